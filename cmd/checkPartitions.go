@@ -0,0 +1,79 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// checkPartitionsCmd represents the checkPartitions command
+var checkPartitionsCmd = &cobra.Command{
+	Use:   "checkPartitions <manifest>...",
+	Short: "Check the partitions of a partitioned snapshot are complete",
+	Long: `Usage
+
+./ipld-eth-state-snapshot checkPartitions [--manifest={merged manifest path}] {partition manifest}...
+
+Reads the manifest written by each partition of a snapshot taken with --partition, and checks that
+there is one for every partition, and that all are of the same blocks. If --manifest is given, a
+manifest of the whole snapshot, merging those of the partitions, is written to it.`,
+	Args: cobra.MinimumNArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.SNAPSHOT_MANIFEST_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MANIFEST_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		checkPartitions(args)
+	},
+}
+
+func checkPartitions(paths []string) {
+	manifests := make([]*snapshot.Manifest, len(paths))
+	for i, path := range paths {
+		manifest, err := snapshot.ReadManifest(path)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		manifests[i] = manifest
+	}
+	merged, err := snapshot.MergePartitions(manifests)
+	if err != nil {
+		logWithCommand.Fatalf("partitions are incomplete: %v", err)
+	}
+	for _, block := range merged.Blocks {
+		logWithCommand.WithField("height", block.Height).WithField("stateRoot", block.StateRoot).
+			Infof("All %d partitions are complete", len(manifests))
+	}
+
+	viper.BindEnv(snapshot.SNAPSHOT_MANIFEST_TOML, snapshot.SNAPSHOT_MANIFEST)
+	if path := viper.GetString(snapshot.SNAPSHOT_MANIFEST_TOML); path != "" {
+		if err := merged.Write(path); err != nil {
+			logWithCommand.Fatalf("failed to write manifest: %v", err)
+		}
+		logWithCommand.Infof("Wrote merged manifest to %s", path)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(checkPartitionsCmd)
+
+	checkPartitionsCmd.PersistentFlags().String(snapshot.SNAPSHOT_MANIFEST_CLI, "", "path to write the merged manifest to")
+}
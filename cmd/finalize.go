@@ -0,0 +1,64 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/output"
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// finalizeCmd represents the finalize command
+var finalizeCmd = &cobra.Command{
+	Use:   "finalize",
+	Short: "Combine and deduplicate the CSV output of file mode snapshots for import",
+	Long: `Usage
+
+./ipld-eth-state-snapshot finalize --output-dir={snapshot output directory}
+
+The CSV files for each table in the output directory and its per-worker subdirectories are
+merged, sorted and deduplicated into the processed_output subdirectory, ready for COPY.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.FILE_OUTPUT_DIR_TOML, cmd.PersistentFlags().Lookup(snapshot.FILE_OUTPUT_DIR_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		finalize()
+	},
+}
+
+func finalize() {
+	config := &snapshot.FileConfig{}
+	if err := snapshot.InitFile(config); err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	if err := output.Finalize(config.OutputDir); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("Finalized output written to %s", filepath.Join(config.OutputDir, output.ProcessedDir))
+}
+
+func init() {
+	rootCmd.AddCommand(finalizeCmd)
+
+	finalizeCmd.PersistentFlags().String(snapshot.FILE_OUTPUT_DIR_CLI, "", "directory of the snapshot output")
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -36,10 +37,14 @@ var (
 )
 
 var rootCmd = &cobra.Command{
-	Use:              "ipld-eth-state-snapshot",
-	PersistentPreRun: initFuncs,
+	Use:               "ipld-eth-state-snapshot",
+	PersistentPreRun:  initFuncs,
+	PersistentPostRun: stopFuncs,
 }
 
+// pusher pushes the metrics to a Pushgateway, if one is configured
+var pusher *prom.Pusher
+
 // Execute executes root Command.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
@@ -65,12 +70,24 @@ func initFuncs(cmd *cobra.Command, args []string) {
 	if err := logLevel(); err != nil {
 		log.Fatal("Could not set log level: ", err)
 	}
+	prom.SetLogInterval(viper.GetDuration(snapshot.LOG_PROGRESS_INTERVAL_TOML))
 
-	if viper.GetBool(snapshot.PROM_METRICS_TOML) {
+	// Pushing metrics requires them to be collected
+	pushURL := viper.GetString(snapshot.PROM_PUSH_URL_TOML)
+	if viper.GetBool(snapshot.PROM_METRICS_TOML) || pushURL != "" {
 		log.Info("Initializing prometheus metrics")
 		prom.Init()
 	}
 
+	if pushURL != "" {
+		log.WithField("url", pushURL).Info("pushing prometheus metrics")
+		pusher = prom.StartPush(pushURL,
+			viper.GetString(snapshot.PROM_PUSH_JOB_TOML),
+			viper.GetDuration(snapshot.PROM_PUSH_INTERVAL_TOML))
+		// Push the final metrics on a fatal exit, as well as a normal one
+		log.RegisterExitHandler(stopPush)
+	}
+
 	if viper.GetBool(snapshot.PROM_HTTP_TOML) {
 		addr := fmt.Sprintf(
 			"%s:%s",
@@ -82,6 +99,20 @@ func initFuncs(cmd *cobra.Command, args []string) {
 	}
 }
 
+func stopFuncs(cmd *cobra.Command, args []string) {
+	stopPush()
+}
+
+// stopPush pushes the final metrics, if pushing is enabled.
+func stopPush() {
+	if pusher == nil {
+		return
+	}
+	if err := pusher.Stop(); err != nil {
+		log.WithError(err).Warn("failed to push final metrics")
+	}
+}
+
 func logLevel() error {
 	lvl, err := log.ParseLevel(viper.GetString(snapshot.LOG_LEVEL_TOML))
 	if err != nil {
@@ -109,12 +140,16 @@ func init() {
 	rootCmd.PersistentFlags().String(snapshot.DATABASE_USER_CLI, "", "database user")
 	rootCmd.PersistentFlags().String(snapshot.DATABASE_PASSWORD_CLI, "", "database password")
 	rootCmd.PersistentFlags().String(snapshot.LOG_LEVEL_CLI, log.InfoLevel.String(), "log level (trace, debug, info, warn, error, fatal, panic)")
+	rootCmd.PersistentFlags().Duration(snapshot.LOG_PROGRESS_INTERVAL_CLI, time.Minute, "interval at which to log snapshot progress (0 to disable)")
 
 	rootCmd.PersistentFlags().Bool(snapshot.PROM_METRICS_CLI, false, "enable prometheus metrics")
 	rootCmd.PersistentFlags().Bool(snapshot.PROM_HTTP_CLI, false, "enable prometheus http service")
 	rootCmd.PersistentFlags().String(snapshot.PROM_HTTP_ADDR_CLI, "127.0.0.1", "prometheus http host")
 	rootCmd.PersistentFlags().String(snapshot.PROM_HTTP_PORT_CLI, "8086", "prometheus http port")
 	rootCmd.PersistentFlags().Bool(snapshot.PROM_DB_STATS_CLI, false, "enables prometheus db stats")
+	rootCmd.PersistentFlags().String(snapshot.PROM_PUSH_URL_CLI, "", "prometheus pushgateway url to push metrics to")
+	rootCmd.PersistentFlags().String(snapshot.PROM_PUSH_JOB_CLI, "ipld-eth-state-snapshot", "prometheus pushgateway job name")
+	rootCmd.PersistentFlags().Duration(snapshot.PROM_PUSH_INTERVAL_CLI, 30*time.Second, "interval at which to push metrics (0 pushes only at the end of each run)")
 
 	viper.BindPFlag(snapshot.LOG_FILE_TOML, rootCmd.PersistentFlags().Lookup(snapshot.LOG_FILE_CLI))
 	viper.BindPFlag(snapshot.DATABASE_NAME_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_NAME_CLI))
@@ -123,12 +158,20 @@ func init() {
 	viper.BindPFlag(snapshot.DATABASE_USER_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_USER_CLI))
 	viper.BindPFlag(snapshot.DATABASE_PASSWORD_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_PASSWORD_CLI))
 	viper.BindPFlag(snapshot.LOG_LEVEL_TOML, rootCmd.PersistentFlags().Lookup(snapshot.LOG_LEVEL_CLI))
+	viper.BindPFlag(snapshot.LOG_PROGRESS_INTERVAL_TOML, rootCmd.PersistentFlags().Lookup(snapshot.LOG_PROGRESS_INTERVAL_CLI))
+	viper.BindEnv(snapshot.LOG_PROGRESS_INTERVAL_TOML, snapshot.LOG_PROGRESS_INTERVAL)
 
 	viper.BindPFlag(snapshot.PROM_METRICS_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_METRICS_CLI))
 	viper.BindPFlag(snapshot.PROM_HTTP_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_HTTP_CLI))
 	viper.BindPFlag(snapshot.PROM_HTTP_ADDR_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_HTTP_ADDR_CLI))
 	viper.BindPFlag(snapshot.PROM_HTTP_PORT_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_HTTP_PORT_CLI))
 	viper.BindPFlag(snapshot.PROM_DB_STATS_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_DB_STATS_CLI))
+	viper.BindPFlag(snapshot.PROM_PUSH_URL_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_PUSH_URL_CLI))
+	viper.BindPFlag(snapshot.PROM_PUSH_JOB_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_PUSH_JOB_CLI))
+	viper.BindPFlag(snapshot.PROM_PUSH_INTERVAL_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_PUSH_INTERVAL_CLI))
+	viper.BindEnv(snapshot.PROM_PUSH_URL_TOML, snapshot.PROM_PUSH_URL)
+	viper.BindEnv(snapshot.PROM_PUSH_JOB_TOML, snapshot.PROM_PUSH_JOB)
+	viper.BindEnv(snapshot.PROM_PUSH_INTERVAL_TOML, snapshot.PROM_PUSH_INTERVAL)
 }
 
 func initConfig() {
@@ -0,0 +1,104 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// stateDiffCmd represents the stateDiff command
+var stateDiffCmd = &cobra.Command{
+	Use:   "stateDiff",
+	Short: "Extract the Ethereum state which changed between two heights and publish into PG-IPFS",
+	Long: `Usage
+
+./ipld-eth-state-snapshot stateDiff --config={path to toml config file}
+
+Applied on top of a snapshot at --from-height, the output forms a snapshot at --to-height.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindSnapshotFlags(cmd)
+		viper.BindPFlag(snapshot.SNAPSHOT_FROM_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_FROM_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_TO_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_TO_HEIGHT_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		stateDiff()
+	},
+}
+
+func stateDiff() {
+	mode := snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_MODE_TOML))
+	config, err := snapshot.NewConfig(mode)
+	if err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	from := viper.GetUint64(snapshot.SNAPSHOT_FROM_HEIGHT_TOML)
+	to := viper.GetUint64(snapshot.SNAPSHOT_TO_HEIGHT_TOML)
+	if from >= to {
+		logWithCommand.Fatalf("from height %d must be less than to height %d", from, to)
+	}
+	if len(config.Service.WatchedStorage) != 0 {
+		logWithCommand.Fatal("watched storage slots are not supported for state diffs")
+	}
+	if config.Service.Partition != nil {
+		logWithCommand.Fatal("partitions are not supported for state diffs")
+	}
+	recoveryFile := viper.GetString(snapshot.SNAPSHOT_RECOVERY_FILE_TOML)
+	if recoveryFile == "" {
+		recoveryFile = fmt.Sprintf("./%d_%d_diff_recovery", from, to)
+		logWithCommand.Infof("no recovery file set, using default: %s", recoveryFile)
+	}
+
+	start := time.Now()
+	snapshotService := newSnapshotService(config, mode, recoveryFile)
+	params := snapshot.StateDiffParams{
+		FromHeight:            from,
+		ToHeight:              to,
+		Workers:               viper.GetUint(snapshot.SNAPSHOT_WORKERS_TOML),
+		WatchedAddresses:      config.Service.AllowedAccounts,
+		Filter:                config.Service.Filter,
+		FullBlock:             config.Service.FullBlock,
+		AllowMissingBlockData: config.Service.AllowMissingBlockData,
+		CommitInterval:        config.Service.CommitInterval,
+	}
+	if err := snapshotService.CreateStateDiff(params); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("State diff from height %d to %d is complete", from, to)
+
+	manifest := snapshotService.Manifest("stateDiff")
+	manifest.Range.Start = from
+	if err := snapshotService.Close(); err != nil {
+		logWithCommand.Fatalf("failed to close indexer: %v", err)
+	}
+	writeManifest(manifest, config, mode, start)
+}
+
+func init() {
+	rootCmd.AddCommand(stateDiffCmd)
+
+	addSnapshotFlags(stateDiffCmd)
+	stateDiffCmd.PersistentFlags().Uint64(snapshot.SNAPSHOT_FROM_HEIGHT_CLI, 0, "block height of the base snapshot")
+	stateDiffCmd.PersistentFlags().Uint64(snapshot.SNAPSHOT_TO_HEIGHT_CLI, 0, "block height to diff the base snapshot to")
+}
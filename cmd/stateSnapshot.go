@@ -18,13 +18,21 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/output"
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/parquet"
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/pgcopy"
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/prom"
 	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
 	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/database/sql"
+	"github.com/ethereum/go-ethereum/params"
 )
 
 // stateSnapshotCmd represents the stateSnapshot command
@@ -34,6 +42,11 @@ var stateSnapshotCmd = &cobra.Command{
 	Long: `Usage
 
 ./ipld-eth-state-snapshot stateSnapshot --config={path to toml config file}`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindSnapshotFlags(cmd)
+		viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.FILE_FINALIZE_TOML, cmd.PersistentFlags().Lookup(snapshot.FILE_FINALIZE_CLI))
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		subCommand = cmd.CalledAs()
 		logWithCommand = *logrus.WithField("SubCommand", subCommand)
@@ -47,17 +60,112 @@ func stateSnapshot() {
 	if err != nil {
 		logWithCommand.Fatalf("unable to initialize config: %v", err)
 	}
-	logWithCommand.Infof("opening levelDB and ancient data at %s and %s",
-		config.Eth.LevelDBPath, config.Eth.AncientDBPath)
-	edb, err := snapshot.NewLevelDB(config.Eth)
-	if err != nil {
-		logWithCommand.Fatal(err)
-	}
 	height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
 	recoveryFile := viper.GetString(snapshot.SNAPSHOT_RECOVERY_FILE_TOML)
+
+	start := time.Now()
+	snapshotService := newSnapshotService(config, mode, recoveryFile)
+	if height < 0 {
+		// The latest height is resolved here, so that the default recovery file is named by it
+		latest, err := snapshotService.LatestHeight()
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		height = int64(latest)
+		logWithCommand.Infof("snapshotting latest height %d", height)
+	}
 	if recoveryFile == "" {
 		recoveryFile = fmt.Sprintf("./%d_snapshot_recovery", height)
 		logWithCommand.Infof("no recovery file set, using default: %s", recoveryFile)
+		snapshotService.SetRecoveryFile(recoveryFile)
+	}
+	params := snapshot.SnapshotParams{
+		Workers:               viper.GetUint(snapshot.SNAPSHOT_WORKERS_TOML),
+		WatchedAddresses:      config.Service.AllowedAccounts,
+		WatchedStorage:        config.Service.WatchedStorage,
+		Filter:                config.Service.Filter,
+		FullBlock:             config.Service.FullBlock,
+		AllowMissingBlockData: config.Service.AllowMissingBlockData,
+		CommitInterval:        config.Service.CommitInterval,
+		Partition:             config.Service.Partition,
+	}
+	params.Height = uint64(height)
+	if err := snapshotService.CreateSnapshot(params); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	manifest := snapshotService.Manifest("snapshot")
+	logWithCommand.Infof("State snapshot at height %d is complete", manifest.Range.Stop)
+
+	if err := snapshotService.Close(); err != nil {
+		logWithCommand.Fatalf("failed to close indexer: %v", err)
+	}
+	if mode == snapshot.FileSnapshot && config.File.Format == snapshot.CSVFormat && config.File.Finalize {
+		logWithCommand.Infof("Finalizing output in %s", config.File.OutputDir)
+		if err := output.Finalize(config.File.OutputDir); err != nil {
+			logWithCommand.Fatalf("failed to finalize output: %v", err)
+		}
+	}
+	writeManifest(manifest, config, mode, start)
+}
+
+// writeManifest completes the manifest of a run which started at the given time, and writes it to
+// the configured path. It should be called once the output is complete.
+func writeManifest(manifest *snapshot.Manifest, config *snapshot.Config, mode snapshot.SnapshotMode, start time.Time) {
+	manifest.Time.Start, manifest.Time.Stop = start.UTC(), time.Now().UTC()
+	manifest.SetNodeInfo(config.Eth)
+	manifest.Mode = mode
+	manifest.Workers = viper.GetUint(snapshot.SNAPSHOT_WORKERS_TOML)
+	manifest.WatchedAddresses = config.Service.AllowedAccounts
+	manifest.WatchedStorage = config.Service.WatchedStorage
+	manifest.Partition = config.Service.Partition
+	manifest.Filter = config.Service.Filter
+
+	path := config.Service.ManifestPath
+	if mode == snapshot.FileSnapshot {
+		manifest.Format = config.File.Format
+		if err := manifest.AddFiles(config.File.OutputDir); err != nil {
+			logWithCommand.Fatalf("failed to checksum output files: %v", err)
+		}
+		if path == "" {
+			path = filepath.Join(config.File.OutputDir, snapshot.ManifestFileName)
+		}
+	} else if path == "" {
+		path = snapshot.ManifestFileName
+	}
+	if err := manifest.Write(path); err != nil {
+		logWithCommand.Fatalf("failed to write manifest: %v", err)
+	}
+	logWithCommand.Infof("Wrote manifest to %s", path)
+}
+
+// newSnapshotService opens the source database and the indexer for the output mode, and creates
+// the snapshot service.
+func newSnapshotService(config *snapshot.Config, mode snapshot.SnapshotMode, recoveryFile string) *snapshot.Service {
+	logWithCommand.Infof("opening chain database and ancient data at %s and %s",
+		config.Eth.LevelDBPath, config.Eth.AncientDBPath)
+	edb, err := snapshot.NewLevelDB(config.Eth)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+
+	// Periodic commits rely on the rows written again on resuming being skipped
+	if config.Service.CommitInterval != 0 && mode != snapshot.PgSnapshot && mode != snapshot.PgCopySnapshot {
+		logWithCommand.Fatalf("commit interval is only supported in postgres modes, not %s", mode)
+	}
+
+	// The chain config is needed to index the transactions and receipts of full blocks
+	var chainConfig *params.ChainConfig
+	if config.Service.FullBlock {
+		if mode == snapshot.PgCopySnapshot {
+			logWithCommand.Fatalf("full block export is not supported in %s mode", mode)
+		}
+		if mode == snapshot.FileSnapshot && config.File.Format == snapshot.ParquetFormat {
+			logWithCommand.Fatalf("full block export is not supported for %s output", config.File.Format)
+		}
+		chainConfig, err = snapshot.ReadChainConfig(edb)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
 	}
 
 	var idxconfig indexer.Config
@@ -65,55 +173,108 @@ func stateSnapshot() {
 	case snapshot.PgSnapshot:
 		idxconfig = *config.DB
 	case snapshot.FileSnapshot:
-		idxconfig = *config.File
-	}
-	_, indexer, err := indexer.NewStateDiffIndexer(
-		context.Background(),
-		nil, // ChainConfig is only used in PushBlock, which we don't call
-		config.Eth.NodeInfo,
-		idxconfig,
-		false,
-	)
+		idxconfig = config.File.Config
+	}
+	var idx indexer.Indexer
+	// the stats of the connection pool, in the postgres modes
+	var dbStats prom.DBStatsGetter
+	switch {
+	case mode == snapshot.PgCopySnapshot:
+		var copyIdx *pgcopy.Indexer
+		copyIdx, err = pgcopy.NewIndexer(context.Background(), *config.DB, config.Eth.NodeInfo)
+		idx, dbStats = copyIdx, copyIdx
+	case mode == snapshot.FileSnapshot && config.File.Format == snapshot.ParquetFormat:
+		// partition by worker
+		workers := viper.GetUint(snapshot.SNAPSHOT_WORKERS_TOML)
+		idx, err = parquet.NewIndexer(config.File.OutputDir, workers, config.Eth.NodeInfo)
+	default:
+		var db sql.Database
+		db, idx, err = indexer.NewStateDiffIndexer(
+			context.Background(),
+			chainConfig, // only used by PushBlock, so nil unless exporting full blocks
+			config.Eth.NodeInfo,
+			idxconfig,
+			false,
+		)
+		if db != nil {
+			dbStats = db
+		}
+	}
 	if err != nil {
 		logWithCommand.Fatal(err)
 	}
+	if viper.GetBool(snapshot.PROM_DB_STATS_TOML) {
+		prom.RegisterChainDBCollector(config.Eth.Engine, edb)
+		if dbStats != nil {
+			prom.RegisterDBCollector(config.DB.DatabaseName, dbStats)
+		}
+	}
 
-	snapshotService, err := snapshot.NewSnapshotService(edb, indexer, recoveryFile)
+	snapshotService, err := snapshot.NewSnapshotService(edb, idx, recoveryFile)
 	if err != nil {
 		logWithCommand.Fatal(err)
 	}
-	workers := viper.GetUint(snapshot.SNAPSHOT_WORKERS_TOML)
-	if height < 0 {
-		if err := snapshotService.CreateLatestSnapshot(workers, config.Service.AllowedAccounts); err != nil {
-			logWithCommand.Fatal(err)
-		}
-	} else {
-		params := snapshot.SnapshotParams{Workers: workers, Height: uint64(height), WatchedAddresses: config.Service.AllowedAccounts}
-		if err := snapshotService.CreateSnapshot(params); err != nil {
-			logWithCommand.Fatal(err)
-		}
-	}
-	logWithCommand.Infof("State snapshot at height %d is complete", height)
+	snapshotService.SetRecoveryOptions(mode, config.Service.DiscardRecovery)
+	return snapshotService
 }
 
 func init() {
 	rootCmd.AddCommand(stateSnapshotCmd)
 
-	stateSnapshotCmd.PersistentFlags().String(snapshot.LEVELDB_PATH_CLI, "", "path to primary datastore")
-	stateSnapshotCmd.PersistentFlags().String(snapshot.LEVELDB_ANCIENT_CLI, "", "path to ancient datastore")
+	addSnapshotFlags(stateSnapshotCmd)
 	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, "", "block height to extract state at")
-	stateSnapshotCmd.PersistentFlags().Int(snapshot.SNAPSHOT_WORKERS_CLI, 1, "number of concurrent workers to use")
-	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_RECOVERY_FILE_CLI, "", "file to recover from a previous iteration")
-	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_MODE_CLI, "postgres", "output mode for snapshot ('file' or 'postgres')")
-	stateSnapshotCmd.PersistentFlags().String(snapshot.FILE_OUTPUT_DIR_CLI, "", "directory for writing ouput to while operating in 'file' mode")
-	stateSnapshotCmd.PersistentFlags().StringArray(snapshot.SNAPSHOT_ACCOUNTS_CLI, nil, "list of account addresses to limit snapshot to")
-
-	viper.BindPFlag(snapshot.LEVELDB_PATH_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.LEVELDB_PATH_CLI))
-	viper.BindPFlag(snapshot.LEVELDB_ANCIENT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.LEVELDB_ANCIENT_CLI))
-	viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
-	viper.BindPFlag(snapshot.SNAPSHOT_WORKERS_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_WORKERS_CLI))
-	viper.BindPFlag(snapshot.SNAPSHOT_RECOVERY_FILE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_RECOVERY_FILE_CLI))
-	viper.BindPFlag(snapshot.SNAPSHOT_MODE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MODE_CLI))
-	viper.BindPFlag(snapshot.FILE_OUTPUT_DIR_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.FILE_OUTPUT_DIR_CLI))
-	viper.BindPFlag(snapshot.SNAPSHOT_ACCOUNTS_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_ACCOUNTS_CLI))
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.FILE_FINALIZE_CLI, false, "combine and deduplicate CSV output when complete")
+}
+
+// addSnapshotFlags adds the flags shared by all snapshot commands.
+func addSnapshotFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String(snapshot.LEVELDB_PATH_CLI, "", "path to primary datastore")
+	cmd.PersistentFlags().String(snapshot.LEVELDB_ANCIENT_CLI, "", "path to ancient datastore")
+	cmd.PersistentFlags().String(snapshot.LEVELDB_ENGINE_CLI, "", "engine of primary datastore ('leveldb' or 'pebble'; detected if unset)")
+	cmd.PersistentFlags().Int(snapshot.SNAPSHOT_WORKERS_CLI, 1, "number of concurrent workers to use")
+	cmd.PersistentFlags().String(snapshot.SNAPSHOT_RECOVERY_FILE_CLI, "", "file to recover from a previous iteration")
+	cmd.PersistentFlags().Bool(snapshot.SNAPSHOT_DISCARD_RECOVERY_CLI, false, "discard a recovery file written by a different run, rather than refusing to start")
+	cmd.PersistentFlags().Uint64(snapshot.SNAPSHOT_COMMIT_INTERVAL_CLI, 0, "number of state nodes after which to commit the output in postgres modes (0 commits once complete)")
+	cmd.PersistentFlags().String(snapshot.SNAPSHOT_PARTITION_CLI, "", "slice of the state trie to snapshot, as <index>/<count> with index from 0")
+	cmd.PersistentFlags().String(snapshot.SNAPSHOT_MODE_CLI, "postgres", "output mode for snapshot ('file', 'postgres' or 'postgres-copy')")
+	cmd.PersistentFlags().String(snapshot.FILE_OUTPUT_DIR_CLI, "", "directory for writing ouput to while operating in 'file' mode")
+	cmd.PersistentFlags().String(snapshot.FILE_FORMAT_CLI, "", "format of files written in 'file' mode ('csv' or 'parquet')")
+	cmd.PersistentFlags().StringArray(snapshot.SNAPSHOT_ACCOUNTS_CLI, nil, "list of account addresses to limit snapshot to")
+	cmd.PersistentFlags().StringArray(snapshot.SNAPSHOT_STORAGE_CLI, nil, "storage slots to limit snapshot of an account to, as <address>:<slot>[,<slot>...]")
+	cmd.PersistentFlags().StringArray(snapshot.SNAPSHOT_DENY_ACCOUNTS_CLI, nil, "list of account addresses to exclude from snapshot")
+	cmd.PersistentFlags().Bool(snapshot.SNAPSHOT_EOA_ONLY_CLI, false, "exclude contract accounts from snapshot")
+	cmd.PersistentFlags().Bool(snapshot.SNAPSHOT_CONTRACTS_ONLY_CLI, false, "exclude externally owned accounts from snapshot")
+	cmd.PersistentFlags().String(snapshot.SNAPSHOT_MIN_BALANCE_CLI, "", "exclude accounts with a balance (in wei) below this from snapshot")
+	cmd.PersistentFlags().StringArray(snapshot.SNAPSHOT_CODE_HASHES_CLI, nil, "list of code hashes to limit snapshot to accounts with")
+	cmd.PersistentFlags().Uint64(snapshot.SNAPSHOT_MAX_STORAGE_SLOTS_CLI, 0, "exclude accounts with more storage slots than this from snapshot")
+	cmd.PersistentFlags().Bool(snapshot.SNAPSHOT_FULL_BLOCK_CLI, false, "index the complete block (transactions, receipts, logs and uncles), not only the header")
+	cmd.PersistentFlags().Bool(snapshot.SNAPSHOT_ALLOW_MISSING_CLI, false, "index the header with zero total difficulty or reward if they cannot be determined, rather than failing")
+	cmd.PersistentFlags().String(snapshot.SNAPSHOT_MANIFEST_CLI, "", "path to write the manifest of the run to (default: metadata.json in the output directory in 'file' mode, else in the working directory)")
+}
+
+// bindSnapshotFlags binds the shared flags of the command being run to their config keys. This is
+// done on execution rather than in init, since a key can only be bound to a single flag.
+func bindSnapshotFlags(cmd *cobra.Command) {
+	viper.BindPFlag(snapshot.LEVELDB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.LEVELDB_PATH_CLI))
+	viper.BindPFlag(snapshot.LEVELDB_ANCIENT_TOML, cmd.PersistentFlags().Lookup(snapshot.LEVELDB_ANCIENT_CLI))
+	viper.BindPFlag(snapshot.LEVELDB_ENGINE_TOML, cmd.PersistentFlags().Lookup(snapshot.LEVELDB_ENGINE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_WORKERS_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_WORKERS_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_RECOVERY_FILE_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_RECOVERY_FILE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_DISCARD_RECOVERY_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_DISCARD_RECOVERY_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_COMMIT_INTERVAL_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_COMMIT_INTERVAL_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_PARTITION_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_PARTITION_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_MODE_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MODE_CLI))
+	viper.BindPFlag(snapshot.FILE_OUTPUT_DIR_TOML, cmd.PersistentFlags().Lookup(snapshot.FILE_OUTPUT_DIR_CLI))
+	viper.BindPFlag(snapshot.FILE_FORMAT_TOML, cmd.PersistentFlags().Lookup(snapshot.FILE_FORMAT_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_ACCOUNTS_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_ACCOUNTS_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_STORAGE_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_STORAGE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_DENY_ACCOUNTS_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_DENY_ACCOUNTS_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_EOA_ONLY_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_EOA_ONLY_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_CONTRACTS_ONLY_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_CONTRACTS_ONLY_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_MIN_BALANCE_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MIN_BALANCE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_CODE_HASHES_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_CODE_HASHES_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_MAX_STORAGE_SLOTS_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MAX_STORAGE_SLOTS_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_FULL_BLOCK_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_FULL_BLOCK_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_ALLOW_MISSING_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_ALLOW_MISSING_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_MANIFEST_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MANIFEST_CLI))
 }
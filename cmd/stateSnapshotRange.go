@@ -0,0 +1,115 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// stateSnapshotRangeCmd represents the stateSnapshotRange command
+var stateSnapshotRangeCmd = &cobra.Command{
+	Use:   "stateSnapshotRange",
+	Short: "Extract the Ethereum state at multiple heights and publish into PG-IPFS",
+	Long: `Usage
+
+./ipld-eth-state-snapshot stateSnapshotRange --config={path to toml config file}
+
+Heights are given either as an explicit list (--heights) or as a range (--start-height,
+--stop-height and --height-step).`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindSnapshotFlags(cmd)
+		viper.BindPFlag(snapshot.SNAPSHOT_START_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_START_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_STOP_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_STOP_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_HEIGHT_STEP_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_HEIGHT_STEP_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_HEIGHTS_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_HEIGHTS_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_DEDUP_IPLDS_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_DEDUP_IPLDS_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		stateSnapshotRange()
+	},
+}
+
+func stateSnapshotRange() {
+	mode := snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_MODE_TOML))
+	config, err := snapshot.NewConfig(mode)
+	if err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+
+	var heights []uint64
+	if err := viper.UnmarshalKey(snapshot.SNAPSHOT_HEIGHTS_TOML, &heights); err != nil {
+		logWithCommand.Fatalf("invalid snapshot heights: %v", err)
+	}
+	if len(heights) == 0 {
+		heights, err = snapshot.HeightRange(
+			viper.GetUint64(snapshot.SNAPSHOT_START_HEIGHT_TOML),
+			viper.GetUint64(snapshot.SNAPSHOT_STOP_HEIGHT_TOML),
+			viper.GetUint64(snapshot.SNAPSHOT_HEIGHT_STEP_TOML),
+		)
+		if err != nil {
+			logWithCommand.Fatalf("invalid snapshot range: %v", err)
+		}
+	}
+	// per-height recovery files are derived from this, e.g. ./32_snapshot_recovery
+	recoveryFile := viper.GetString(snapshot.SNAPSHOT_RECOVERY_FILE_TOML)
+	if recoveryFile == "" {
+		recoveryFile = "./snapshot_recovery"
+		logWithCommand.Infof("no recovery file set, using default: %s", recoveryFile)
+	}
+
+	start := time.Now()
+	snapshotService := newSnapshotService(config, mode, recoveryFile)
+	params := snapshot.SnapshotParams{
+		Workers:               viper.GetUint(snapshot.SNAPSHOT_WORKERS_TOML),
+		WatchedAddresses:      config.Service.AllowedAccounts,
+		WatchedStorage:        config.Service.WatchedStorage,
+		Filter:                config.Service.Filter,
+		FullBlock:             config.Service.FullBlock,
+		AllowMissingBlockData: config.Service.AllowMissingBlockData,
+		CommitInterval:        config.Service.CommitInterval,
+		Partition:             config.Service.Partition,
+		DedupIPLDs:            viper.GetBool(snapshot.SNAPSHOT_DEDUP_IPLDS_TOML),
+	}
+	if err := snapshotService.CreateSnapshotRange(heights, params); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("State snapshots at %d heights are complete", len(heights))
+
+	manifest := snapshotService.Manifest("snapshotRange")
+	if err := snapshotService.Close(); err != nil {
+		logWithCommand.Fatalf("failed to close indexer: %v", err)
+	}
+	writeManifest(manifest, config, mode, start)
+}
+
+func init() {
+	rootCmd.AddCommand(stateSnapshotRangeCmd)
+
+	addSnapshotFlags(stateSnapshotRangeCmd)
+	stateSnapshotRangeCmd.PersistentFlags().Uint64(snapshot.SNAPSHOT_START_HEIGHT_CLI, 0, "first block height of the range")
+	stateSnapshotRangeCmd.PersistentFlags().Uint64(snapshot.SNAPSHOT_STOP_HEIGHT_CLI, 0, "last block height of the range (inclusive)")
+	stateSnapshotRangeCmd.PersistentFlags().Uint64(snapshot.SNAPSHOT_HEIGHT_STEP_CLI, 1, "interval between block heights of the range")
+	stateSnapshotRangeCmd.PersistentFlags().StringSlice(snapshot.SNAPSHOT_HEIGHTS_CLI, nil, "explicit list of block heights to extract state at (overrides range)")
+	stateSnapshotRangeCmd.PersistentFlags().Bool(snapshot.SNAPSHOT_DEDUP_IPLDS_CLI, false, "skip IPLD blocks already emitted for an earlier height (see README)")
+}
@@ -0,0 +1,85 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/output"
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// validateOutputCmd represents the validate-output command
+var validateOutputCmd = &cobra.Command{
+	Use:   "validate-output",
+	Short: "Validate the CSV output of file mode snapshots against the ipld-eth-db schema",
+	Long: `Usage
+
+./ipld-eth-state-snapshot validate-output --output-dir={snapshot output directory} [--quarantine-dir={directory}]
+
+Each row of the CSV files in the output directory, its per-worker subdirectories and the
+processed_output subdirectory is checked against the schema of its table: the number of columns,
+CID formats and codecs, hex key lengths, block numbers and other numeric, boolean and bytea values.
+Bad rows are reported; if a quarantine directory is given they are also moved to files of the same
+relative path there. Exits with a non-zero status if any bad rows are found.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.FILE_OUTPUT_DIR_TOML, cmd.PersistentFlags().Lookup(snapshot.FILE_OUTPUT_DIR_CLI))
+		viper.BindPFlag(snapshot.FILE_QUARANTINE_DIR_TOML, cmd.PersistentFlags().Lookup(snapshot.FILE_QUARANTINE_DIR_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		validateOutput()
+	},
+}
+
+func validateOutput() {
+	config := &snapshot.FileConfig{}
+	if err := snapshot.InitFile(config); err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	results, err := output.ValidateOutput(config.OutputDir, config.QuarantineDir)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+
+	var corrupt int
+	for _, res := range results {
+		for _, bad := range res.Bad {
+			logWithCommand.Error(bad)
+		}
+		if len(res.Bad) > 0 {
+			corrupt++
+			logWithCommand.Warnf("%s: %d of %d rows are invalid", res.File, len(res.Bad), res.Rows)
+		}
+	}
+	if corrupt > 0 {
+		if config.QuarantineDir != "" {
+			logWithCommand.Infof("Invalid rows moved to %s", config.QuarantineDir)
+		}
+		logWithCommand.Fatalf("%d of %d files contain invalid rows", corrupt, len(results))
+	}
+	logWithCommand.Infof("Validated %d files", len(results))
+}
+
+func init() {
+	rootCmd.AddCommand(validateOutputCmd)
+
+	validateOutputCmd.PersistentFlags().String(snapshot.FILE_OUTPUT_DIR_CLI, "", "directory of the snapshot output")
+	validateOutputCmd.PersistentFlags().String(snapshot.FILE_QUARANTINE_DIR_CLI, "", "directory to move invalid rows to")
+}
@@ -0,0 +1,136 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"os"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/verify"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify a snapshot is complete by rebuilding the state from its output",
+	Long: `Usage
+
+./ipld-eth-state-snapshot verify --config={path to toml config file} --block-height={snapshot height}
+
+Reads the snapshot at the height back from Postgres or the CSV files of file mode, rebuilds the state
+trie and every storage trie from the IPLD blocks, and checks the state root matches that of the
+header. Lists any missing trie node CIDs and any trie node blocks at the height which are not part
+of the state, and exits with a non-zero status if the snapshot is incomplete.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.SNAPSHOT_MODE_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MODE_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.FILE_OUTPUT_DIR_TOML, cmd.PersistentFlags().Lookup(snapshot.FILE_OUTPUT_DIR_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		verifySnapshot()
+	},
+}
+
+func verifySnapshot() {
+	viper.BindEnv(snapshot.SNAPSHOT_MODE_TOML, snapshot.SNAPSHOT_MODE)
+	viper.BindEnv(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, snapshot.SNAPSHOT_BLOCK_HEIGHT)
+	mode := snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_MODE_TOML))
+	height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+	if height < 0 {
+		logWithCommand.Fatal("block height must be set")
+	}
+
+	// Visited nodes, and in file mode the IPLD blocks, are tracked on disk
+	tmpDir, err := os.MkdirTemp("", "ipld-eth-state-snapshot-verify-")
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	store, err := rawdb.NewLevelDBDatabase(tmpDir, 256, 256, "", false)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	defer store.Close()
+
+	var source verify.Source
+	switch mode {
+	case snapshot.PgSnapshot, snapshot.PgCopySnapshot:
+		config := &snapshot.DBConfig{}
+		snapshot.InitDB(config)
+		pgSource, err := verify.NewPostgresSource(context.Background(), *config)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		defer pgSource.Close()
+		source = pgSource
+	case snapshot.FileSnapshot:
+		config := &snapshot.FileConfig{}
+		if err := snapshot.InitFile(config); err != nil {
+			logWithCommand.Fatalf("unable to initialize config: %v", err)
+		}
+		if config.Format != snapshot.CSVFormat {
+			logWithCommand.Fatalf("verification of %s output is not supported", config.Format)
+		}
+		source, err = verify.NewCSVSource(config.OutputDir, uint64(height), store)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+	default:
+		logWithCommand.Fatalf("unsupported output mode: %s", mode)
+	}
+
+	res, err := verify.NewVerifier(source, store).Verify(uint64(height))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	for _, key := range res.Missing {
+		logWithCommand.WithField("cid", key).Error("missing trie node")
+	}
+	for _, key := range res.Dangling {
+		logWithCommand.WithField("cid", key).Error("dangling trie node")
+	}
+	for _, root := range res.BadStorageRoots {
+		logWithCommand.WithField("root", root).Error("storage trie does not match its root")
+	}
+	logWithCommand.WithField("accounts", res.Accounts).
+		WithField("stateNodes", res.StateNodes).
+		WithField("storageNodes", res.StorageNodes).
+		Infof("expected state root %s, computed %s", res.StateRoot, res.ComputedRoot)
+	if !res.OK() {
+		// deferred cleanup is skipped by Fatal
+		store.Close()
+		os.RemoveAll(tmpDir)
+		logWithCommand.Fatalf("snapshot at height %d is incomplete: %d missing and %d dangling nodes",
+			height, len(res.Missing), len(res.Dangling))
+	}
+	logWithCommand.Infof("Snapshot at height %d is complete", height)
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.PersistentFlags().String(snapshot.SNAPSHOT_MODE_CLI, "postgres", "output mode of the snapshot ('file', 'postgres' or 'postgres-copy')")
+	verifyCmd.PersistentFlags().String(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, "", "block height of the snapshot")
+	verifyCmd.PersistentFlags().String(snapshot.FILE_OUTPUT_DIR_CLI, "", "directory of the snapshot output in 'file' mode")
+}
@@ -23,6 +23,10 @@ type Indexer struct {
 
 type IndexerData struct {
 	Headers    map[uint64]*types.Header
+	Rewards    map[uint64]*big.Int
+	TDs        map[uint64]*big.Int
+	Blocks     map[uint64]*types.Block
+	Receipts   map[uint64]types.Receipts
 	StateNodes []sdtypes.StateLeafNode
 	IPLDs      []sdtypes.IPLD
 }
@@ -36,18 +40,34 @@ func NewIndexer(t *testing.T) *Indexer {
 	return &Indexer{
 		MockgenIndexer: NewMockgenIndexer(ctl),
 		IndexerData: IndexerData{
-			Headers: make(map[uint64]*types.Header),
+			Headers:  make(map[uint64]*types.Header),
+			Rewards:  make(map[uint64]*big.Int),
+			TDs:      make(map[uint64]*big.Int),
+			Blocks:   make(map[uint64]*types.Block),
+			Receipts: make(map[uint64]types.Receipts),
 		},
 	}
 }
 
-func (i *Indexer) PushHeader(_ indexer.Batch, header *types.Header, _, _ *big.Int) (string, error) {
+func (i *Indexer) PushHeader(_ indexer.Batch, header *types.Header, reward, td *big.Int) (string, error) {
 	i.Lock()
 	defer i.Unlock()
 	i.Headers[header.Number.Uint64()] = header
+	i.Rewards[header.Number.Uint64()] = reward
+	i.TDs[header.Number.Uint64()] = td
 	return header.Hash().String(), nil
 }
 
+func (i *Indexer) PushBlock(block *types.Block, receipts types.Receipts, td *big.Int) (indexer.Batch, error) {
+	i.Lock()
+	defer i.Unlock()
+	i.Headers[block.NumberU64()] = block.Header()
+	i.TDs[block.NumberU64()] = td
+	i.Blocks[block.NumberU64()] = block
+	i.Receipts[block.NumberU64()] = receipts
+	return Batch{}, nil
+}
+
 func (i *Indexer) PushStateNode(_ indexer.Batch, stateNode sdtypes.StateLeafNode, _ string) error {
 	i.Lock()
 	defer i.Unlock()
@@ -86,3 +106,95 @@ func (i *InterruptingIndexer) PushStateNode(b indexer.Batch, stateNode sdtypes.S
 	}
 	return i.Indexer.PushStateNode(b, stateNode, h)
 }
+
+// TxIndexer holds the state nodes and IPLDs pushed to a batch until it is submitted, when those
+// which already exist are skipped, as the database does on conflict.
+type TxIndexer struct {
+	*Indexer
+
+	// FailSubmit, if non-zero, is the number of the submission to fail, counting from 1
+	FailSubmit int
+	submitted  int
+	stateKeys  map[string]struct{}
+	cids       map[string]struct{}
+}
+
+// TxBatch is a batch of a TxIndexer.
+type TxBatch struct {
+	sync.Mutex
+	idx        *TxIndexer
+	stateNodes []sdtypes.StateLeafNode
+	iplds      []sdtypes.IPLD
+}
+
+// NewTxIndexer returns a mock indexer which commits data on submission.
+func NewTxIndexer(t *testing.T) *TxIndexer {
+	return &TxIndexer{
+		Indexer:   NewIndexer(t),
+		stateKeys: make(map[string]struct{}),
+		cids:      make(map[string]struct{}),
+	}
+}
+
+func (i *TxIndexer) BeginTx(_ *big.Int, _ context.Context) indexer.Batch {
+	return &TxBatch{idx: i}
+}
+
+func (i *TxIndexer) PushBlock(block *types.Block, receipts types.Receipts, td *big.Int) (indexer.Batch, error) {
+	if _, err := i.Indexer.PushBlock(block, receipts, td); err != nil {
+		return nil, err
+	}
+	return &TxBatch{idx: i}, nil
+}
+
+func (i *TxIndexer) PushStateNode(b indexer.Batch, stateNode sdtypes.StateLeafNode, _ string) error {
+	tx := b.(*TxBatch)
+	tx.Lock()
+	defer tx.Unlock()
+	tx.stateNodes = append(tx.stateNodes, stateNode)
+	return nil
+}
+
+func (i *TxIndexer) PushIPLD(b indexer.Batch, ipld sdtypes.IPLD) error {
+	tx := b.(*TxBatch)
+	tx.Lock()
+	defer tx.Unlock()
+	tx.iplds = append(tx.iplds, ipld)
+	return nil
+}
+
+func (tx *TxBatch) Submit() error {
+	i := tx.idx
+	i.Lock()
+	defer i.Unlock()
+	i.submitted++
+	if i.submitted == i.FailSubmit {
+		return fmt.Errorf("mock submission failure")
+	}
+	for _, node := range tx.stateNodes {
+		key := string(node.AccountWrapper.LeafKey)
+		if _, has := i.stateKeys[key]; !has {
+			i.stateKeys[key] = struct{}{}
+			i.StateNodes = append(i.StateNodes, node)
+		}
+	}
+	for _, ipld := range tx.iplds {
+		if _, has := i.cids[ipld.CID]; !has {
+			i.cids[ipld.CID] = struct{}{}
+			i.IPLDs = append(i.IPLDs, ipld)
+		}
+	}
+	tx.stateNodes, tx.iplds = nil, nil
+	return nil
+}
+
+func (tx *TxBatch) BlockNumber() string { return "0" }
+
+func (tx *TxBatch) RollbackOnFailure(err error) {
+	if err == nil {
+		return
+	}
+	tx.Lock()
+	defer tx.Unlock()
+	tx.stateNodes, tx.iplds = nil, nil
+}
@@ -0,0 +1,285 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package output post-processes the CSV output of file mode snapshots.
+package output
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProcessedDir is the directory within the output directory which finalized files are written to.
+const ProcessedDir = "processed_output"
+
+// DefaultChunkSize is the size of input sorted in memory at a time when finalizing.
+const DefaultChunkSize = 256 << 20
+
+// ProcessedFiles maps the snapshot tables to the names of their finalized files, as expected by
+// the documented COPY commands.
+var ProcessedFiles = map[*schema.Table]string{
+	&schema.TableNodeInfo:    "public.nodes.csv",
+	&schema.TableIPLDBlock:   "deduped-combined-ipld.blocks.csv",
+	&schema.TableHeader:      "deduped-eth.header_cids.csv",
+	&schema.TableStateNode:   "deduped-combined-eth.state_cids.csv",
+	&schema.TableStorageNode: "deduped-combined-eth.storage_cids.csv",
+}
+
+// Finalize combines the CSV files written for each table, both in the output directory and in
+// any per-worker subdirectories, into a single sorted file per table with duplicate rows removed.
+// The files are written to the ProcessedDir subdirectory.
+func Finalize(dir string) error {
+	outDir := filepath.Join(dir, ProcessedDir)
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	for table, name := range ProcessedFiles {
+		inputs, err := TableFiles(dir, table)
+		if err != nil {
+			return err
+		}
+		outPath := filepath.Join(outDir, name)
+		log.WithField("table", table.Name).WithField("files", len(inputs)).Infof("writing %s", outPath)
+		if err := sortUnique(inputs, outPath, DefaultChunkSize); err != nil {
+			return fmt.Errorf("failed to finalize %s: %w", table.Name, err)
+		}
+	}
+	return nil
+}
+
+// TableFiles returns the CSV files of the table in dir and its immediate subdirectories, excluding
+// finalized output.
+func TableFiles(dir string, table *schema.Table) ([]string, error) {
+	name := table.Name + ".csv"
+	var files []string
+	for _, pattern := range []string{filepath.Join(dir, name), filepath.Join(dir, "*", name)} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if filepath.Base(filepath.Dir(match)) != ProcessedDir {
+				files = append(files, match)
+			}
+		}
+	}
+	return files, nil
+}
+
+// OutputFiles returns the CSV files of the table in dir and its immediate subdirectories, including
+// its finalized file if present.
+func OutputFiles(dir string, table *schema.Table) ([]string, error) {
+	files, err := TableFiles(dir, table)
+	if err != nil {
+		return nil, err
+	}
+	processed := filepath.Join(dir, ProcessedDir, ProcessedFiles[table])
+	if _, err := os.Stat(processed); err == nil {
+		files = append(files, processed)
+	}
+	return files, nil
+}
+
+// sortUnique writes the sorted, unique lines of the input files to outPath, like `sort -u`.
+// Input is sorted in chunks of about chunkSize bytes, which are then merged.
+func sortUnique(inputs []string, outPath string, chunkSize int) error {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(outPath), ".sort-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var (
+		chunks []string
+		lines  []string
+		size   int
+	)
+	writeChunk := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		path := filepath.Join(tmpDir, fmt.Sprintf("chunk-%d", len(chunks)))
+		sort.Strings(lines)
+		if err := writeLines(path, lines); err != nil {
+			return err
+		}
+		chunks = append(chunks, path)
+		lines, size = nil, 0
+		return nil
+	}
+	for _, input := range inputs {
+		err := readLines(input, func(line string) error {
+			lines = append(lines, line)
+			size += len(line)
+			if size >= chunkSize {
+				return writeChunk()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// A single chunk can be written directly
+	if len(chunks) == 0 {
+		sort.Strings(lines)
+		return writeLines(outPath, lines)
+	}
+	if err := writeChunk(); err != nil {
+		return err
+	}
+	return mergeChunks(chunks, outPath)
+}
+
+func readLines(path string, fn func(string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := readLine(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+}
+
+// readLine reads a line of any length, without its line ending.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+// writeLines writes sorted lines, skipping duplicates.
+func writeLines(path string, lines []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for i, line := range lines {
+		if i > 0 && line == lines[i-1] {
+			continue
+		}
+		if _, err := w.WriteString(line + "\n"); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mergeChunks merges sorted chunk files into outPath, skipping duplicates.
+func mergeChunks(chunks []string, outPath string) error {
+	h := &lineHeap{}
+	for _, chunk := range chunks {
+		f, err := os.Open(chunk)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r := bufio.NewReader(f)
+		line, err := readLine(r)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		heap.Push(h, lineReader{line, r})
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	var (
+		last  string
+		first = true
+	)
+	for h.Len() > 0 {
+		top := (*h)[0]
+		if first || top.line != last {
+			if _, err := w.WriteString(top.line + "\n"); err != nil {
+				return err
+			}
+			last, first = top.line, false
+		}
+		line, err := readLine(top.r)
+		switch {
+		case err == io.EOF:
+			heap.Pop(h)
+		case err != nil:
+			return err
+		default:
+			(*h)[0].line = line
+			heap.Fix(h, 0)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+type lineReader struct {
+	line string
+	r    *bufio.Reader
+}
+
+type lineHeap []lineReader
+
+func (h lineHeap) Len() int            { return len(h) }
+func (h lineHeap) Less(i, j int) bool  { return h[i].line < h[j].line }
+func (h lineHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *lineHeap) Push(x interface{}) { *h = append(*h, x.(lineReader)) }
+func (h *lineHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,55 @@
+package output
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path string, lines ...string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+}
+
+func readFile(t *testing.T, path string) []string {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestFinalize(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "public.nodes.csv"), "node")
+	writeFile(t, filepath.Join(dir, "eth.header_cids.csv"), "header")
+	writeFile(t, filepath.Join(dir, "ipld.blocks.csv"), "c", "a")
+	writeFile(t, filepath.Join(dir, "0", "ipld.blocks.csv"), "b", "a")
+	writeFile(t, filepath.Join(dir, "1", "ipld.blocks.csv"), "c", "d")
+	writeFile(t, filepath.Join(dir, "0", "eth.state_cids.csv"), "s2", "s1")
+	writeFile(t, filepath.Join(dir, "1", "eth.state_cids.csv"), "s1")
+	writeFile(t, filepath.Join(dir, "0", "eth.storage_cids.csv"), "st")
+
+	require.NoError(t, Finalize(dir))
+	out := filepath.Join(dir, ProcessedDir)
+	require.Equal(t, []string{"node"}, readFile(t, filepath.Join(out, "public.nodes.csv")))
+	require.Equal(t, []string{"header"}, readFile(t, filepath.Join(out, "deduped-eth.header_cids.csv")))
+	require.Equal(t, []string{"a", "b", "c", "d"}, readFile(t, filepath.Join(out, "deduped-combined-ipld.blocks.csv")))
+	require.Equal(t, []string{"s1", "s2"}, readFile(t, filepath.Join(out, "deduped-combined-eth.state_cids.csv")))
+	require.Equal(t, []string{"st"}, readFile(t, filepath.Join(out, "deduped-combined-eth.storage_cids.csv")))
+
+	// finalizing again should ignore the previous output
+	require.NoError(t, Finalize(dir))
+	require.Equal(t, []string{"a", "b", "c", "d"}, readFile(t, filepath.Join(out, "deduped-combined-ipld.blocks.csv")))
+}
+
+func TestSortUniqueChunks(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.csv")
+	writeFile(t, in, "e", "b", "d", "a", "b", "c", "e", "a")
+	out := filepath.Join(dir, "out.csv")
+	// sort two lines at a time, forcing a merge
+	require.NoError(t, sortUnique([]string{in}, out, 2))
+	require.Equal(t, []string{"a", "b", "c", "d", "e"}, readFile(t, out))
+}
@@ -0,0 +1,373 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package output
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	"github.com/ipfs/go-cid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tables are the ipld-eth-db tables written by file mode snapshots.
+var Tables = []*schema.Table{
+	&schema.TableNodeInfo,
+	&schema.TableIPLDBlock,
+	&schema.TableHeader,
+	&schema.TableStateNode,
+	&schema.TableStorageNode,
+}
+
+// checkFunc validates a single field of a row.
+type checkFunc func(string) error
+
+var (
+	checkHash    = checkHex(32)
+	checkAddress = checkHex(20)
+
+	// columnChecks are the checks applied to the columns of every table, by column name.
+	columnChecks = map[string]checkFunc{
+		"block_number":     checkUint,
+		"block_hash":       checkHash,
+		"parent_hash":      checkHash,
+		"header_id":        checkHash,
+		"state_root":       checkHash,
+		"tx_root":          checkHash,
+		"receipt_root":     checkHash,
+		"uncles_hash":      checkHash,
+		"state_leaf_key":   checkHash,
+		"storage_leaf_key": checkHash,
+		"code_hash":        checkHash,
+		"storage_root":     checkHash,
+		"coinbase":         checkAddress,
+		"td":               checkNumeric,
+		"reward":           checkNumeric,
+		"balance":          checkNumeric,
+		"nonce":            checkUint,
+		"timestamp":        checkUint,
+		"chain_id":         checkUint,
+		"diff":             checkBool,
+		"removed":          checkBool,
+		"node_ids":         checkArray,
+		"bloom":            checkBytea,
+		"val":              checkBytea,
+		"data":             checkBytea,
+		"key":              checkCID(0),
+	}
+
+	// tableCIDCodecs are the multicodecs expected of the cid column of each table.
+	tableCIDCodecs = map[string]uint64{
+		schema.TableHeader.Name:      ipld.MEthHeader,
+		schema.TableStateNode.Name:   ipld.MEthStateTrie,
+		schema.TableStorageNode.Name: ipld.MEthStorageTrie,
+	}
+)
+
+// TableValidator checks rows of CSV output against the schema of a table.
+type TableValidator struct {
+	table  *schema.Table
+	checks []checkFunc
+}
+
+// NewTableValidator returns a validator for the given table.
+func NewTableValidator(table *schema.Table) *TableValidator {
+	v := &TableValidator{table: table}
+	for _, col := range table.Columns {
+		check := columnChecks[col.Name]
+		if col.Name == "cid" {
+			check = checkCID(tableCIDCodecs[table.Name])
+		}
+		v.checks = append(v.checks, check)
+	}
+	return v
+}
+
+// ValidateRow returns an error describing the first problem found in a row, or nil if it is valid.
+func (v *TableValidator) ValidateRow(row []string) error {
+	if len(row) != len(v.table.Columns) {
+		return fmt.Errorf("expected %d columns, found %d", len(v.table.Columns), len(row))
+	}
+	for i, field := range row {
+		if v.checks[i] == nil {
+			continue
+		}
+		if err := v.checks[i](field); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", v.table.Columns[i].Name, truncate(field), err)
+		}
+	}
+	return nil
+}
+
+// BadRow describes a row which failed validation.
+type BadRow struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (r BadRow) String() string {
+	return fmt.Sprintf("%s:%d: %v", r.File, r.Line, r.Err)
+}
+
+// FileResult summarizes the validation of a file.
+type FileResult struct {
+	File  string
+	Table string
+	Rows  int
+	Bad   []BadRow
+}
+
+// ValidateFile reads the CSV rows of a table from path and validates each of them. If quarantine is
+// not empty, bad rows are moved to that file, leaving only the valid rows in place.
+func ValidateFile(path string, table *schema.Table, quarantine string) (*FileResult, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	res := &FileResult{File: path, Table: table.Name}
+	v := NewTableValidator(table)
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+
+	// Bad rows are copied byte for byte, so the offsets of each record are tracked.
+	var good, bad *rangeCopier
+	if quarantine != "" {
+		if good, err = newRangeCopier(in, path+".validated"); err != nil {
+			return nil, err
+		}
+		defer good.abort()
+		if bad, err = newRangeCopier(in, quarantine); err != nil {
+			return nil, err
+		}
+		defer bad.abort()
+	}
+
+	var start int64
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		end := r.InputOffset()
+		res.Rows++
+
+		var (
+			line     int
+			rowErr   error
+			parseErr *csv.ParseError
+		)
+		switch {
+		case errors.As(err, &parseErr):
+			line, rowErr = parseErr.StartLine, parseErr.Err
+		case err != nil:
+			return nil, err
+		default:
+			line, _ = r.FieldPos(0)
+			rowErr = v.ValidateRow(record)
+		}
+
+		if rowErr != nil {
+			res.Bad = append(res.Bad, BadRow{File: path, Line: line, Err: rowErr})
+		}
+		if quarantine != "" {
+			out := good
+			if rowErr != nil {
+				out = bad
+			}
+			if err := out.copy(start, end); err != nil {
+				return nil, err
+			}
+		}
+		start = end
+	}
+
+	if quarantine == "" {
+		return res, nil
+	}
+	if err := bad.close(); err != nil {
+		return nil, err
+	}
+	if len(res.Bad) == 0 {
+		// nothing to quarantine, leave the file as it is
+		os.Remove(quarantine)
+		return res, nil
+	}
+	if err := good.close(); err != nil {
+		return nil, err
+	}
+	return res, os.Rename(good.path, path)
+}
+
+// ValidateOutput validates the CSV output of each table in dir and its per-worker subdirectories,
+// including any finalized files. If quarantineDir is not empty, bad rows are moved out of each file
+// into a file of the same relative path under quarantineDir.
+func ValidateOutput(dir, quarantineDir string) ([]*FileResult, error) {
+	var results []*FileResult
+	validate := func(path string, table *schema.Table) error {
+		var quarantine string
+		if quarantineDir != "" {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			quarantine = filepath.Join(quarantineDir, rel)
+			if err := os.MkdirAll(filepath.Dir(quarantine), 0755); err != nil {
+				return err
+			}
+		}
+		res, err := ValidateFile(path, table, quarantine)
+		if err != nil {
+			return fmt.Errorf("failed to validate %s: %w", path, err)
+		}
+		log.WithField("table", table.Name).WithField("rows", res.Rows).WithField("bad", len(res.Bad)).
+			Infof("validated %s", path)
+		results = append(results, res)
+		return nil
+	}
+
+	for _, table := range Tables {
+		files, err := OutputFiles(dir, table)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range files {
+			if err := validate(path, table); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// rangeCopier copies byte ranges of a file to another file.
+type rangeCopier struct {
+	src  io.ReaderAt
+	path string
+	file *os.File
+}
+
+func newRangeCopier(src io.ReaderAt, path string) (*rangeCopier, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &rangeCopier{src: src, path: path, file: file}, nil
+}
+
+func (c *rangeCopier) copy(start, end int64) error {
+	_, err := io.Copy(c.file, io.NewSectionReader(c.src, start, end-start))
+	return err
+}
+
+func (c *rangeCopier) close() error {
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// abort removes the file if it was not closed.
+func (c *rangeCopier) abort() {
+	if c.file != nil {
+		c.file.Close()
+		os.Remove(c.path)
+	}
+}
+
+func checkUint(s string) error {
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err
+}
+
+func checkNumeric(s string) error {
+	if _, ok := new(big.Int).SetString(s, 10); !ok || strings.HasPrefix(s, "-") {
+		return errors.New("not a non-negative integer")
+	}
+	return nil
+}
+
+func checkBool(s string) error {
+	switch s {
+	case "t", "f", "true", "false":
+		return nil
+	}
+	return errors.New("not a boolean")
+}
+
+func checkArray(s string) error {
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return errors.New("not an array")
+	}
+	return nil
+}
+
+// checkBytea checks a bytea in hex format, as written by the file indexer.
+func checkBytea(s string) error {
+	if !strings.HasPrefix(s, `\x`) {
+		return errors.New(`missing \x prefix`)
+	}
+	_, err := hex.DecodeString(s[2:])
+	return err
+}
+
+// checkHex returns a check for 0x-prefixed hex strings of the given length in bytes.
+func checkHex(size int) checkFunc {
+	return func(s string) error {
+		if !strings.HasPrefix(s, "0x") {
+			return errors.New("missing 0x prefix")
+		}
+		if len(s) != 2+2*size {
+			return fmt.Errorf("expected %d bytes", size)
+		}
+		_, err := hex.DecodeString(s[2:])
+		return err
+	}
+}
+
+// checkCID returns a check for CIDs with the given multicodec, or with any codec if it is 0.
+func checkCID(codec uint64) checkFunc {
+	return func(s string) error {
+		c, err := cid.Decode(s)
+		if err != nil {
+			return err
+		}
+		if codec != 0 && c.Type() != codec {
+			return fmt.Errorf("unexpected codec 0x%x", c.Type())
+		}
+		return nil
+	}
+}
+
+func truncate(s string) string {
+	const max = 80
+	if len(s) > max {
+		return s[:max] + "..."
+	}
+	return s
+}
@@ -0,0 +1,90 @@
+package output
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testHash     = "0x" + strings.Repeat("ab", 32)
+	testStateCID = ipld.Keccak256ToCid(ipld.MEthStateTrie, make([]byte, 32)).String()
+	testRawCID   = ipld.Keccak256ToCid(ipld.RawBinary, make([]byte, 32)).String()
+)
+
+func stateRow(fields ...string) string {
+	row := []string{"32", testHash, testHash, testStateCID, "t", "1000", "1", testHash, testHash, "f"}
+	for i := 0; i+1 < len(fields); i += 2 {
+		for j, col := range schema.TableStateNode.Columns {
+			if col.Name == fields[i] {
+				row[j] = fields[i+1]
+			}
+		}
+	}
+	return strings.Join(row, ",")
+}
+
+func TestValidateRow(t *testing.T) {
+	v := NewTableValidator(&schema.TableStateNode)
+	valid := strings.Split(stateRow(), ",")
+	require.NoError(t, v.ValidateRow(valid))
+
+	for name, row := range map[string]string{
+		"column count":   stateRow() + ",extra",
+		"block number":   stateRow("block_number", "-1"),
+		"leaf key hex":   stateRow("state_leaf_key", "0x1234"),
+		"leaf key 0x":    stateRow("state_leaf_key", strings.Repeat("ab", 33)),
+		"cid format":     stateRow("cid", "not-a-cid"),
+		"cid codec":      stateRow("cid", testRawCID),
+		"balance":        stateRow("balance", "1.5"),
+		"boolean":        stateRow("removed", "yes"),
+		"empty leaf key": stateRow("state_leaf_key", ""),
+	} {
+		require.Error(t, v.ValidateRow(strings.Split(row, ",")), name)
+	}
+
+	ipldValidator := NewTableValidator(&schema.TableIPLDBlock)
+	require.NoError(t, ipldValidator.ValidateRow([]string{"32", testRawCID, `\x0f`}))
+	require.Error(t, ipldValidator.ValidateRow([]string{"32", testRawCID, `0f`}))
+	require.Error(t, ipldValidator.ValidateRow([]string{"32", testRawCID, `\x0`}))
+}
+
+func TestValidateFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "eth.state_cids.csv")
+	rows := []string{
+		stateRow(),
+		stateRow("nonce", "x"),
+		// quoted fields may contain commas
+		stateRow("balance", `"1,000"`),
+		stateRow("block_number", "33"),
+		`"unterminated,` + stateRow(),
+	}
+	writeFile(t, path, rows...)
+
+	res, err := ValidateFile(path, &schema.TableStateNode, "")
+	require.NoError(t, err)
+	require.Equal(t, 5, res.Rows)
+	require.Len(t, res.Bad, 3)
+	require.Equal(t, []int{2, 3, 5}, []int{res.Bad[0].Line, res.Bad[1].Line, res.Bad[2].Line})
+
+	quarantine := filepath.Join(dir, "quarantine.csv")
+	res, err = ValidateFile(path, &schema.TableStateNode, quarantine)
+	require.NoError(t, err)
+	require.Len(t, res.Bad, 3)
+	require.Equal(t, []string{rows[0], rows[3]}, readFile(t, path))
+	require.Equal(t, []string{rows[1], rows[2], rows[4]}, readFile(t, quarantine))
+
+	// the cleaned file is valid, and nothing more is quarantined
+	require.NoError(t, os.Remove(quarantine))
+	res, err = ValidateFile(path, &schema.TableStateNode, quarantine)
+	require.NoError(t, err)
+	require.Empty(t, res.Bad)
+	require.NoFileExists(t, quarantine)
+	require.Equal(t, []string{rows[0], rows[3]}, readFile(t, path))
+}
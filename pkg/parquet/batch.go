@@ -0,0 +1,130 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package parquet
+
+import (
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// BatchTx holds the files written for a block. Files are opened on first use and completed when
+// the batch is submitted or rolled back, so that rows written before a failure remain readable.
+type BatchTx struct {
+	number int64
+
+	headerWriters  *partitionedWriter[HeaderRow]
+	stateWriters   *partitionedWriter[StateRow]
+	storageWriters *partitionedWriter[StorageRow]
+	ipldWriters    *partitionedWriter[IPLDRow]
+}
+
+func newBatch(idx *Indexer, number *big.Int) *BatchTx {
+	start := time.Now()
+	dir := func(table *schema.Table) string {
+		return filepath.Join(idx.dir, table.Name, "block_number="+number.String())
+	}
+	return &BatchTx{
+		number:         number.Int64(),
+		headerWriters:  newPartitionedWriter[HeaderRow](dir(&schema.TableHeader), 1, start),
+		stateWriters:   newPartitionedWriter[StateRow](dir(&schema.TableStateNode), idx.partitions, start),
+		storageWriters: newPartitionedWriter[StorageRow](dir(&schema.TableStorageNode), idx.partitions, start),
+		ipldWriters:    newPartitionedWriter[IPLDRow](dir(&schema.TableIPLDBlock), idx.partitions, start),
+	}
+}
+
+// Submit completes the files of the batch.
+func (tx *BatchTx) Submit() error {
+	var err error
+	for _, closeFn := range []func() error{
+		tx.headerWriters.close, tx.stateWriters.close, tx.storageWriters.close, tx.ipldWriters.close,
+	} {
+		if cerr := closeFn(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// BlockNumber returns the block number of the batch.
+func (tx *BatchTx) BlockNumber() string {
+	return strconv.FormatInt(tx.number, 10)
+}
+
+// RollbackOnFailure completes the files of the batch if err is non-nil. Written rows cannot be
+// removed, but on recovery, the remaining rows are written to new files.
+func (tx *BatchTx) RollbackOnFailure(err error) {
+	if err == nil {
+		return
+	}
+	if err := tx.Submit(); err != nil {
+		log.Errorf("failed to close parquet files: %v", err)
+	}
+}
+
+// partitionedWriter writes the rows of one table into a file per partition.
+type partitionedWriter[T any] struct {
+	sync.Mutex
+	dir     string
+	start   time.Time
+	writers []*writer[T]
+	closed  bool
+}
+
+func newPartitionedWriter[T any](dir string, partitions int, start time.Time) *partitionedWriter[T] {
+	return &partitionedWriter[T]{dir: dir, start: start, writers: make([]*writer[T], partitions)}
+}
+
+func (pw *partitionedWriter[T]) write(part int, row T) error {
+	pw.Lock()
+	defer pw.Unlock()
+	if pw.closed {
+		return fmt.Errorf("batch is already complete")
+	}
+	if pw.writers[part] == nil {
+		w, err := newWriter[T](filepath.Join(pw.dir, fileName(part, pw.start)))
+		if err != nil {
+			return err
+		}
+		pw.writers[part] = w
+	}
+	return pw.writers[part].write(row)
+}
+
+func (pw *partitionedWriter[T]) close() error {
+	pw.Lock()
+	defer pw.Unlock()
+	if pw.closed {
+		return nil
+	}
+	pw.closed = true
+	var err error
+	for _, w := range pw.writers {
+		if w == nil {
+			continue
+		}
+		if cerr := w.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,288 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package parquet implements a snapshot indexer which writes Apache Parquet files.
+package parquet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/interfaces"
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	"github.com/cerc-io/plugeth-statediff/indexer/models"
+	"github.com/cerc-io/plugeth-statediff/indexer/node"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	parquetgo "github.com/segmentio/parquet-go"
+)
+
+// DefaultRowGroupSize is the maximum number of rows per row group.
+const DefaultRowGroupSize = 100000
+
+var errNotSupported = errors.New("not supported by the parquet indexer")
+
+// Indexer writes snapshot data as one Parquet dataset per table, laid out as
+//
+//	<dir>/<table>/block_number=<n>/part-<p>-<t>.parquet
+//
+// where p is the partition and t identifies the batch. State and storage rows are partitioned by
+// state leaf key over equal ranges of the key space, as the trie is divided between workers; IPLD
+// blocks are partitioned by CID. Files are zstd-compressed and completed when the batch ends, so
+// each batch writes a new set of files.
+type Indexer struct {
+	dir        string
+	partitions int
+	nodeInfo   node.Info
+}
+
+var _ indexer.Indexer = (*Indexer)(nil)
+
+// NewIndexer creates the output directory and writes the node info. Data is written in the given
+// number of partitions, normally the number of workers.
+func NewIndexer(dir string, partitions uint, nodeInfo node.Info) (*Indexer, error) {
+	if partitions == 0 {
+		partitions = 1
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	idx := &Indexer{dir: dir, partitions: int(partitions), nodeInfo: nodeInfo}
+
+	path := filepath.Join(dir, schema.TableNodeInfo.Name, fileName(0, time.Now()))
+	w, err := newWriter[NodeRow](path)
+	if err != nil {
+		return nil, err
+	}
+	err = w.write(NodeRow{
+		GenesisBlock: nodeInfo.GenesisBlock,
+		NetworkID:    nodeInfo.NetworkID,
+		NodeID:       nodeInfo.ID,
+		ClientName:   nodeInfo.ClientName,
+		ChainID:      int32(nodeInfo.ChainID),
+	})
+	if cerr := w.close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write node info: %w", err)
+	}
+	return idx, nil
+}
+
+// BeginTx starts a batch writing the files for a block.
+func (idx *Indexer) BeginTx(number *big.Int, _ context.Context) interfaces.Batch {
+	return newBatch(idx, number)
+}
+
+// PushHeader writes the header and its IPLD block, and returns the header ID.
+func (idx *Indexer) PushHeader(batch interfaces.Batch, header *types.Header, reward, td *big.Int) (string, error) {
+	tx, ok := batch.(*BatchTx)
+	if !ok {
+		return "", fmt.Errorf("unexpected batch type %T", batch)
+	}
+	headerRLP, err := rlp.EncodeToBytes(header)
+	if err != nil {
+		return "", err
+	}
+	headerID := header.Hash().String()
+	headerCID := ipld.Keccak256ToCid(ipld.MEthHeader, header.Hash().Bytes()).String()
+	err = tx.ipldWriters.write(0, IPLDRow{BlockNumber: tx.number, Key: headerCID, Data: headerRLP})
+	if err != nil {
+		return "", err
+	}
+	return headerID, tx.headerWriters.write(0, HeaderRow{
+		BlockNumber: tx.number,
+		BlockHash:   headerID,
+		ParentHash:  header.ParentHash.String(),
+		CID:         headerCID,
+		TD:          td.String(),
+		NodeIDs:     []string{idx.nodeInfo.ID},
+		Reward:      reward.String(),
+		StateRoot:   header.Root.String(),
+		TxRoot:      header.TxHash.String(),
+		RctRoot:     header.ReceiptHash.String(),
+		UnclesHash:  header.UncleHash.String(),
+		Bloom:       header.Bloom.Bytes(),
+		Timestamp:   new(big.Int).SetUint64(header.Time).String(),
+		Coinbase:    header.Coinbase.String(),
+	})
+}
+
+// PushStateNode writes the state leaf row and the rows of its storage leaves.
+func (idx *Indexer) PushStateNode(batch interfaces.Batch, stateNode sdtypes.StateLeafNode, headerID string) error {
+	tx, ok := batch.(*BatchTx)
+	if !ok {
+		return fmt.Errorf("unexpected batch type %T", batch)
+	}
+	leafKey := stateNode.AccountWrapper.LeafKey
+	part := idx.keyPartition(leafKey)
+	stateKey := common.BytesToHash(leafKey).String()
+	// Removed nodes are recorded with zero values, as by the statediff indexer
+	row := StateRow{
+		BlockNumber:  tx.number,
+		HeaderID:     headerID,
+		StateLeafKey: stateKey,
+		Diff:         true,
+		Removed:      stateNode.Removed,
+	}
+	if stateNode.Removed {
+		row.CID = shared.RemovedNodeStateCID
+		row.Balance = "0"
+	} else {
+		account := stateNode.AccountWrapper.Account
+		row.CID = stateNode.AccountWrapper.CID
+		row.Balance = account.Balance.String()
+		row.Nonce = int64(account.Nonce)
+		row.CodeHash = common.BytesToHash(account.CodeHash).String()
+		row.StorageRoot = account.Root.String()
+	}
+	if err := tx.stateWriters.write(part, row); err != nil {
+		return err
+	}
+
+	for _, storageNode := range stateNode.StorageDiff {
+		row := StorageRow{
+			BlockNumber:    tx.number,
+			HeaderID:       headerID,
+			StateLeafKey:   stateKey,
+			StorageLeafKey: common.BytesToHash(storageNode.LeafKey).String(),
+			Diff:           true,
+			Removed:        storageNode.Removed,
+		}
+		if storageNode.Removed {
+			row.CID = shared.RemovedNodeStorageCID
+			row.Value = []byte{}
+		} else {
+			row.CID = storageNode.CID
+			row.Value = storageNode.Value
+		}
+		if err := tx.storageWriters.write(part, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PushIPLD writes an IPLD block.
+func (idx *Indexer) PushIPLD(batch interfaces.Batch, i sdtypes.IPLD) error {
+	tx, ok := batch.(*BatchTx)
+	if !ok {
+		return fmt.Errorf("unexpected batch type %T", batch)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(i.CID))
+	part := int(h.Sum32() % uint32(idx.partitions))
+	return tx.ipldWriters.write(part, IPLDRow{BlockNumber: tx.number, Key: i.CID, Data: i.Content})
+}
+
+// keyPartition returns the partition of a leaf key, dividing the key space into equal ranges.
+func (idx *Indexer) keyPartition(key []byte) int {
+	if len(key) == 0 {
+		return 0
+	}
+	return int(key[0]) * idx.partitions / 256
+}
+
+// Close is a no-op, as files are completed by their batch.
+func (idx *Indexer) Close() error { return nil }
+
+func (idx *Indexer) PushBlock(*types.Block, types.Receipts, *big.Int) (interfaces.Batch, error) {
+	return nil, errNotSupported
+}
+
+func (idx *Indexer) CurrentBlock() (*models.HeaderModel, error) {
+	return nil, errNotSupported
+}
+
+func (idx *Indexer) DetectGaps(uint64, uint64) ([]*interfaces.BlockGap, error) {
+	return nil, errNotSupported
+}
+
+func (idx *Indexer) HasBlock(common.Hash, uint64) (bool, error) {
+	return false, errNotSupported
+}
+
+func (idx *Indexer) LoadWatchedAddresses() ([]common.Address, error) {
+	return nil, errNotSupported
+}
+
+func (idx *Indexer) InsertWatchedAddresses([]sdtypes.WatchAddressArg, *big.Int) error {
+	return errNotSupported
+}
+
+func (idx *Indexer) RemoveWatchedAddresses([]sdtypes.WatchAddressArg) error {
+	return errNotSupported
+}
+
+func (idx *Indexer) SetWatchedAddresses([]sdtypes.WatchAddressArg, *big.Int) error {
+	return errNotSupported
+}
+
+func (idx *Indexer) ClearWatchedAddresses() error {
+	return errNotSupported
+}
+
+// ReportDBMetrics is a no-op.
+func (idx *Indexer) ReportDBMetrics(time.Duration, <-chan bool) {}
+
+func fileName(part int, t time.Time) string {
+	return fmt.Sprintf("part-%d-%d.parquet", part, t.UnixNano())
+}
+
+// writer writes rows of a single Parquet file.
+type writer[T any] struct {
+	file *os.File
+	pw   *parquetgo.GenericWriter[T]
+}
+
+func newWriter[T any](path string) (*writer[T], error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	pw := parquetgo.NewGenericWriter[T](file,
+		parquetgo.Compression(&parquetgo.Zstd),
+		parquetgo.MaxRowsPerRowGroup(DefaultRowGroupSize),
+	)
+	return &writer[T]{file: file, pw: pw}, nil
+}
+
+func (w *writer[T]) write(row T) error {
+	_, err := w.pw.Write([]T{row})
+	return err
+}
+
+func (w *writer[T]) close() error {
+	err := w.pw.Close()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
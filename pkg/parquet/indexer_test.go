@@ -0,0 +1,84 @@
+package parquet_test
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/node"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	parquetgo "github.com/segmentio/parquet-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/parquet"
+)
+
+func readRows[T any](t *testing.T, pattern string) []T {
+	paths, err := filepath.Glob(pattern)
+	require.NoError(t, err)
+	var rows []T
+	for _, path := range paths {
+		r, err := parquetgo.ReadFile[T](path)
+		require.NoError(t, err)
+		rows = append(rows, r...)
+	}
+	return rows
+}
+
+func TestIndexer(t *testing.T) {
+	dir := t.TempDir()
+	info := node.Info{ID: "test-node", GenesisBlock: "0xgenesis", NetworkID: "1", ChainID: 1}
+	idx, err := parquet.NewIndexer(dir, 4, info)
+	require.NoError(t, err)
+
+	header := &types.Header{Number: big.NewInt(32), Difficulty: big.NewInt(1), Time: 1000}
+	tx := idx.BeginTx(header.Number, context.Background())
+	headerID, err := idx.PushHeader(tx, header, big.NewInt(2), big.NewInt(3))
+	require.NoError(t, err)
+
+	// one account in each partition
+	var leafKeys []common.Hash
+	for _, b := range []byte{0x00, 0x40, 0x80, 0xc0} {
+		leafKeys = append(leafKeys, common.Hash{b})
+	}
+	for i, key := range leafKeys {
+		stateNode := sdtypes.StateLeafNode{
+			AccountWrapper: sdtypes.AccountWrapper{
+				Account: &types.StateAccount{Balance: big.NewInt(int64(i)), Root: types.EmptyRootHash},
+				LeafKey: key.Bytes(),
+				CID:     "state",
+			},
+			StorageDiff: []sdtypes.StorageLeafNode{{LeafKey: key.Bytes(), Value: []byte{1}, CID: "storage"}},
+		}
+		require.NoError(t, idx.PushStateNode(tx, stateNode, headerID))
+		require.NoError(t, idx.PushIPLD(tx, sdtypes.IPLD{CID: key.String(), Content: []byte{2}}))
+	}
+	require.NoError(t, tx.Submit())
+
+	nodes := readRows[parquet.NodeRow](t, filepath.Join(dir, "public.nodes", "*.parquet"))
+	require.Equal(t, []parquet.NodeRow{{
+		GenesisBlock: "0xgenesis", NetworkID: "1", NodeID: "test-node", ChainID: 1,
+	}}, nodes)
+
+	blockDir := func(table string) string { return filepath.Join(dir, table, "block_number=32") }
+	headers := readRows[parquet.HeaderRow](t, filepath.Join(blockDir("eth.header_cids"), "*.parquet"))
+	require.Len(t, headers, 1)
+	require.Equal(t, headerID, headers[0].BlockHash)
+	require.Equal(t, "3", headers[0].TD)
+	require.Equal(t, "2", headers[0].Reward)
+	require.Equal(t, []string{"test-node"}, headers[0].NodeIDs)
+
+	stateFiles, err := filepath.Glob(filepath.Join(blockDir("eth.state_cids"), "*.parquet"))
+	require.NoError(t, err)
+	require.Len(t, stateFiles, 4, "expected a file per partition")
+	states := readRows[parquet.StateRow](t, filepath.Join(blockDir("eth.state_cids"), "*.parquet"))
+	require.Len(t, states, 4)
+	storage := readRows[parquet.StorageRow](t, filepath.Join(blockDir("eth.storage_cids"), "*.parquet"))
+	require.Len(t, storage, 4)
+	// IPLDs pushed, plus the header
+	iplds := readRows[parquet.IPLDRow](t, filepath.Join(blockDir("ipld.blocks"), "*.parquet"))
+	require.Len(t, iplds, 5)
+}
@@ -0,0 +1,86 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package parquet
+
+// Row types for the ipld-eth-db tables. Column types map as follows:
+//
+//	BIGINT    -> INT64
+//	INTEGER   -> INT32
+//	BOOLEAN   -> BOOLEAN
+//	BYTEA     -> BYTE_ARRAY
+//	VARCHAR[] -> LIST<STRING>
+//	TEXT, VARCHAR -> STRING
+//	NUMERIC   -> STRING (base 10, as values such as balances exceed the range of fixed-size types)
+
+// NodeRow is a row of public.nodes
+type NodeRow struct {
+	GenesisBlock string `parquet:"genesis_block"`
+	NetworkID    string `parquet:"network_id"`
+	NodeID       string `parquet:"node_id"`
+	ClientName   string `parquet:"client_name"`
+	ChainID      int32  `parquet:"chain_id"`
+}
+
+// HeaderRow is a row of eth.header_cids
+type HeaderRow struct {
+	BlockNumber int64    `parquet:"block_number"`
+	BlockHash   string   `parquet:"block_hash"`
+	ParentHash  string   `parquet:"parent_hash"`
+	CID         string   `parquet:"cid"`
+	TD          string   `parquet:"td"`
+	NodeIDs     []string `parquet:"node_ids,list"`
+	Reward      string   `parquet:"reward"`
+	StateRoot   string   `parquet:"state_root"`
+	TxRoot      string   `parquet:"tx_root"`
+	RctRoot     string   `parquet:"receipt_root"`
+	UnclesHash  string   `parquet:"uncles_hash"`
+	Bloom       []byte   `parquet:"bloom"`
+	Timestamp   string   `parquet:"timestamp"`
+	Coinbase    string   `parquet:"coinbase"`
+}
+
+// StateRow is a row of eth.state_cids
+type StateRow struct {
+	BlockNumber  int64  `parquet:"block_number"`
+	HeaderID     string `parquet:"header_id"`
+	StateLeafKey string `parquet:"state_leaf_key"`
+	CID          string `parquet:"cid"`
+	Diff         bool   `parquet:"diff"`
+	Balance      string `parquet:"balance"`
+	Nonce        int64  `parquet:"nonce"`
+	CodeHash     string `parquet:"code_hash"`
+	StorageRoot  string `parquet:"storage_root"`
+	Removed      bool   `parquet:"removed"`
+}
+
+// StorageRow is a row of eth.storage_cids
+type StorageRow struct {
+	BlockNumber    int64  `parquet:"block_number"`
+	HeaderID       string `parquet:"header_id"`
+	StateLeafKey   string `parquet:"state_leaf_key"`
+	StorageLeafKey string `parquet:"storage_leaf_key"`
+	CID            string `parquet:"cid"`
+	Diff           bool   `parquet:"diff"`
+	Value          []byte `parquet:"val"`
+	Removed        bool   `parquet:"removed"`
+}
+
+// IPLDRow is a row of ipld.blocks
+type IPLDRow struct {
+	BlockNumber int64  `parquet:"block_number"`
+	Key         string `parquet:"key"`
+	Data        []byte `parquet:"data"`
+}
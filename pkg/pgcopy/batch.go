@@ -0,0 +1,191 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pgcopy
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	"github.com/jackc/pgx/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// BatchTx buffers rows per table and copies them into the database within a single transaction.
+//
+// Rows are copied into temporary tables and then moved to their target tables with
+// INSERT ... ON CONFLICT DO NOTHING, since COPY cannot skip rows which already exist (e.g. IPLD
+// blocks shared between tries, or written by another worker).
+//
+// The transaction has a single connection, so copies are made one at a time, but the buffers are
+// swapped out before copying, so that other workers can keep buffering rows meanwhile.
+type BatchTx struct {
+	ctx       context.Context
+	number    *big.Int
+	batchSize int
+
+	// mtx guards the buffers and the error
+	mtx  sync.Mutex
+	err  error
+	rows map[*schema.Table][][]interface{}
+
+	// dbMtx guards the use of the transaction
+	dbMtx sync.Mutex
+	dbtx  pgx.Tx
+}
+
+func (idx *Indexer) beginTx(ctx context.Context, number *big.Int) *BatchTx {
+	tx := &BatchTx{
+		ctx:       ctx,
+		number:    number,
+		batchSize: idx.batchSize,
+		rows:      make(map[*schema.Table][][]interface{}),
+	}
+	tx.dbtx, tx.err = idx.pool.Begin(ctx)
+	if tx.err != nil {
+		tx.err = fmt.Errorf("failed to begin transaction: %w", tx.err)
+		return tx
+	}
+	for _, table := range copyTables {
+		stm := fmt.Sprintf("CREATE TEMPORARY TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP",
+			tempTableName(table), table.Name)
+		if _, tx.err = tx.dbtx.Exec(ctx, stm); tx.err != nil {
+			tx.err = fmt.Errorf("failed to create temporary table for %s: %w", table.Name, tx.err)
+			return tx
+		}
+	}
+	return tx
+}
+
+// push buffers a row for the table, copying the table's rows once the batch size is reached.
+func (tx *BatchTx) push(table *schema.Table, row []interface{}) error {
+	tx.mtx.Lock()
+	if tx.err != nil {
+		tx.mtx.Unlock()
+		return tx.err
+	}
+	tx.rows[table] = append(tx.rows[table], row)
+	var rows [][]interface{}
+	if len(tx.rows[table]) >= tx.batchSize {
+		rows, tx.rows[table] = tx.rows[table], nil
+	}
+	tx.mtx.Unlock()
+
+	if len(rows) == 0 {
+		return nil
+	}
+	tx.dbMtx.Lock()
+	err := tx.copy(table, rows)
+	tx.dbMtx.Unlock()
+	if err != nil {
+		tx.fail(err)
+	}
+	return err
+}
+
+// fail records the first error of the batch, which is returned by all further use of it.
+func (tx *BatchTx) fail(err error) {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+	if tx.err == nil {
+		tx.err = err
+	}
+}
+
+// copy copies rows into the table. The caller must hold dbMtx.
+func (tx *BatchTx) copy(table *schema.Table, rows [][]interface{}) error {
+	tempTable := tempTableName(table)
+	columns := columnNames(table)
+	_, err := tx.dbtx.CopyFrom(tx.ctx, pgx.Identifier{tempTable}, columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		return fmt.Errorf("failed to copy rows into %s: %w", table.Name, err)
+	}
+	columnList := strings.Join(columns, ", ")
+	stm := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT DO NOTHING",
+		table.Name, columnList, columnList, tempTable)
+	if _, err = tx.dbtx.Exec(tx.ctx, stm); err != nil {
+		return fmt.Errorf("failed to insert rows into %s: %w", table.Name, err)
+	}
+	_, err = tx.dbtx.Exec(tx.ctx, "TRUNCATE "+tempTable)
+	return err
+}
+
+// Submit copies the remaining rows and commits the transaction. If it fails, the transaction is
+// rolled back.
+func (tx *BatchTx) Submit() (err error) {
+	defer func() {
+		if err != nil {
+			tx.fail(err)
+			tx.RollbackOnFailure(err)
+		}
+	}()
+	tx.mtx.Lock()
+	err, rows := tx.err, tx.rows
+	tx.rows = make(map[*schema.Table][][]interface{})
+	tx.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tx.dbMtx.Lock()
+	defer tx.dbMtx.Unlock()
+	for _, table := range copyTables {
+		if len(rows[table]) == 0 {
+			continue
+		}
+		if err = tx.copy(table, rows[table]); err != nil {
+			return err
+		}
+	}
+	if err = tx.dbtx.Commit(tx.ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// BlockNumber returns the block number of the batch.
+func (tx *BatchTx) BlockNumber() string {
+	if tx.number == nil {
+		return ""
+	}
+	return tx.number.String()
+}
+
+// RollbackOnFailure rolls back the transaction if err is non-nil.
+func (tx *BatchTx) RollbackOnFailure(err error) {
+	if err == nil || tx.dbtx == nil {
+		return
+	}
+	// the transaction context may already be cancelled
+	if rerr := tx.dbtx.Rollback(context.Background()); rerr != nil && rerr != pgx.ErrTxClosed {
+		log.Errorf("failed to roll back transaction: %v", rerr)
+	}
+}
+
+func tempTableName(table *schema.Table) string {
+	return "copy_" + strings.ReplaceAll(table.Name, ".", "_")
+}
+
+func columnNames(table *schema.Table) []string {
+	names := make([]string, len(table.Columns))
+	for i, col := range table.Columns {
+		names[i] = col.Name
+	}
+	return names
+}
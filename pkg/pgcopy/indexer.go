@@ -0,0 +1,278 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package pgcopy implements a snapshot indexer which writes to Postgres using COPY FROM STDIN.
+package pgcopy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/database/metrics"
+	"github.com/cerc-io/plugeth-statediff/indexer/database/sql/postgres"
+	"github.com/cerc-io/plugeth-statediff/indexer/interfaces"
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	"github.com/cerc-io/plugeth-statediff/indexer/models"
+	"github.com/cerc-io/plugeth-statediff/indexer/node"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// DefaultCopyBatchSize is the number of rows buffered per table before they are copied.
+const DefaultCopyBatchSize = 10000
+
+var errNotSupported = errors.New("not supported by the postgres-copy indexer")
+
+// copyTables are the tables written by the indexer
+var copyTables = []*schema.Table{
+	&schema.TableNodeInfo,
+	&schema.TableHeader,
+	&schema.TableStateNode,
+	&schema.TableStorageNode,
+	&schema.TableIPLDBlock,
+}
+
+// Indexer writes snapshot data to Postgres with COPY FROM STDIN, in place of the row-by-row inserts
+// of the statediff SQL indexer. It only supports the methods used for snapshots.
+type Indexer struct {
+	pool      *pgxpool.Pool
+	nodeInfo  node.Info
+	batchSize int
+}
+
+var _ indexer.Indexer = (*Indexer)(nil)
+
+// NewIndexer connects to the database and writes the node info.
+func NewIndexer(ctx context.Context, config postgres.Config, nodeInfo node.Info) (*Indexer, error) {
+	pgConf, err := pgxpool.ParseConfig(config.DbConnectionString())
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxConns > 0 {
+		pgConf.MaxConns = int32(config.MaxConns)
+	}
+	if config.MaxConnLifetime > 0 {
+		pgConf.MaxConnLifetime = config.MaxConnLifetime
+	}
+	pool, err := pgxpool.ConnectConfig(ctx, pgConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	idx := &Indexer{pool: pool, nodeInfo: nodeInfo, batchSize: DefaultCopyBatchSize}
+
+	tx := idx.beginTx(ctx, nil)
+	err = tx.push(&schema.TableNodeInfo, nodeInfoRow(nodeInfo))
+	if err == nil {
+		err = tx.Submit()
+	}
+	if err != nil {
+		tx.RollbackOnFailure(err)
+		pool.Close()
+		return nil, fmt.Errorf("failed to write node info: %w", err)
+	}
+	return idx, nil
+}
+
+// BeginTx starts a transaction for the rows of a block. Errors are deferred to the first use of
+// the returned batch.
+func (idx *Indexer) BeginTx(number *big.Int, ctx context.Context) interfaces.Batch {
+	return idx.beginTx(ctx, number)
+}
+
+// PushHeader writes the header and its IPLD block, and returns the header ID.
+func (idx *Indexer) PushHeader(batch interfaces.Batch, header *types.Header, reward, td *big.Int) (string, error) {
+	tx, ok := batch.(*BatchTx)
+	if !ok {
+		return "", fmt.Errorf("unexpected batch type %T", batch)
+	}
+	headerRLP, err := rlp.EncodeToBytes(header)
+	if err != nil {
+		return "", err
+	}
+	headerID := header.Hash().String()
+	headerCID := ipld.Keccak256ToCid(ipld.MEthHeader, header.Hash().Bytes()).String()
+	err = tx.push(&schema.TableIPLDBlock, ipldRow(tx.number.Int64(), headerCID, headerRLP))
+	if err != nil {
+		return "", err
+	}
+	return headerID, tx.push(&schema.TableHeader, headerRow(tx.number.Int64(), header, headerCID, reward, td, idx.nodeInfo.ID))
+}
+
+// PushStateNode writes the state leaf row and the rows of its storage leaves.
+func (idx *Indexer) PushStateNode(batch interfaces.Batch, stateNode sdtypes.StateLeafNode, headerID string) error {
+	tx, ok := batch.(*BatchTx)
+	if !ok {
+		return fmt.Errorf("unexpected batch type %T", batch)
+	}
+	if err := tx.push(&schema.TableStateNode, stateRow(tx.number.Int64(), headerID, stateNode)); err != nil {
+		return err
+	}
+	stateKey := common.BytesToHash(stateNode.AccountWrapper.LeafKey).String()
+	for _, storageNode := range stateNode.StorageDiff {
+		row := storageRow(tx.number.Int64(), headerID, stateKey, storageNode)
+		if err := tx.push(&schema.TableStorageNode, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PushIPLD writes an IPLD block. Duplicate blocks are ignored.
+func (idx *Indexer) PushIPLD(batch interfaces.Batch, i sdtypes.IPLD) error {
+	tx, ok := batch.(*BatchTx)
+	if !ok {
+		return fmt.Errorf("unexpected batch type %T", batch)
+	}
+	return tx.push(&schema.TableIPLDBlock, ipldRow(tx.number.Int64(), i.CID, i.Content))
+}
+
+// The rows of each table, with values in the order of the table's columns
+
+func nodeInfoRow(info node.Info) []interface{} {
+	return []interface{}{info.GenesisBlock, info.NetworkID, info.ID, info.ClientName, info.ChainID}
+}
+
+func headerRow(number int64, header *types.Header, headerCID string, reward, td *big.Int, nodeID string) []interface{} {
+	return []interface{}{
+		number, header.Hash().String(), header.ParentHash.String(), headerCID, td, []string{nodeID},
+		reward, header.Root.String(), header.TxHash.String(), header.ReceiptHash.String(),
+		header.UncleHash.String(), header.Bloom.Bytes(), header.Time, header.Coinbase.String(),
+	}
+}
+
+// stateRow returns the row of a state leaf. Removed nodes are recorded with zero values, as by
+// the statediff indexer.
+func stateRow(number int64, headerID string, stateNode sdtypes.StateLeafNode) []interface{} {
+	stateKey := common.BytesToHash(stateNode.AccountWrapper.LeafKey).String()
+	if stateNode.Removed {
+		return []interface{}{
+			number, headerID, stateKey, shared.RemovedNodeStateCID, true, big.NewInt(0), uint64(0), "", "", true,
+		}
+	}
+	account := stateNode.AccountWrapper.Account
+	return []interface{}{
+		number, headerID, stateKey, stateNode.AccountWrapper.CID, true, account.Balance,
+		account.Nonce, common.BytesToHash(account.CodeHash).String(), account.Root.String(), false,
+	}
+}
+
+func storageRow(number int64, headerID, stateKey string, storageNode sdtypes.StorageLeafNode) []interface{} {
+	storageKey := common.BytesToHash(storageNode.LeafKey).String()
+	if storageNode.Removed {
+		return []interface{}{number, headerID, stateKey, storageKey, shared.RemovedNodeStorageCID, true, []byte{}, true}
+	}
+	return []interface{}{number, headerID, stateKey, storageKey, storageNode.CID, true, storageNode.Value, false}
+}
+
+func ipldRow(number int64, cid string, data []byte) []interface{} {
+	return []interface{}{number, cid, data}
+}
+
+// Close closes the connection pool.
+func (idx *Indexer) Close() error {
+	idx.pool.Close()
+	return nil
+}
+
+func (idx *Indexer) PushBlock(*types.Block, types.Receipts, *big.Int) (interfaces.Batch, error) {
+	return nil, errNotSupported
+}
+
+func (idx *Indexer) CurrentBlock() (*models.HeaderModel, error) {
+	return nil, errNotSupported
+}
+
+func (idx *Indexer) DetectGaps(uint64, uint64) ([]*interfaces.BlockGap, error) {
+	return nil, errNotSupported
+}
+
+func (idx *Indexer) HasBlock(common.Hash, uint64) (bool, error) {
+	return false, errNotSupported
+}
+
+func (idx *Indexer) LoadWatchedAddresses() ([]common.Address, error) {
+	return nil, errNotSupported
+}
+
+func (idx *Indexer) InsertWatchedAddresses([]sdtypes.WatchAddressArg, *big.Int) error {
+	return errNotSupported
+}
+
+func (idx *Indexer) RemoveWatchedAddresses([]sdtypes.WatchAddressArg) error {
+	return errNotSupported
+}
+
+func (idx *Indexer) SetWatchedAddresses([]sdtypes.WatchAddressArg, *big.Int) error {
+	return errNotSupported
+}
+
+func (idx *Indexer) ClearWatchedAddresses() error {
+	return errNotSupported
+}
+
+// ReportDBMetrics is a no-op.
+func (idx *Indexer) ReportDBMetrics(time.Duration, <-chan bool) {}
+
+// Stats returns the stats of the connection pool.
+func (idx *Indexer) Stats() metrics.DbStats {
+	return poolStats{idx.pool.Stat()}
+}
+
+// poolStats adapts the stats of a pgx pool, which does not close connections for being idle or
+// too old, to the stats of an SQL database.
+type poolStats struct {
+	stat *pgxpool.Stat
+}
+
+func (s poolStats) MaxOpen() int64 {
+	return int64(s.stat.MaxConns())
+}
+
+func (s poolStats) Open() int64 {
+	return int64(s.stat.TotalConns())
+}
+
+func (s poolStats) InUse() int64 {
+	return int64(s.stat.AcquiredConns())
+}
+
+func (s poolStats) Idle() int64 {
+	return int64(s.stat.IdleConns())
+}
+
+func (s poolStats) WaitCount() int64 {
+	return s.stat.EmptyAcquireCount()
+}
+
+func (s poolStats) WaitDuration() time.Duration {
+	return s.stat.AcquireDuration()
+}
+
+func (s poolStats) MaxIdleClosed() int64 {
+	return 0
+}
+
+func (s poolStats) MaxLifetimeClosed() int64 {
+	return 0
+}
@@ -0,0 +1,231 @@
+package pgcopy
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/database/sql/postgres"
+	"github.com/cerc-io/plugeth-statediff/indexer/node"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testNodeInfo = node.Info{
+		ID:           "pgcopy_test_node",
+		ClientName:   "test_client",
+		GenesisBlock: "TEST_GENESIS",
+		NetworkID:    "test_network",
+		ChainID:      1,
+	}
+	// the database of test/compose.yml
+	testPgConfig = postgres.Config{
+		Hostname:     "localhost",
+		Port:         8077,
+		DatabaseName: "cerc_testing",
+		Username:     "vdbm",
+		Password:     "password",
+		MaxConns:     4,
+	}
+	// testHeight is a block number not written by other tests
+	testHeight = big.NewInt(1 << 40)
+)
+
+// columns maps the columns of the table to the values of the row.
+func columns(t *testing.T, table *schema.Table, row []interface{}) map[string]interface{} {
+	require.Len(t, row, len(table.Columns), "row of %s", table.Name)
+	ret := make(map[string]interface{}, len(row))
+	for i, col := range table.Columns {
+		ret[col.Name] = row[i]
+	}
+	return ret
+}
+
+func testStateNode(key common.Hash, removed bool) sdtypes.StateLeafNode {
+	return sdtypes.StateLeafNode{
+		Removed: removed,
+		AccountWrapper: sdtypes.AccountWrapper{
+			Account: &types.StateAccount{
+				Nonce:    2,
+				Balance:  big.NewInt(3),
+				Root:     common.Hash{4},
+				CodeHash: common.Hash{5}.Bytes(),
+			},
+			LeafKey: key.Bytes(),
+			CID:     "state_cid",
+		},
+		StorageDiff: []sdtypes.StorageLeafNode{
+			{LeafKey: common.Hash{6}.Bytes(), Value: []byte{7}, CID: "storage_cid"},
+		},
+	}
+}
+
+func TestColumnOrder(t *testing.T) {
+	header := &types.Header{Number: big.NewInt(32), Difficulty: big.NewInt(1), Time: 1000,
+		ParentHash: common.Hash{1}, Root: common.Hash{2}, Coinbase: common.Address{3}}
+	stateKey := common.Hash{1}
+
+	t.Run("node info", func(t *testing.T) {
+		row := columns(t, &schema.TableNodeInfo, nodeInfoRow(testNodeInfo))
+		require.Equal(t, testNodeInfo.GenesisBlock, row["genesis_block"])
+		require.Equal(t, testNodeInfo.NetworkID, row["network_id"])
+		require.Equal(t, testNodeInfo.ID, row["node_id"])
+		require.Equal(t, testNodeInfo.ClientName, row["client_name"])
+		require.Equal(t, testNodeInfo.ChainID, row["chain_id"])
+	})
+
+	t.Run("header", func(t *testing.T) {
+		reward, td := big.NewInt(2), big.NewInt(3)
+		row := columns(t, &schema.TableHeader, headerRow(32, header, "header_cid", reward, td, testNodeInfo.ID))
+		require.Equal(t, int64(32), row["block_number"])
+		require.Equal(t, header.Hash().String(), row["block_hash"])
+		require.Equal(t, header.ParentHash.String(), row["parent_hash"])
+		require.Equal(t, "header_cid", row["cid"])
+		require.Equal(t, td, row["td"])
+		require.Equal(t, []string{testNodeInfo.ID}, row["node_ids"])
+		require.Equal(t, reward, row["reward"])
+		require.Equal(t, header.Root.String(), row["state_root"])
+		require.Equal(t, header.TxHash.String(), row["tx_root"])
+		require.Equal(t, header.ReceiptHash.String(), row["receipt_root"])
+		require.Equal(t, header.UncleHash.String(), row["uncles_hash"])
+		require.Equal(t, header.Bloom.Bytes(), row["bloom"])
+		require.Equal(t, header.Time, row["timestamp"])
+		require.Equal(t, header.Coinbase.String(), row["coinbase"])
+	})
+
+	t.Run("state node", func(t *testing.T) {
+		node := testStateNode(stateKey, false)
+		row := columns(t, &schema.TableStateNode, stateRow(32, "header_id", node))
+		require.Equal(t, int64(32), row["block_number"])
+		require.Equal(t, "header_id", row["header_id"])
+		require.Equal(t, stateKey.String(), row["state_leaf_key"])
+		require.Equal(t, "state_cid", row["cid"])
+		require.Equal(t, true, row["diff"])
+		require.Equal(t, node.AccountWrapper.Account.Balance, row["balance"])
+		require.Equal(t, node.AccountWrapper.Account.Nonce, row["nonce"])
+		require.Equal(t, common.Hash{5}.String(), row["code_hash"])
+		require.Equal(t, common.Hash{4}.String(), row["storage_root"])
+		require.Equal(t, false, row["removed"])
+
+		removed := columns(t, &schema.TableStateNode, stateRow(32, "header_id", testStateNode(stateKey, true)))
+		require.Equal(t, true, removed["removed"])
+	})
+
+	t.Run("storage node", func(t *testing.T) {
+		storage := testStateNode(stateKey, false).StorageDiff[0]
+		row := columns(t, &schema.TableStorageNode, storageRow(32, "header_id", stateKey.String(), storage))
+		require.Equal(t, int64(32), row["block_number"])
+		require.Equal(t, "header_id", row["header_id"])
+		require.Equal(t, stateKey.String(), row["state_leaf_key"])
+		require.Equal(t, common.Hash{6}.String(), row["storage_leaf_key"])
+		require.Equal(t, "storage_cid", row["cid"])
+		require.Equal(t, true, row["diff"])
+		require.Equal(t, []byte{7}, row["val"])
+		require.Equal(t, false, row["removed"])
+	})
+
+	t.Run("IPLD block", func(t *testing.T) {
+		row := columns(t, &schema.TableIPLDBlock, ipldRow(32, "ipld_cid", []byte{8}))
+		require.Equal(t, int64(32), row["block_number"])
+		require.Equal(t, "ipld_cid", row["key"])
+		require.Equal(t, []byte{8}, row["data"])
+	})
+}
+
+// TestIndexer writes to the database of test/compose.yml, and is skipped if it is not running.
+func TestIndexer(t *testing.T) {
+	ctx := context.Background()
+	idx, err := NewIndexer(ctx, testPgConfig, testNodeInfo)
+	if err != nil {
+		t.Skipf("database not available: %v", err)
+	}
+	t.Cleanup(func() { idx.Close() })
+	// copy in small batches, so that workers copy concurrently with buffering
+	idx.batchSize = 7
+
+	deleteRows := func() {
+		for _, table := range []*schema.Table{
+			&schema.TableHeader, &schema.TableStateNode, &schema.TableStorageNode, &schema.TableIPLDBlock,
+		} {
+			_, err := idx.pool.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE block_number = $1", table.Name), testHeight.Int64())
+			require.NoError(t, err)
+		}
+	}
+	deleteRows()
+	t.Cleanup(deleteRows)
+
+	count := func(table *schema.Table) int {
+		var n int
+		stm := fmt.Sprintf("SELECT count(*) FROM %s WHERE block_number = $1", table.Name)
+		require.NoError(t, idx.pool.QueryRow(ctx, stm, testHeight.Int64()).Scan(&n))
+		return n
+	}
+
+	header := &types.Header{Number: testHeight, Difficulty: big.NewInt(1), Time: 1000}
+	tx := idx.BeginTx(header.Number, ctx)
+	headerID, err := idx.PushHeader(tx, header, big.NewInt(2), big.NewInt(3))
+	require.NoError(t, err)
+
+	const workers, perWorker = 4, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				key := common.BigToHash(big.NewInt(int64(w*perWorker + i)))
+				if err := idx.PushStateNode(tx, testStateNode(key, false), headerID); err != nil {
+					errs <- err
+					return
+				}
+				// every worker writes the same IPLDs, which are only inserted once
+				ipld := sdtypes.IPLD{CID: fmt.Sprintf("pgcopy_test_%d", i), Content: []byte{byte(i)}}
+				if err := idx.PushIPLD(tx, ipld); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.NoError(t, tx.Submit())
+
+	require.Equal(t, 1, count(&schema.TableHeader))
+	require.Equal(t, workers*perWorker, count(&schema.TableStateNode))
+	require.Equal(t, workers*perWorker, count(&schema.TableStorageNode))
+	// IPLDs pushed, plus the header
+	require.Equal(t, perWorker+1, count(&schema.TableIPLDBlock))
+
+	// rows already written are skipped
+	tx = idx.BeginTx(header.Number, ctx)
+	_, err = idx.PushHeader(tx, header, big.NewInt(2), big.NewInt(3))
+	require.NoError(t, err)
+	require.NoError(t, idx.PushStateNode(tx, testStateNode(common.Hash{}, false), headerID))
+	require.NoError(t, tx.Submit())
+	require.Equal(t, 1, count(&schema.TableHeader))
+	require.Equal(t, workers*perWorker, count(&schema.TableStateNode))
+
+	t.Run("failed submit is rolled back", func(t *testing.T) {
+		tx := idx.BeginTx(header.Number, ctx)
+		require.NoError(t, idx.PushIPLD(tx, sdtypes.IPLD{CID: "pgcopy_test_rollback", Content: []byte{1}}))
+		// a cancelled context fails the copy
+		batch := tx.(*BatchTx)
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		batch.ctx = cctx
+		require.Error(t, tx.Submit())
+		require.Error(t, tx.Submit(), "the error is kept")
+		require.Equal(t, perWorker+1, count(&schema.TableIPLDBlock))
+	})
+}
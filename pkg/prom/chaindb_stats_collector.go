@@ -0,0 +1,209 @@
+// VulcanizeDB
+// Copyright © 2023 Vulcanize
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package prom
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	gethmetrics "github.com/ethereum/go-ethereum/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const chainDBSubsystem = "chaindb"
+
+// ChainDBNamespace is the prefix of the meters which geth registers for the chain database, if
+// its metrics are enabled
+const ChainDBNamespace = "ipld-eth-state-snapshot/chaindata/"
+
+// The stats of a chain database, which are only exported if reported by its engine
+const (
+	chainDBCompactions       = "compactions_total"
+	chainDBCompactionSeconds = "compaction_seconds_total"
+	chainDBReadBytes         = "read_bytes_total"
+	chainDBWriteBytes        = "write_bytes_total"
+	chainDBBlockCacheBytes   = "block_cache_bytes"
+	chainDBOpenFiles         = "open_files"
+)
+
+// ChainDBStatsCollector implements the prometheus.Collector interface for the internal stats of
+// the source chain database, scraped from the properties of its LevelDB engine, or from the
+// meters geth registers for its Pebble engine.
+type ChainDBStatsCollector struct {
+	engine string
+	prefix string
+	db     ethdb.KeyValueStater
+
+	// descriptions of exported metrics, by stat
+	descs map[string]*prometheus.Desc
+}
+
+var chainDBStats = []struct {
+	name, help string
+	valueType  prometheus.ValueType
+}{
+	{chainDBCompactions, "The total number of compactions, including memtable flushes.", prometheus.CounterValue},
+	{chainDBCompactionSeconds, "The total time spent in compactions.", prometheus.CounterValue},
+	{chainDBReadBytes, "The total bytes read from disk by the database (leveldb), or by compactions (pebble).", prometheus.CounterValue},
+	{chainDBWriteBytes, "The total bytes written to disk by the database (leveldb), or by the WAL, flushes and compactions (pebble).", prometheus.CounterValue},
+	{chainDBBlockCacheBytes, "The size of the block cache.", prometheus.GaugeValue},
+	{chainDBOpenFiles, "The number of open table files.", prometheus.GaugeValue},
+}
+
+// NewChainDBStatsCollector creates a new ChainDBStatsCollector for a database of the given engine
+// ("leveldb" or "pebble"), whose meters are registered by geth with the prefix.
+func NewChainDBStatsCollector(engine, prefix string, db ethdb.KeyValueStater) *ChainDBStatsCollector {
+	labels := prometheus.Labels{"engine": engine}
+	c := &ChainDBStatsCollector{
+		engine: engine,
+		prefix: prefix,
+		db:     db,
+		descs:  make(map[string]*prometheus.Desc, len(chainDBStats)),
+	}
+	for _, stat := range chainDBStats {
+		c.descs[stat.name] = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, chainDBSubsystem, stat.name),
+			stat.help,
+			nil,
+			labels,
+		)
+	}
+	return c
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *ChainDBStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, stat := range chainDBStats {
+		ch <- c.descs[stat.name]
+	}
+}
+
+// Collect implements the prometheus.Collector interface. Stats which the engine does not report,
+// or fails to, are skipped.
+func (c *ChainDBStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	var stats map[string]float64
+	switch c.engine {
+	case "leveldb":
+		stats = levelDBStats(c.db)
+	case "pebble":
+		stats = pebbleStats(c.prefix)
+	}
+	for _, stat := range chainDBStats {
+		if value, ok := stats[stat.name]; ok {
+			ch <- prometheus.MustNewConstMetric(c.descs[stat.name], stat.valueType, value)
+		}
+	}
+}
+
+// levelDBStats reads the stats of a LevelDB database from its properties, which are formatted from
+// its DBStats; geth does not expose the DBStats themselves. LevelDB does not count the hits and
+// misses of its block cache.
+func levelDBStats(db ethdb.KeyValueStater) map[string]float64 {
+	stats := make(map[string]float64)
+	if s, err := db.Stat("leveldb.compcount"); err == nil {
+		// MemComp:%d Level0Comp:%d NonLevel0Comp:%d SeekComp:%d
+		var total float64
+		fields := parseFields(s)
+		for _, n := range fields {
+			total += n
+		}
+		if len(fields) != 0 {
+			stats[chainDBCompactions] = total
+		}
+	}
+	if s, err := db.Stat("leveldb.stats"); err == nil {
+		// a table of compactions by level, ending with a total row of
+		// Tables | Size(MB) | Time(sec) | Read(MB) | Write(MB)
+		scanner := bufio.NewScanner(strings.NewReader(s))
+		for scanner.Scan() {
+			cols := strings.Split(scanner.Text(), "|")
+			if len(cols) != 6 || strings.TrimSpace(cols[0]) != "Total" {
+				continue
+			}
+			if secs, err := strconv.ParseFloat(strings.TrimSpace(cols[3]), 64); err == nil {
+				stats[chainDBCompactionSeconds] = secs
+			}
+		}
+	}
+	if s, err := db.Stat("leveldb.iostats"); err == nil {
+		// Read(MB):%.5f Write(MB):%.5f
+		if fields := parseFields(s); len(fields) == 2 {
+			stats[chainDBReadBytes] = fields[0] * (1 << 20)
+			stats[chainDBWriteBytes] = fields[1] * (1 << 20)
+		}
+	}
+	if s, err := db.Stat("leveldb.cachedblock"); err == nil {
+		if n, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			stats[chainDBBlockCacheBytes] = n
+		}
+	}
+	if s, err := db.Stat("leveldb.openedtables"); err == nil {
+		if n, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			stats[chainDBOpenFiles] = n
+		}
+	}
+	return stats
+}
+
+// parseFields parses the values of a list of "Name:value" fields.
+func parseFields(s string) []float64 {
+	var ret []float64
+	for _, field := range strings.Fields(s) {
+		_, value, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+// pebbleStats reads the stats of a Pebble database from the meters geth registers for it under
+// the prefix, which it updates every few seconds. Geth v1.12 reports no other stats of Pebble
+// databases, so the size of the block cache and the number of open files are not exported.
+func pebbleStats(prefix string) map[string]float64 {
+	stats := make(map[string]float64)
+	// flushes, and level 0, non-level 0 and read-triggered compactions
+	var compactions int64
+	var found bool
+	for _, name := range []string{"compact/memory", "compact/level0", "compact/nonlevel0", "compact/seek"} {
+		if g, ok := gethmetrics.DefaultRegistry.Get(prefix + name).(gethmetrics.Gauge); ok {
+			compactions += g.Value()
+			found = true
+		}
+	}
+	if found {
+		stats[chainDBCompactions] = float64(compactions)
+	}
+	if m, ok := gethmetrics.DefaultRegistry.Get(prefix + "compact/time").(gethmetrics.Meter); ok {
+		stats[chainDBCompactionSeconds] = time.Duration(m.Count()).Seconds()
+	}
+	if m, ok := gethmetrics.DefaultRegistry.Get(prefix + "compact/input").(gethmetrics.Meter); ok {
+		stats[chainDBReadBytes] = float64(m.Count())
+	}
+	if m, ok := gethmetrics.DefaultRegistry.Get(prefix + "disk/write").(gethmetrics.Meter); ok {
+		stats[chainDBWriteBytes] = float64(m.Count())
+	}
+	return stats
+}
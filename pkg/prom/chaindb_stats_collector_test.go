@@ -0,0 +1,105 @@
+package prom
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	gethmetrics "github.com/ethereum/go-ethereum/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// collectChainDBStats collects the stats of the database, by name.
+func collectChainDBStats(t *testing.T, engine, prefix string, db ethdb.KeyValueStater) map[string]float64 {
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(NewChainDBStatsCollector(engine, prefix, db))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, f := range families {
+		name := strings.TrimPrefix(f.GetName(), "ipld_eth_state_snapshot_chaindb_")
+		metric := f.GetMetric()[0]
+		if metric.GetCounter() != nil {
+			values[name] = metric.GetCounter().GetValue()
+		} else {
+			values[name] = metric.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+// writeTestData writes to the database, and compacts it, so that it has tables on disk.
+func writeTestData(t *testing.T, db ethdb.KeyValueStore) {
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, db.Put([]byte{byte(i >> 8), byte(i)}, make([]byte, 100)))
+	}
+	require.NoError(t, db.Compact(nil, nil))
+	value, err := db.Get([]byte{0, 1})
+	require.NoError(t, err)
+	require.Len(t, value, 100)
+}
+
+func TestChainDBStats(t *testing.T) {
+	t.Run("leveldb", func(t *testing.T) {
+		db, err := rawdb.NewLevelDBDatabase(filepath.Join(t.TempDir(), "chaindata"), 16, 16, "", false)
+		require.NoError(t, err)
+		defer db.Close()
+		writeTestData(t, db)
+
+		values := collectChainDBStats(t, "leveldb", "", db)
+		for _, name := range []string{
+			"compactions_total", "compaction_seconds_total", "read_bytes_total", "write_bytes_total",
+			"block_cache_bytes", "open_files",
+		} {
+			require.Contains(t, values, name)
+		}
+		require.NotZero(t, values["compactions_total"])
+		require.NotZero(t, values["write_bytes_total"])
+		require.NotZero(t, values["open_files"])
+	})
+
+	t.Run("pebble", func(t *testing.T) {
+		// geth only registers the meters of the database if its metrics are enabled when it is
+		// opened
+		enabled := gethmetrics.Enabled
+		gethmetrics.Enabled = true
+		t.Cleanup(func() { gethmetrics.Enabled = enabled })
+
+		// the meters stay registered once the database is closed, so each is opened with a
+		// prefix of its own
+		dir := t.TempDir()
+		prefix := dir + "/"
+		db, err := rawdb.NewPebbleDBDatabase(filepath.Join(dir, "chaindata"), 16, 16, prefix, false)
+		if err != nil {
+			t.Skipf("pebble not supported: %v", err)
+		}
+		defer db.Close()
+		// the first compaction moves the table to the bottom level, without reading it, so the
+		// data is written again to be merged with it
+		writeTestData(t, db)
+		writeTestData(t, db)
+
+		// the meters are updated every few seconds
+		var values map[string]float64
+		require.Eventually(t, func() bool {
+			values = collectChainDBStats(t, "pebble", prefix, db)
+			return values["compactions_total"] != 0
+		}, 10*time.Second, 100*time.Millisecond)
+		names := []string{"compactions_total", "compaction_seconds_total", "read_bytes_total", "write_bytes_total"}
+		for _, name := range names {
+			require.Contains(t, values, name)
+		}
+		// the size of the block cache and the number of open files are not reported
+		require.Len(t, values, len(names))
+		require.NotZero(t, values["compaction_seconds_total"])
+		require.NotZero(t, values["read_bytes_total"])
+		require.NotZero(t, values["write_bytes_total"])
+
+		// a database without meters has no stats
+		require.Empty(t, collectChainDBStats(t, "pebble", prefix+"missing/", db))
+	})
+}
@@ -0,0 +1,255 @@
+// VulcanizeDB
+// Copyright © 2023 Vulcanize
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package prom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+
+	iterutil "github.com/cerc-io/eth-iterator-utils"
+)
+
+// EstimateParams configures the sampling of a trie to estimate its size.
+type EstimateParams struct {
+	// Depth is the depth, in nibbles, of the strata the key space is divided into (at most 4)
+	Depth int
+	// ExactLimit is the number of leaves up to which a stratum is counted exactly; denser strata
+	// are sampled
+	ExactLimit int
+	// Probes is the number of random probes of each sampled stratum
+	Probes int
+	// Rand is the source of the probe positions
+	Rand *rand.Rand
+}
+
+// DefaultEstimateParams divides the key space into 256 strata, so a sparse trie is counted
+// exactly, and a dense one is sampled with 2048 probes.
+var DefaultEstimateParams = EstimateParams{
+	Depth:      2,
+	ExactLimit: 64,
+	Probes:     8,
+}
+
+// TrieSize is an estimate of the number of leaves in each stratum of the key space of a trie.
+type TrieSize struct {
+	depth  int
+	leaves []float64
+	// exact records whether every stratum was counted rather than sampled
+	exact bool
+	// variance is the variance of the estimate of the total, from the sampled strata
+	variance float64
+}
+
+// EstimateTrieSize estimates the number of leaves of a trie by stratified sampling. The key space
+// is divided into equal strata, and each is counted exactly up to a limit. The leaf keys of a
+// hashed trie are uniformly distributed, so the leaves of a denser stratum are estimated from its
+// density: the gaps between adjacent leaves are exponentially distributed with a mean of the
+// inverse of the density, which is estimated from the gaps found by probes at random positions.
+//
+// The estimate of a sampled stratum of n leaves is limited by the randomness of the gaps between
+// them, and by the number of probes p, so its relative standard error is taken to be
+// 1.5/sqrt(min(n, p)). The standard error of the total is reported by StdErr.
+func EstimateTrieSize(ctor iterutil.IteratorConstructor, params EstimateParams) (*TrieSize, error) {
+	if params.Depth < 0 || params.Depth > 4 {
+		return nil, fmt.Errorf("invalid stratum depth %d", params.Depth)
+	}
+	rng := params.Rand
+	if rng == nil {
+		rng = rand.New(rand.NewSource(rand.Int63()))
+	}
+	strata := 1 << (4 * params.Depth)
+	size := &TrieSize{depth: params.Depth, leaves: make([]float64, strata), exact: true}
+	dense, err := size.count(ctor, params.ExactLimit)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range dense {
+		size.exact = false
+		lo, hi := size.stratumBounds(s)
+		density, err := sampleDensity(ctor, lo, hi, params.Probes, rng)
+		if err != nil {
+			return nil, err
+		}
+		// The stratum was found to have more leaves than the limit
+		n := math.Max(density*float64(hi-lo), float64(params.ExactLimit+1))
+		size.leaves[s] = n
+		stderr := n * 1.5 / math.Sqrt(math.Min(n, float64(params.Probes)))
+		size.variance += stderr * stderr
+	}
+	return size, nil
+}
+
+// count counts the leaves of each stratum in order, moving to the next once a stratum has more
+// than limit leaves. It returns the strata which exceeded the limit.
+func (s *TrieSize) count(ctor iterutil.IteratorConstructor, limit int) ([]int, error) {
+	var dense []int
+	stratum := 0
+	it := ctor(nil)
+	for it.Next(true) {
+		if !it.Leaf() {
+			continue
+		}
+		key := it.LeafKey()
+		ks := s.stratumOf(key)
+		if ks < stratum {
+			continue
+		}
+		stratum = ks
+		s.leaves[ks]++
+		if int(s.leaves[ks]) <= limit {
+			continue
+		}
+		dense = append(dense, ks)
+		if ks+1 == len(s.leaves) {
+			break
+		}
+		// Skip the rest of the stratum, seeking to the path of the next, so that a leaf whose path
+		// is shorter than the stratum depth is not passed over
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+		stratum = ks + 1
+		it = ctor(s.stratumKey(stratum))
+	}
+	return dense, it.Error()
+}
+
+// sampleDensity estimates the density of leaves, per unit of key position, between the positions
+// lo and hi (inclusive). Each probe scans from a random position to the second leaf after it, or
+// to hi if that comes first. The leaves of a hashed trie are placed at random, so the distances
+// scanned are those of a Poisson process, and the density is estimated as the leaves found per
+// distance scanned.
+func sampleDensity(ctor iterutil.IteratorConstructor, lo, hi uint64, probes int, rng *rand.Rand) (float64, error) {
+	var found int
+	var distance float64
+	for i := 0; i < probes; i++ {
+		pos := lo + rng.Uint64()%(hi-lo)
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, pos)
+		var leaves []uint64
+		it := ctor(start)
+		for len(leaves) < 2 && it.Next(true) {
+			if !it.Leaf() {
+				continue
+			}
+			leaf := keyPosition(it.LeafKey())
+			if leaf > hi {
+				break
+			}
+			leaves = append(leaves, leaf)
+		}
+		if err := it.Error(); err != nil {
+			return 0, err
+		}
+		found += len(leaves)
+		if len(leaves) == 2 {
+			distance += float64(leaves[1] - pos)
+		} else {
+			distance += float64(hi - pos)
+		}
+	}
+	if distance == 0 {
+		return 0, nil
+	}
+	return float64(found) / distance, nil
+}
+
+// Total returns the estimated number of leaves in the trie.
+func (s *TrieSize) Total() float64 {
+	var total float64
+	for _, n := range s.leaves {
+		total += n
+	}
+	return total
+}
+
+// Exact returns whether the trie was small enough to be counted exactly.
+func (s *TrieSize) Exact() bool {
+	return s.exact
+}
+
+// StdErr returns the standard error of the estimated number of leaves, which is zero if it was
+// counted exactly.
+func (s *TrieSize) StdErr() float64 {
+	return math.Sqrt(s.variance)
+}
+
+// Leaves returns the estimated number of leaves between two paths, as nibbles, from start
+// (inclusive) to end (exclusive). A nil end is the end of the trie. Leaves within a stratum are
+// taken to be uniformly distributed.
+func (s *TrieSize) Leaves(start, end []byte) float64 {
+	from, to := pathPosition(start), 1.0
+	if end != nil {
+		to = pathPosition(end)
+	}
+	if from >= to {
+		return 0
+	}
+	width := 1 / float64(len(s.leaves))
+	var ret float64
+	for i, n := range s.leaves {
+		lo, hi := float64(i)*width, float64(i+1)*width
+		overlap := math.Min(hi, to) - math.Max(lo, from)
+		if overlap > 0 {
+			ret += n * overlap / width
+		}
+	}
+	return ret
+}
+
+func (s *TrieSize) stratumOf(key []byte) int {
+	return int(keyPosition(key) >> (64 - 4*s.depth))
+}
+
+// stratumBounds returns the first and last key positions of a stratum.
+func (s *TrieSize) stratumBounds(stratum int) (lo, hi uint64) {
+	shift := 64 - 4*s.depth
+	lo = uint64(stratum) << shift
+	return lo, lo + (math.MaxUint64 >> (4 * s.depth))
+}
+
+// stratumKey returns the first key of a stratum, to seek to it. A key is a whole number of
+// bytes, so the path of a stratum of odd depth is padded with a zero nibble.
+func (s *TrieSize) stratumKey(stratum int) []byte {
+	lo, _ := s.stratumBounds(stratum)
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, lo)
+	return key[:(s.depth+1)/2]
+}
+
+// keyPosition returns the position of a key in the key space, from its first 8 bytes.
+func keyPosition(key []byte) uint64 {
+	var buf [8]byte
+	copy(buf[:], key)
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// pathPosition returns the position of a path, as nibbles, as a fraction of the key space.
+func pathPosition(path []byte) float64 {
+	var pos, scale float64 = 0, 1
+	for _, nibble := range path {
+		if nibble > 0xf {
+			// the terminator of a leaf path
+			break
+		}
+		scale /= 16
+		pos += float64(nibble) * scale
+	}
+	return pos
+}
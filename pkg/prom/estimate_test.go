@@ -0,0 +1,101 @@
+package prom
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/require"
+)
+
+// testLeaves is the number of leaves of the test trie
+const testLeaves = 4096
+
+// testTrie returns a trie of testLeaves leaves, and their hashed keys.
+func testTrie(t *testing.T) (*trie.StateTrie, [][]byte) {
+	tr, err := trie.NewStateTrie(trie.TrieID(types.EmptyRootHash), trie.NewDatabase(rawdb.NewMemoryDatabase()))
+	require.NoError(t, err)
+	keys := make([][]byte, testLeaves)
+	for i := range keys {
+		key := binary.BigEndian.AppendUint64(nil, uint64(i))
+		tr.MustUpdate(key, []byte{1})
+		keys[i] = crypto.Keccak256(key)
+	}
+	return tr, keys
+}
+
+func TestTrieSizeEstimate(t *testing.T) {
+	tr, _ := testTrie(t)
+
+	// a trie this sparse is counted exactly
+	size, err := EstimateTrieSize(tr.NodeIterator, DefaultEstimateParams)
+	require.NoError(t, err)
+	require.True(t, size.Exact())
+	require.Equal(t, float64(testLeaves), size.Total())
+	require.Zero(t, size.StdErr())
+	require.Equal(t, size.Total(), size.Leaves(nil, []byte{8})+size.Leaves([]byte{8}, nil))
+
+	// with every stratum sampled, the estimate is within three standard errors
+	for _, depth := range []int{0, 1} {
+		params := EstimateParams{
+			Depth:      depth,
+			ExactLimit: 0,
+			Probes:     4096 >> (4 * depth),
+			Rand:       rand.New(rand.NewSource(1)),
+		}
+		size, err := EstimateTrieSize(tr.NodeIterator, params)
+		require.NoError(t, err)
+		require.False(t, size.Exact())
+		// about 2.5%, with 4096 probes
+		require.InDelta(t, 0.025*testLeaves, size.StdErr(), 0.005*testLeaves)
+		require.InDelta(t, float64(testLeaves), size.Total(), 3*size.StdErr(), "estimate at depth %d", depth)
+		require.InDelta(t, size.Total(), size.Leaves(nil, nil), 1e-6)
+	}
+}
+
+func TestStratumKey(t *testing.T) {
+	for _, tc := range []struct {
+		depth, stratum int
+		key            []byte
+	}{
+		{1, 0x5, []byte{0x50}},
+		{2, 0x5a, []byte{0x5a}},
+		{3, 0x5a3, []byte{0x5a, 0x30}},
+		{4, 0x5a3c, []byte{0x5a, 0x3c}},
+	} {
+		size := &TrieSize{depth: tc.depth}
+		require.Equal(t, tc.key, size.stratumKey(tc.stratum), "stratum %x at depth %d", tc.stratum, tc.depth)
+	}
+
+	// counting at an odd depth seeks to each stratum after a dense one, and finds every stratum
+	// with leaves
+	tr, keys := testTrie(t)
+	size := &TrieSize{depth: 3, leaves: make([]float64, 1<<12)}
+	expected := map[int]bool{}
+	for _, key := range keys {
+		expected[size.stratumOf(key)] = true
+	}
+	var seeks [][]byte
+	ctor := func(start []byte) trie.NodeIterator {
+		seeks = append(seeks, start)
+		return tr.NodeIterator(start)
+	}
+	dense, err := size.count(ctor, 0)
+	require.NoError(t, err)
+	require.True(t, sort.IntsAreSorted(dense))
+	require.Len(t, dense, len(expected))
+	for _, s := range dense {
+		require.True(t, expected[s], "stratum %x has no leaves", s)
+		require.Equal(t, 1.0, size.leaves[s])
+	}
+	require.Nil(t, seeks[0])
+	for i, seek := range seeks[1:] {
+		// after the first stratum with leaves, each seek is to the stratum after a dense one
+		require.Equal(t, size.stratumKey(dense[i]+1), seek)
+	}
+}
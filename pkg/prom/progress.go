@@ -0,0 +1,161 @@
+// VulcanizeDB
+// Copyright © 2023 Vulcanize
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package prom
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sampleInterval is the interval at which the progress metrics are updated
+const sampleInterval = 5 * time.Second
+
+var (
+	// logInterval is the interval at which progress is logged, or zero to not log it
+	logInterval time.Duration
+	// now is the clock of the progress samples, replaced in tests
+	now = time.Now
+)
+
+// SetLogInterval sets the interval at which the progress of a snapshot is logged. Zero disables
+// progress logging.
+func SetLogInterval(interval time.Duration) {
+	logInterval = interval
+}
+
+// ProgressEnabled returns whether the progress of a snapshot is reported, as metrics, logs or
+// status.
+func ProgressEnabled() bool {
+	return metrics || logInterval > 0 || serving
+}
+
+// progressSample is the progress and node counts at a point in time.
+type progressSample struct {
+	time                     time.Time
+	progress                 float64
+	stateNodes, storageNodes uint64
+}
+
+func (t *MetricsTracker) sample() (progressSample, []float64) {
+	workers, overall := t.Progress()
+	return progressSample{
+		time:         now(),
+		progress:     overall,
+		stateNodes:   stateNodes.Load(),
+		storageNodes: storageNodes.Load(),
+	}, workers
+}
+
+// report updates the progress metrics, and logs the progress, until the tracker is closed.
+func (t *MetricsTracker) report() {
+	defer close(t.done)
+	if metrics {
+		workerProgress.Reset()
+	}
+
+	sampleTicker := time.NewTicker(sampleInterval)
+	defer sampleTicker.Stop()
+	var logTick <-chan time.Time
+	if logInterval > 0 {
+		logTicker := time.NewTicker(logInterval)
+		defer logTicker.Stop()
+		logTick = logTicker.C
+	}
+
+	r := newProgressReporter(t)
+	for {
+		logNow := false
+		select {
+		case <-t.quit:
+			return
+		case <-sampleTicker.C:
+		case <-logTick:
+			logNow = true
+		}
+		r.update(logNow)
+	}
+}
+
+// progressReporter measures the rates and ETA of a traversal from samples of its progress.
+//
+// The ETA is estimated from the progress made since the first sample taken once the iterators
+// are created, which for a resumed traversal starts from where it left off. Rates are measured
+// since the previous sample.
+type progressReporter struct {
+	t                      *MetricsTracker
+	first, last            progressSample
+	started                bool
+	stateRate, storageRate float64
+}
+
+func newProgressReporter(t *MetricsTracker) *progressReporter {
+	first, workers := t.sample()
+	return &progressReporter{t: t, first: first, last: first, started: len(workers) != 0}
+}
+
+// update takes a sample, and updates the progress metrics and ETA from it, logging the progress
+// if logNow is set.
+func (r *progressReporter) update(logNow bool) {
+	cur, workers := r.t.sample()
+	if elapsed := cur.time.Sub(r.last.time).Seconds(); elapsed > 0 {
+		r.stateRate = float64(cur.stateNodes-r.last.stateNodes) / elapsed
+		r.storageRate = float64(cur.storageNodes-r.last.storageNodes) / elapsed
+	}
+	r.last = cur
+	if !r.started && len(workers) != 0 {
+		r.first, r.started = cur, true
+	}
+	eta := estimateETA(r.first, cur)
+	r.t.eta.Store(int64(eta))
+
+	if metrics {
+		for i, p := range workers {
+			workerProgress.WithLabelValues(strconv.Itoa(i)).Set(p)
+		}
+		overallProgress.Set(cur.progress)
+		stateNodeRate.Set(r.stateRate)
+		storageNodeRate.Set(r.storageRate)
+		etaSeconds.Set(eta.Seconds())
+	}
+	if logNow {
+		fields := logrus.Fields{
+			"progress":              fmt.Sprintf("%.2f%%", cur.progress),
+			"state_nodes":           cur.stateNodes,
+			"storage_nodes":         cur.storageNodes,
+			"state_nodes_per_sec":   fmt.Sprintf("%.1f", r.stateRate),
+			"storage_nodes_per_sec": fmt.Sprintf("%.1f", r.storageRate),
+		}
+		if eta > 0 {
+			fields["eta"] = eta.Round(time.Second).String()
+		}
+		logrus.WithFields(fields).Info("Snapshot progress")
+	}
+}
+
+// estimateETA estimates the time remaining from the rate of progress between two samples, or
+// returns zero if no progress has been made.
+func estimateETA(from, to progressSample) time.Duration {
+	made := to.progress - from.progress
+	if made <= 0 {
+		return 0
+	}
+	remaining := 100.0 - to.progress
+	return time.Duration(float64(to.time.Sub(from.time)) * remaining / made)
+}
@@ -0,0 +1,91 @@
+package prom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+// testMetrics enables metrics for the duration of the test, registered with a registry of its own.
+func testMetrics(t *testing.T) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	initMetrics(registry)
+	t.Cleanup(func() { metrics = false })
+	return registry
+}
+
+func TestProgressReport(t *testing.T) {
+	testMetrics(t)
+	hook := logtest.NewGlobal()
+	t.Cleanup(hook.Reset)
+
+	clock := time.Unix(1700000000, 0)
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+	stateNodes.Store(0)
+	storageNodes.Store(0)
+
+	// a single iterator over the whole trie, whose progress is measured by its last path
+	it := &metricsIterator{depth: 1, totalSteps: estimateSteps(nil, nil, 1)}
+	tr := &MetricsTracker{iters: []*metricsIterator{it}}
+	step := func(elapsed time.Duration, path []byte, state, storage uint64) {
+		clock = clock.Add(elapsed)
+		it.lastPath = path
+		stateNodes.Add(state)
+		storageNodes.Add(storage)
+	}
+	r := newProgressReporter(tr)
+
+	step(10*time.Second, []byte{0x8}, 100, 500)
+	r.update(false)
+	require.Equal(t, 50.0, testutil.ToFloat64(overallProgress))
+	require.Equal(t, 50.0, testutil.ToFloat64(workerProgress.WithLabelValues("0")))
+	require.Equal(t, 10.0, testutil.ToFloat64(stateNodeRate))
+	require.Equal(t, 50.0, testutil.ToFloat64(storageNodeRate))
+	require.Equal(t, 10.0, testutil.ToFloat64(etaSeconds))
+	require.Empty(t, hook.AllEntries(), "progress is only logged when due")
+
+	// the ETA is measured from the first sample, and the rates from the previous one
+	step(20*time.Second, []byte{0xc}, 100, 0)
+	r.update(true)
+	require.Equal(t, 75.0, testutil.ToFloat64(overallProgress))
+	require.Equal(t, 5.0, testutil.ToFloat64(stateNodeRate))
+	require.Equal(t, 0.0, testutil.ToFloat64(storageNodeRate))
+	require.Equal(t, 10.0, testutil.ToFloat64(etaSeconds))
+	require.Equal(t, int64(10*time.Second), tr.eta.Load())
+
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	require.Equal(t, "Snapshot progress", entry.Message)
+	require.Equal(t, logrus.Fields{
+		"progress":              "75.00%",
+		"state_nodes":           uint64(200),
+		"storage_nodes":         uint64(500),
+		"state_nodes_per_sec":   "5.0",
+		"storage_nodes_per_sec": "0.0",
+		"eta":                   "10s",
+	}, entry.Data)
+
+	// once complete, there is no time remaining
+	it.done = true
+	step(10*time.Second, nil, 0, 0)
+	r.update(true)
+	require.Equal(t, 100.0, testutil.ToFloat64(overallProgress))
+	require.Equal(t, 0.0, testutil.ToFloat64(etaSeconds))
+	require.NotContains(t, hook.LastEntry().Data, "eta")
+}
+
+func TestEstimateETA(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	sample := func(elapsed time.Duration, progress float64) progressSample {
+		return progressSample{time: start.Add(elapsed), progress: progress}
+	}
+	require.Equal(t, 50*time.Second, estimateETA(sample(0, 10), sample(10*time.Second, 25)))
+	require.Zero(t, estimateETA(sample(0, 10), sample(10*time.Second, 10)), "no progress made")
+	require.Zero(t, estimateETA(sample(0, 10), sample(10*time.Second, 100)), "complete")
+}
@@ -17,6 +17,11 @@
 package prom
 
 import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	gethmetrics "github.com/ethereum/go-ethereum/metrics"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -24,8 +29,9 @@ import (
 const (
 	namespace = "ipld_eth_state_snapshot"
 
-	connSubsystem  = "connections"
-	statsSubsystem = "stats"
+	connSubsystem     = "connections"
+	statsSubsystem    = "stats"
+	pipelineSubsystem = "pipeline"
 )
 
 var (
@@ -33,34 +39,134 @@ var (
 
 	stateNodeCount   prometheus.Counter
 	storageNodeCount prometheus.Counter
+	codeNodeCount    prometheus.Counter
+
+	workerProgress  *prometheus.GaugeVec
+	overallProgress prometheus.Gauge
+	stateNodeRate   prometheus.Gauge
+	storageNodeRate prometheus.Gauge
+	etaSeconds      prometheus.Gauge
+
+	pushDuration     *prometheus.HistogramVec
+	lockWait         *prometheus.HistogramVec
+	trieReadDuration *prometheus.HistogramVec
+	submitDuration   *prometheus.HistogramVec
+	ipldBytes        *prometheus.CounterVec
+
+	// node counts are kept whether or not metrics are enabled, to log progress
+	stateNodes   atomic.Uint64
+	storageNodes atomic.Uint64
 )
 
+// Init enables metrics, registering them with the default registry. The metrics of geth are
+// enabled too, since it only registers the meters of the chain database, which are read for its
+// stats, if they are; so Init must be called before the database is opened.
 func Init() {
+	gethmetrics.Enabled = true
+	initMetrics(prometheus.DefaultRegisterer)
+}
+
+func initMetrics(reg prometheus.Registerer) {
 	metrics = true
+	factory := promauto.With(reg)
 
-	stateNodeCount = promauto.NewCounter(prometheus.CounterOpts{
+	stateNodeCount = factory.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
 		Subsystem: statsSubsystem,
 		Name:      "state_node_count",
 		Help:      "Number of state nodes processed",
 	})
 
-	storageNodeCount = promauto.NewCounter(prometheus.CounterOpts{
+	storageNodeCount = factory.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
 		Subsystem: statsSubsystem,
 		Name:      "storage_node_count",
 		Help:      "Number of storage nodes processed",
 	})
-}
 
-func RegisterGaugeFunc(name string, function func() float64) {
-	promauto.NewGaugeFunc(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: statsSubsystem,
-			Name:      name,
-			Help:      name,
-		}, function)
+	codeNodeCount = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "code_node_count",
+		Help:      "Number of code nodes processed",
+	})
+
+	workerProgress = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "worker_progress",
+		Help:      "Estimated progress of each worker through its section of the state trie, as a percentage",
+	}, []string{"worker"})
+
+	overallProgress = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "progress",
+		Help:      "Estimated progress through the state trie, as a percentage",
+	})
+
+	stateNodeRate = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "state_nodes_per_second",
+		Help:      "Rate of state nodes processed",
+	})
+
+	storageNodeRate = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "storage_nodes_per_second",
+		Help:      "Rate of storage nodes processed",
+	})
+
+	etaSeconds = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "eta_seconds",
+		Help:      "Estimated time remaining, in seconds, from the rate of progress (0 if unknown)",
+	})
+
+	// latencies of the steps of writing each node range from microseconds to seconds
+	latencyBuckets := prometheus.ExponentialBuckets(1e-6, 4, 12)
+
+	pushDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: pipelineSubsystem,
+		Name:      "push_duration_seconds",
+		Help:      "Time taken to push a state node or IPLD to the indexer",
+		Buckets:   latencyBuckets,
+	}, []string{"mode", "kind"})
+
+	lockWait = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: pipelineSubsystem,
+		Name:      "lock_wait_seconds",
+		Help:      "Time spent waiting for the lock of a sink before pushing to the indexer",
+		Buckets:   latencyBuckets,
+	}, []string{"mode", "lock"})
+
+	trieReadDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: pipelineSubsystem,
+		Name:      "trie_read_duration_seconds",
+		Help:      "Time taken to step a trie iterator to its next node",
+		Buckets:   latencyBuckets,
+	}, []string{"mode"})
+
+	submitDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: pipelineSubsystem,
+		Name:      "batch_submit_duration_seconds",
+		Help:      "Time taken to submit a batch",
+		Buckets:   prometheus.ExponentialBuckets(1e-3, 4, 10),
+	}, []string{"mode"})
+
+	ipldBytes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: pipelineSubsystem,
+		Name:      "ipld_bytes_written",
+		Help:      "Number of bytes of IPLD block data written",
+	}, []string{"mode"})
 }
 
 // RegisterDBCollector create metric collector for given connection
@@ -70,8 +176,17 @@ func RegisterDBCollector(name string, db DBStatsGetter) {
 	}
 }
 
+// RegisterChainDBCollector creates a metric collector for the internal stats of the chain
+// database of the given engine
+func RegisterChainDBCollector(engine string, db ethdb.KeyValueStater) {
+	if metrics {
+		prometheus.Register(NewChainDBStatsCollector(engine, ChainDBNamespace, db))
+	}
+}
+
 // IncStateNodeCount increments the number of state nodes processed
 func IncStateNodeCount() {
+	stateNodes.Add(1)
 	if metrics {
 		stateNodeCount.Inc()
 	}
@@ -79,11 +194,57 @@ func IncStateNodeCount() {
 
 // AddStorageNodeCount increments the number of storage nodes processed
 func AddStorageNodeCount(count int) {
-	if metrics && count > 0 {
+	if count <= 0 {
+		return
+	}
+	storageNodes.Add(uint64(count))
+	if metrics {
 		storageNodeCount.Add(float64(count))
 	}
 }
 
+// IncCodeNodeCount increments the number of code nodes processed
+func IncCodeNodeCount() {
+	if metrics {
+		codeNodeCount.Inc()
+	}
+}
+
+// ObservePush records the time taken to push a node of the kind ("state" or "ipld") to the indexer
+func ObservePush(mode, kind string, d time.Duration) {
+	if metrics {
+		pushDuration.WithLabelValues(mode, kind).Observe(d.Seconds())
+	}
+}
+
+// ObserveLockWait records the time spent waiting for the lock ("node" or "ipld") of a sink
+func ObserveLockWait(mode, lock string, d time.Duration) {
+	if metrics {
+		lockWait.WithLabelValues(mode, lock).Observe(d.Seconds())
+	}
+}
+
+// ObserveTrieRead records the time taken to step a trie iterator
+func ObserveTrieRead(mode string, d time.Duration) {
+	if metrics {
+		trieReadDuration.WithLabelValues(mode).Observe(d.Seconds())
+	}
+}
+
+// ObserveSubmit records the time taken to submit a batch
+func ObserveSubmit(mode string, d time.Duration) {
+	if metrics {
+		submitDuration.WithLabelValues(mode).Observe(d.Seconds())
+	}
+}
+
+// AddIPLDBytes increments the number of bytes of IPLD data written
+func AddIPLDBytes(mode string, count int) {
+	if metrics && count > 0 {
+		ipldBytes.WithLabelValues(mode).Add(float64(count))
+	}
+}
+
 func Enabled() bool {
 	return metrics
 }
@@ -0,0 +1,85 @@
+package prom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// sampleCount returns the number of observations of the histogram with the name in the registry.
+func sampleCount(t *testing.T, registry *prometheus.Registry, name string) uint64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	var count uint64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			count += m.GetHistogram().GetSampleCount()
+		}
+	}
+	return count
+}
+
+func TestPipelineMetrics(t *testing.T) {
+	registry := testMetrics(t)
+	const (
+		pushName     = "ipld_eth_state_snapshot_pipeline_push_duration_seconds"
+		lockName     = "ipld_eth_state_snapshot_pipeline_lock_wait_seconds"
+		trieReadName = "ipld_eth_state_snapshot_pipeline_trie_read_duration_seconds"
+		submitName   = "ipld_eth_state_snapshot_pipeline_batch_submit_duration_seconds"
+		bytesName    = "ipld_eth_state_snapshot_pipeline_ipld_bytes_written"
+	)
+
+	// a series of each metric is registered on its first observation
+	ObservePush("snapshot", "state", time.Millisecond)
+	ObserveLockWait("snapshot", "node", time.Millisecond)
+	ObserveTrieRead("snapshot", time.Millisecond)
+	ObserveSubmit("snapshot", time.Millisecond)
+	AddIPLDBytes("snapshot", 32)
+	for _, name := range []string{pushName, lockName, trieReadName, submitName, bytesName} {
+		require.Equal(t, 1, testutil.CollectAndCount(registry, name), name)
+	}
+	for _, name := range []string{pushName, lockName, trieReadName, submitName} {
+		require.Equal(t, uint64(1), sampleCount(t, registry, name), name)
+	}
+	require.Equal(t, 32.0, testutil.ToFloat64(ipldBytes.WithLabelValues("snapshot")))
+
+	// each push is observed once, in the series of its labels
+	ObservePush("snapshot", "ipld", time.Millisecond)
+	ObservePush("file", "state", time.Millisecond)
+	ObserveLockWait("snapshot", "ipld", time.Millisecond)
+	AddIPLDBytes("file", 8)
+	AddIPLDBytes("file", 0)
+	require.Equal(t, 3, testutil.CollectAndCount(registry, pushName))
+	require.Equal(t, uint64(3), sampleCount(t, registry, pushName))
+	require.Equal(t, 2, testutil.CollectAndCount(registry, lockName))
+	require.Equal(t, uint64(2), sampleCount(t, registry, lockName))
+	require.Equal(t, 2, testutil.CollectAndCount(registry, bytesName))
+	require.Equal(t, 8.0, testutil.ToFloat64(ipldBytes.WithLabelValues("file")))
+
+	// each step of a tracked iterator is a trie read
+	tr, _ := testTrie(t)
+	it := &metricsIterator{NodeIterator: tr.NodeIterator(nil), mode: "file"}
+	var steps uint64
+	for it.Next(true) {
+		steps++
+	}
+	require.NoError(t, it.Error())
+	// the final step, which finds the end of the trie
+	steps++
+	require.Equal(t, 2, testutil.CollectAndCount(registry, trieReadName))
+	require.Equal(t, 1+steps, sampleCount(t, registry, trieReadName))
+
+	// with metrics disabled, the steps are not timed
+	metrics = false
+	it = &metricsIterator{NodeIterator: tr.NodeIterator(nil), mode: "file"}
+	for it.Next(true) {
+	}
+	require.NoError(t, it.Error())
+	require.Equal(t, 1+steps, sampleCount(t, registry, trieReadName))
+}
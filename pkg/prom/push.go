@@ -0,0 +1,231 @@
+// VulcanizeDB
+// Copyright © 2023 Vulcanize
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package prom
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// Pusher pushes the registered metrics to a Pushgateway, so that the final values of a run are
+// kept after it exits. The metrics are pushed periodically, at the end of each run, and once more
+// when the pusher is stopped. They are grouped by job and the height of the current run. The
+// counters, histograms and summaries of the process are cumulative, so the values they had when
+// the run started are subtracted from them, and each height of a range keeps the metrics of its
+// own run. Gauges are pushed as they are.
+type Pusher struct {
+	url, job string
+	gatherer prometheus.Gatherer
+
+	mu sync.Mutex
+	// baseline is the cumulative metrics when the current run started, by metricKey
+	baseline   map[string]*dto.Metric
+	quit, done chan struct{}
+	stopOnce   sync.Once
+}
+
+var (
+	pusherMu     sync.Mutex
+	activePusher *Pusher
+)
+
+// NewPusher creates a pusher of the metrics of the gatherer to the Pushgateway at the URL.
+func NewPusher(url, job string, gatherer prometheus.Gatherer) *Pusher {
+	return &Pusher{
+		url:      url,
+		job:      job,
+		gatherer: gatherer,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// StartPush starts pushing the metrics of the default registry to the Pushgateway at the URL, at
+// the interval, and at the end of each run.
+func StartPush(url, job string, interval time.Duration) *Pusher {
+	p := NewPusher(url, job, prometheus.DefaultGatherer)
+	p.Start(interval)
+	return p
+}
+
+// Start starts pushing the metrics at the interval, if non-zero, and at the end of each run.
+func (p *Pusher) Start(interval time.Duration) {
+	pusherMu.Lock()
+	activePusher = p
+	pusherMu.Unlock()
+	if interval <= 0 {
+		close(p.done)
+		return
+	}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.quit:
+				return
+			case <-ticker.C:
+				p.logError(p.Push())
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic pushes, and pushes the metrics a final time.
+func (p *Pusher) Stop() error {
+	p.stopOnce.Do(func() {
+		close(p.quit)
+		pusherMu.Lock()
+		if activePusher == p {
+			activePusher = nil
+		}
+		pusherMu.Unlock()
+	})
+	<-p.done
+	return p.Push()
+}
+
+// Push pushes the metrics, replacing those previously pushed for the height of the current run.
+// Nothing is pushed before a run has started.
+func (p *Pusher) Push() error {
+	height, ok := currentHeight()
+	if !ok {
+		return nil
+	}
+	// Pushes from the ticker and the end of a run are not interleaved
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return push.New(p.url, p.job).
+		Gatherer(prometheus.GathererFunc(p.gatherRun)).
+		Grouping("height", strconv.FormatUint(height, 10)).
+		Push()
+}
+
+// startRun records the cumulative metrics at the start of a run, to be subtracted from those
+// pushed for it.
+func (p *Pusher) startRun() {
+	families, err := p.gatherer.Gather()
+	baseline := make(map[string]*dto.Metric)
+	for _, family := range families {
+		if !cumulative(family) {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			baseline[metricKey(family, m)] = m
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("module", "prom").Warn("failed to gather metrics at the start of the run")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.baseline = baseline
+}
+
+// gatherRun gathers the metrics of the current run. It is called with the lock held.
+func (p *Pusher) gatherRun() ([]*dto.MetricFamily, error) {
+	families, err := p.gatherer.Gather()
+	for _, family := range families {
+		if !cumulative(family) {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if base, ok := p.baseline[metricKey(family, m)]; ok {
+				subtractMetric(m, base)
+			}
+		}
+	}
+	return families, err
+}
+
+func cumulative(family *dto.MetricFamily) bool {
+	switch family.GetType() {
+	case dto.MetricType_COUNTER, dto.MetricType_HISTOGRAM, dto.MetricType_SUMMARY:
+		return true
+	}
+	return false
+}
+
+// metricKey identifies a metric by the name of its family and its labels.
+func metricKey(family *dto.MetricFamily, m *dto.Metric) string {
+	var b strings.Builder
+	b.WriteString(family.GetName())
+	for _, label := range m.GetLabel() {
+		b.WriteString("\xff" + label.GetName() + "=" + label.GetValue())
+	}
+	return b.String()
+}
+
+// subtractMetric subtracts the values of the base from a cumulative metric. The quantiles of a
+// summary can't be subtracted, so are left as they are.
+func subtractMetric(m, base *dto.Metric) {
+	switch {
+	case m.Counter != nil && base.Counter != nil:
+		m.Counter.Value = float64Ptr(m.Counter.GetValue() - base.Counter.GetValue())
+	case m.Histogram != nil && base.Histogram != nil:
+		h, bh := m.Histogram, base.Histogram
+		h.SampleCount = uint64Ptr(h.GetSampleCount() - bh.GetSampleCount())
+		h.SampleSum = float64Ptr(h.GetSampleSum() - bh.GetSampleSum())
+		if len(h.Bucket) == len(bh.Bucket) {
+			for i, bucket := range h.Bucket {
+				bucket.CumulativeCount = uint64Ptr(bucket.GetCumulativeCount() - bh.Bucket[i].GetCumulativeCount())
+			}
+		}
+	case m.Summary != nil && base.Summary != nil:
+		s, bs := m.Summary, base.Summary
+		s.SampleCount = uint64Ptr(s.GetSampleCount() - bs.GetSampleCount())
+		s.SampleSum = float64Ptr(s.GetSampleSum() - bs.GetSampleSum())
+	}
+}
+
+func float64Ptr(v float64) *float64 { return &v }
+func uint64Ptr(v uint64) *uint64    { return &v }
+
+func (p *Pusher) logError(err error) {
+	if err != nil {
+		logrus.WithError(err).WithField("module", "prom").WithField("url", p.url).
+			Warn("failed to push metrics")
+	}
+}
+
+// pushRunStart records the metrics at the start of a run, if pushing is enabled.
+func pushRunStart() {
+	pusherMu.Lock()
+	p := activePusher
+	pusherMu.Unlock()
+	if p != nil {
+		p.startRun()
+	}
+}
+
+// pushRunEnd pushes the final metrics of a run, if pushing is enabled.
+func pushRunEnd() {
+	pusherMu.Lock()
+	p := activePusher
+	pusherMu.Unlock()
+	if p != nil {
+		p.logError(p.Push())
+	}
+}
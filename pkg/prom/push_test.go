@@ -0,0 +1,136 @@
+package prom
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushMetrics(t *testing.T) {
+	resetStatus(t)
+
+	// a stand-in for the Pushgateway, recording the requests to each group
+	var mu sync.Mutex
+	pushes := make(map[string]int)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || len(body) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		pushes[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+	pushed := func(height uint64) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return pushes[fmt.Sprintf("PUT /metrics/job/snapshot-test/height/%d", height)]
+	}
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_pushed_total", Help: "test"})
+	registry.MustRegister(counter)
+	counter.Inc()
+
+	// nothing is pushed before a run has started
+	pusher := NewPusher(gateway.URL, "snapshot-test", registry)
+	require.NoError(t, pusher.Push())
+	mu.Lock()
+	require.Empty(t, pushes)
+	mu.Unlock()
+	pusher.Start(10 * time.Millisecond)
+
+	// the final metrics of each run are pushed when it ends, grouped by height
+	StartRun(RunInfo{Kind: "snapshot", Height: 1})
+	EndRun(nil)
+	require.NotZero(t, pushed(1))
+	StartRun(RunInfo{Kind: "snapshot", Height: 32})
+	EndRun(nil)
+	require.NotZero(t, pushed(32))
+
+	// and periodically, and once more when stopped
+	periodic := pushed(32)
+	require.Eventually(t, func() bool { return pushed(32) > periodic }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, pusher.Stop())
+	stopped := pushed(32)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, stopped, pushed(32), "no pushes after stopping")
+
+	// runs ending after the pusher is stopped are not pushed
+	StartRun(RunInfo{Kind: "snapshot", Height: 33})
+	EndRun(nil)
+	require.Zero(t, pushed(33))
+
+	// a failed push is reported
+	gateway.Close()
+	require.Error(t, pusher.Push())
+}
+
+func TestPushRunMetrics(t *testing.T) {
+	resetStatus(t)
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_nodes_total", Help: "test"}, []string{"kind"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "test", Buckets: []float64{1, 10}})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_progress", Help: "test"})
+	registry.MustRegister(counter, histogram, gauge)
+
+	pusher := NewPusher("http://localhost", "snapshot-test", registry)
+	// pushes at the end of runs fail, but the runs' metrics are gathered
+	pusher.Start(0)
+	t.Cleanup(func() {
+		pusherMu.Lock()
+		activePusher = nil
+		pusherMu.Unlock()
+	})
+	gathered := func() map[string]*dto.Metric {
+		families, err := pusher.gatherRun()
+		require.NoError(t, err)
+		ret := make(map[string]*dto.Metric)
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				ret[metricKey(family, m)] = m
+			}
+		}
+		return ret
+	}
+
+	// the metrics of an earlier run
+	counter.WithLabelValues("state").Add(5)
+	histogram.Observe(0.5)
+	gauge.Set(100)
+
+	// only the counts and observations since the run started are pushed for it
+	StartRun(RunInfo{Kind: "snapshot", Height: 2})
+	counter.WithLabelValues("state").Add(2)
+	counter.WithLabelValues("storage").Add(3)
+	histogram.Observe(5)
+	gauge.Set(50)
+	values := gathered()
+	require.Equal(t, 2.0, values["test_nodes_total\xffkind=state"].GetCounter().GetValue())
+	require.Equal(t, 3.0, values["test_nodes_total\xffkind=storage"].GetCounter().GetValue())
+	h := values["test_seconds"].GetHistogram()
+	require.Equal(t, uint64(1), h.GetSampleCount())
+	require.Equal(t, 5.0, h.GetSampleSum())
+	require.Equal(t, uint64(0), h.GetBucket()[0].GetCumulativeCount())
+	require.Equal(t, uint64(1), h.GetBucket()[1].GetCumulativeCount())
+	require.Equal(t, 50.0, values["test_progress"].GetGauge().GetValue())
+
+	// each run is pushed from its own start
+	StartRun(RunInfo{Kind: "snapshot", Height: 3})
+	counter.WithLabelValues("state").Inc()
+	values = gathered()
+	require.Equal(t, 1.0, values["test_nodes_total\xffkind=state"].GetCounter().GetValue())
+	require.Equal(t, 0.0, values["test_nodes_total\xffkind=storage"].GetCounter().GetValue())
+	require.Equal(t, uint64(0), values["test_seconds"].GetHistogram().GetSampleCount())
+}
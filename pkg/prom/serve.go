@@ -26,10 +26,17 @@ import (
 
 var errPromHTTP = errors.New("can't start http server for prometheus")
 
-// Serve start listening http
+// serving is set once the http server is started, so the progress of runs is reported for the
+// status endpoint
+var serving bool
+
+// Serve start listening http, serving the metrics at /metrics and the status of the current run
+// at /status
 func Serve(addr string) *http.Server {
+	serving = true
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/status", statusHandler)
 	srv := http.Server{
 		Addr:    addr,
 		Handler: mux,
@@ -0,0 +1,204 @@
+// VulcanizeDB
+// Copyright © 2023 Vulcanize
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package prom
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+// RunInfo describes the block a run is writing the state of.
+type RunInfo struct {
+	Kind      string
+	Height    uint64
+	Hash      common.Hash
+	StateRoot common.Hash
+	Mode      string
+}
+
+// Status is the status of the current, or last, run, served as JSON at /status.
+type Status struct {
+	Kind      string      `json:"kind,omitempty"`
+	Height    uint64      `json:"height"`
+	Hash      common.Hash `json:"hash"`
+	StateRoot common.Hash `json:"stateRoot"`
+	Mode      string      `json:"mode"`
+	// Running is unset before the first run starts, and once the last run is complete
+	Running      bool           `json:"running"`
+	Workers      []WorkerStatus `json:"workers"`
+	StateNodes   uint64         `json:"stateNodes"`
+	StorageNodes uint64         `json:"storageNodes"`
+	// Progress is the estimated progress through the state trie, as a percentage
+	Progress       float64    `json:"progress"`
+	Started        *time.Time `json:"started,omitempty"`
+	ElapsedSeconds float64    `json:"elapsedSeconds"`
+	// EstimatedCompletion is estimated from the rate of progress, while the run is running
+	EstimatedCompletion *time.Time `json:"estimatedCompletion,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+}
+
+// WorkerStatus is the status of an iterator over a section of the trie. Paths are given as hex
+// nibbles, and an empty start or end is the start or end of the trie.
+type WorkerStatus struct {
+	Start    string  `json:"start"`
+	End      string  `json:"end"`
+	LastPath string  `json:"lastPath"`
+	Done     bool    `json:"done"`
+	Progress float64 `json:"progress"`
+}
+
+var (
+	statusMu sync.Mutex
+	run      RunInfo
+	running  bool
+	started  time.Time
+	stopped  time.Time
+	lastErr  error
+	// the tracker of the current segment of the run, and the node counts when the run started
+	runTracker                         *MetricsTracker
+	startStateNodes, startStorageNodes uint64
+)
+
+// StartRun records the start of a run, whose status is then served. A run is started before its
+// block is read, so that a failure to read it is reported for the run; the hash and state root of
+// the block are then set by SetRunBlock. If pushing is enabled, the metrics at the start of the
+// run are recorded, so that those of the run alone are pushed.
+func StartRun(info RunInfo) {
+	statusMu.Lock()
+	run, running, lastErr, runTracker = info, true, nil, nil
+	started, stopped = time.Now(), time.Time{}
+	startStateNodes, startStorageNodes = stateNodes.Load(), storageNodes.Load()
+	statusMu.Unlock()
+	pushRunStart()
+}
+
+// SetRunBlock records the hash and state root of the block of the current run.
+func SetRunBlock(hash, stateRoot common.Hash) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	run.Hash, run.StateRoot = hash, stateRoot
+}
+
+// EndRun records the end of the current run, and the error it failed with, if any. If pushing is
+// enabled, the final metrics of the run are pushed.
+func EndRun(err error) {
+	statusMu.Lock()
+	running, stopped = false, time.Now()
+	if err != nil {
+		lastErr = err
+	}
+	statusMu.Unlock()
+	pushRunEnd()
+}
+
+// currentHeight returns the height of the current, or last, run, if one has started.
+func currentHeight() (uint64, bool) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	return run.Height, !started.IsZero()
+}
+
+func setRunTracker(t *MetricsTracker) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	runTracker = t
+}
+
+// CurrentStatus returns the status of the current, or last, run.
+func CurrentStatus() Status {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	ret := Status{
+		Kind:         run.Kind,
+		Height:       run.Height,
+		Hash:         run.Hash,
+		StateRoot:    run.StateRoot,
+		Mode:         run.Mode,
+		Running:      running,
+		Workers:      []WorkerStatus{},
+		StateNodes:   stateNodes.Load() - startStateNodes,
+		StorageNodes: storageNodes.Load() - startStorageNodes,
+	}
+	if lastErr != nil {
+		ret.LastError = lastErr.Error()
+	}
+	if started.IsZero() {
+		return ret
+	}
+	start := started
+	ret.Started = &start
+	if running {
+		ret.ElapsedSeconds = time.Since(started).Seconds()
+	} else {
+		ret.ElapsedSeconds = stopped.Sub(started).Seconds()
+	}
+	if runTracker == nil {
+		return ret
+	}
+	ret.Workers = runTracker.workerStatus()
+	_, ret.Progress = runTracker.Progress()
+	if eta := runTracker.eta.Load(); running && eta > 0 {
+		completion := time.Now().Add(time.Duration(eta))
+		ret.EstimatedCompletion = &completion
+	}
+	return ret
+}
+
+func (t *MetricsTracker) workerStatus() []WorkerStatus {
+	t.itersMu.RLock()
+	defer t.itersMu.RUnlock()
+	ret := make([]WorkerStatus, len(t.iters))
+	for i, it := range t.iters {
+		fraction, _ := it.progress(t.size)
+		it.RLock()
+		ret[i] = WorkerStatus{
+			Start:    nibbles(it.startPath),
+			End:      nibbles(it.endPath),
+			LastPath: nibbles(it.lastPath),
+			Done:     it.done,
+			Progress: fraction * 100.0,
+		}
+		it.RUnlock()
+	}
+	return ret
+}
+
+// nibbles formats a path as a hex digit per nibble.
+func nibbles(path []byte) string {
+	const digits = "0123456789abcdef"
+	ret := make([]byte, 0, len(path))
+	for _, n := range path {
+		if n > 0xf {
+			// the terminator of a leaf path
+			break
+		}
+		ret = append(ret, digits[n])
+	}
+	return string(ret)
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(CurrentStatus()); err != nil {
+		logrus.WithError(err).WithField("module", "prom").Error("failed to write status")
+	}
+}
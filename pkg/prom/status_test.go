@@ -0,0 +1,98 @@
+package prom
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+// resetStatus clears the status of any previous run, before and after the test.
+func resetStatus(t *testing.T) {
+	reset := func() {
+		statusMu.Lock()
+		defer statusMu.Unlock()
+		run, running, lastErr, runTracker = RunInfo{}, false, nil, nil
+		started, stopped = time.Time{}, time.Time{}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// getStatus requests the status from the handler, and decodes its JSON.
+func getStatus(t *testing.T) map[string]interface{} {
+	rec := httptest.NewRecorder()
+	statusHandler(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var ret map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ret))
+	return ret
+}
+
+func TestStatusHandler(t *testing.T) {
+	resetStatus(t)
+
+	// before the first run, there is nothing to report
+	status := getStatus(t)
+	require.Equal(t, false, status["running"])
+	require.Equal(t, []interface{}{}, status["workers"])
+	require.NotContains(t, status, "started")
+	require.NotContains(t, status, "estimatedCompletion")
+
+	// nodes counted before the run are not included in its counts
+	IncStateNodeCount()
+	StartRun(RunInfo{Kind: "snapshot", Height: 32, Mode: "postgres"})
+	status = getStatus(t)
+	require.Equal(t, 32.0, status["height"])
+	require.Equal(t, common.Hash{}.Hex(), status["hash"])
+	// the block is set once its header is read
+	SetRunBlock(common.Hash{1}, common.Hash{2})
+	tr := &MetricsTracker{iters: []*metricsIterator{
+		// halfway through the first half of the trie
+		{endPath: []byte{0x8}, depth: 1, totalSteps: estimateSteps(nil, []byte{0x8}, 1), lastPath: []byte{0x4, 0x2}},
+		{startPath: []byte{0x8}, depth: 1, totalSteps: estimateSteps([]byte{0x8}, nil, 1), done: true},
+	}}
+	tr.eta.Store(int64(time.Hour))
+	setRunTracker(tr)
+	for i := 0; i < 3; i++ {
+		IncStateNodeCount()
+	}
+	AddStorageNodeCount(5)
+
+	status = getStatus(t)
+	require.Equal(t, "snapshot", status["kind"])
+	require.Equal(t, 32.0, status["height"])
+	require.Equal(t, common.Hash{1}.Hex(), status["hash"])
+	require.Equal(t, common.Hash{2}.Hex(), status["stateRoot"])
+	require.Equal(t, "postgres", status["mode"])
+	require.Equal(t, true, status["running"])
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"start": "", "end": "8", "lastPath": "42", "done": false, "progress": 50.0},
+		map[string]interface{}{"start": "8", "end": "", "lastPath": "", "done": true, "progress": 100.0},
+	}, status["workers"])
+	require.Equal(t, 3.0, status["stateNodes"])
+	require.Equal(t, 5.0, status["storageNodes"])
+	require.Equal(t, 75.0, status["progress"])
+	require.Contains(t, status, "started")
+	require.Contains(t, status, "elapsedSeconds")
+	completion, err := time.Parse(time.RFC3339Nano, status["estimatedCompletion"].(string))
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), completion, time.Minute)
+	require.NotContains(t, status, "lastError")
+
+	// once the run fails, it has no estimated completion, and its elapsed time is fixed
+	EndRun(errors.New("interrupted"))
+	status = getStatus(t)
+	require.Equal(t, false, status["running"])
+	require.Equal(t, "interrupted", status["lastError"])
+	require.NotContains(t, status, "estimatedCompletion")
+	elapsed := status["elapsedSeconds"]
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, elapsed, getStatus(t)["elapsedSeconds"])
+}
@@ -2,66 +2,114 @@ package prom
 
 import (
 	"bytes"
-	"fmt"
+	"math"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	iterutil "github.com/cerc-io/eth-iterator-utils"
 	"github.com/cerc-io/eth-iterator-utils/tracker"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
-var trackedIterCount atomic.Int32
-
 // Tracker which wraps a tracked iterators in metrics-reporting iterators
 type MetricsTracker struct {
 	*tracker.TrackerImpl
+	ranges []PathRange
+	size   *TrieSize
+	skip   LeafFilter
+	// mode labels the trie read latency of the iterators
+	mode string
+
+	itersMu sync.RWMutex
+	iters   []*metricsIterator
+	// quit stops the progress reporter, which closes done on exiting
+	quit, done chan struct{}
+	stopOnce   sync.Once
+	// eta is the time remaining last estimated by the reporter
+	eta atomic.Int64
+}
+
+// PathRange is a range of trie paths, as nibbles, from Start (inclusive) to End (exclusive). A
+// nil Start or End is the start or end of the trie.
+type PathRange struct {
+	Start, End []byte
 }
 
+// LeafFilter returns whether the iterators skip the leaf with the key and value, so that neither
+// it nor any trie it references is seen by their consumer.
+type LeafFilter func(key, value []byte) bool
+
 type metricsIterator struct {
 	trie.NodeIterator
-	id int32
-	// count    uint
-	done     bool
-	lastPath []byte
+	mode       string
+	skip       LeafFilter
+	startPath  []byte
+	endPath    []byte
+	depth      int
+	totalSteps uint64
+	done       bool
+	lastPath   []byte
 	sync.RWMutex
 }
 
+// NewTracker creates a tracker, which reports the progress of its iterators while it is open if
+// metrics, progress logging or the status endpoint are enabled. Its iterators are reported in the
+// status of the current run.
 func NewTracker(file string, bufsize uint) *MetricsTracker {
-	return &MetricsTracker{TrackerImpl: tracker.NewImpl(file, bufsize)}
+	t := &MetricsTracker{
+		TrackerImpl: tracker.NewImpl(file, bufsize),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	setRunTracker(t)
+	if ProgressEnabled() {
+		go t.report()
+	} else {
+		close(t.done)
+	}
+	return t
 }
 
 func (t *MetricsTracker) wrap(tracked *tracker.Iterator) *metricsIterator {
 	startPath, endPath := tracked.Bounds()
 	pathDepth := max(max(len(startPath), len(endPath)), 1)
-	totalSteps := estimateSteps(startPath, endPath, pathDepth)
 
+	t.itersMu.Lock()
+	defer t.itersMu.Unlock()
 	ret := &metricsIterator{
 		NodeIterator: tracked,
-		id:           trackedIterCount.Add(1),
+		mode:         t.mode,
+		skip:         t.skip,
+		startPath:    startPath,
+		endPath:      endPath,
+		depth:        pathDepth,
+		totalSteps:   estimateSteps(startPath, endPath, pathDepth),
 	}
+	t.iters = append(t.iters, ret)
+	return ret
+}
 
-	RegisterGaugeFunc(
-		fmt.Sprintf("tracked_iterator_%d", ret.id),
-		func() float64 {
-			ret.RLock()
-			done := ret.done
-			lastPath := ret.lastPath
-			ret.RUnlock()
+// SetMode sets the output mode by which the trie read latency of the iterators is labeled.
+func (t *MetricsTracker) SetMode(mode string) {
+	t.mode = mode
+}
 
-			if done {
-				return 100.0
-			}
+// SetSize sets the estimated size of the trie, by which the progress of the iterators is
+// measured. Without it, the leaves of the trie are taken to be evenly distributed.
+func (t *MetricsTracker) SetSize(size *TrieSize) {
+	t.size = size
+}
 
-			if lastPath == nil {
-				return 0.0
-			}
+// SetLeafFilter sets the filter of the leaves of the iterators.
+func (t *MetricsTracker) SetLeafFilter(skip LeafFilter) {
+	t.skip = skip
+}
 
-			// estimate remaining distance based on current position and node count
-			remainingSteps := estimateSteps(lastPath, endPath, pathDepth)
-			return (float64(totalSteps) - float64(remainingSteps)) / float64(totalSteps) * 100.0
-		})
-	return ret
+// SetRanges sets the ranges of paths to iterate, one per iterator, if there is no state to
+// restore. Otherwise, the caller divides the trie between its iterators.
+func (t *MetricsTracker) SetRanges(ranges []PathRange) {
+	t.ranges = ranges
 }
 
 func (t *MetricsTracker) Restore(ctor iterutil.IteratorConstructor) (
@@ -71,6 +119,15 @@ func (t *MetricsTracker) Restore(ctor iterutil.IteratorConstructor) (
 	if err != nil {
 		return nil, nil, err
 	}
+	if len(iters) == 0 && t.ranges != nil {
+		ret := make([]trie.NodeIterator, len(t.ranges))
+		bases := make([]trie.NodeIterator, len(t.ranges))
+		for i, r := range t.ranges {
+			bases[i] = iterutil.NewPrefixBoundIterator(ctor(pathToKey(r.Start)), r.End)
+			ret[i] = t.Tracked(bases[i])
+		}
+		return ret, bases, nil
+	}
 	ret := make([]trie.NodeIterator, len(iters))
 	for i, tracked := range iters {
 		ret[i] = t.wrap(tracked)
@@ -83,8 +140,42 @@ func (t *MetricsTracker) Tracked(it trie.NodeIterator) trie.NodeIterator {
 	return t.wrap(tracked)
 }
 
+// CloseAndSave stops reporting progress, and saves the state of any incomplete iterators to the
+// recovery file.
+func (t *MetricsTracker) CloseAndSave() error {
+	t.stopOnce.Do(func() { close(t.quit) })
+	<-t.done
+	return t.TrackerImpl.CloseAndSave()
+}
+
+// Progress returns the estimated progress of each iterator through its section of the trie, and
+// of the iterators overall, as percentages.
+func (t *MetricsTracker) Progress() (workers []float64, overall float64) {
+	t.itersMu.RLock()
+	defer t.itersMu.RUnlock()
+	if len(t.iters) == 0 {
+		return nil, 0
+	}
+	workers = make([]float64, len(t.iters))
+	var done, total float64
+	for i, it := range t.iters {
+		fraction, weight := it.progress(t.size)
+		workers[i] = fraction * 100.0
+		done += fraction * weight
+		total += weight
+	}
+	if total == 0 {
+		return workers, 100.0
+	}
+	return workers, done / total * 100.0
+}
+
 func (it *metricsIterator) Next(descend bool) bool {
-	ret := it.NodeIterator.Next(descend)
+	ret := it.step(descend)
+	// A leaf is a value node, so skipping it skips no other node of the trie
+	for ret && it.skip != nil && it.Leaf() && it.skip(it.LeafKey(), it.LeafBlob()) {
+		ret = it.step(descend)
+	}
 	it.Lock()
 	defer it.Unlock()
 	if ret {
@@ -95,6 +186,51 @@ func (it *metricsIterator) Next(descend bool) bool {
 	return ret
 }
 
+// step steps the iterator, timing the trie read if metrics are enabled.
+func (it *metricsIterator) step(descend bool) bool {
+	if !metrics {
+		return it.NodeIterator.Next(descend)
+	}
+	start := time.Now()
+	ret := it.NodeIterator.Next(descend)
+	ObserveTrieRead(it.mode, time.Since(start))
+	return ret
+}
+
+// progress estimates the fraction of its section of the trie the iterator has traversed, from its
+// current position, and the weight of the section in the progress of the whole trie. With an
+// estimate of the size of the trie, the weight is the number of leaves in the section; without
+// one, the sections are weighted equally.
+func (it *metricsIterator) progress(size *TrieSize) (fraction, weight float64) {
+	it.RLock()
+	done := it.done
+	lastPath := it.lastPath
+	it.RUnlock()
+
+	weight = 1.0
+	if size != nil {
+		weight = size.Leaves(it.startPath, it.endPath)
+	}
+	switch {
+	case done:
+		return 1.0, weight
+	case lastPath == nil:
+		return 0.0, weight
+	case size != nil:
+		if weight == 0 {
+			return 1.0, weight
+		}
+		return math.Min(size.Leaves(it.startPath, lastPath)/weight, 1.0), weight
+	case it.totalSteps == 0:
+		return 1.0, weight
+	}
+	remainingSteps := estimateSteps(lastPath, it.endPath, it.depth)
+	if remainingSteps > it.totalSteps {
+		remainingSteps = it.totalSteps
+	}
+	return float64(it.totalSteps-remainingSteps) / float64(it.totalSteps), weight
+}
+
 // Estimate the number of iterations necessary to step from start to end.
 func estimateSteps(start []byte, end []byte, depth int) uint64 {
 	// We see paths in several forms (nil, 0600, 06, etc.). We need to adjust them to a comparable form.
@@ -125,14 +261,11 @@ func estimateSteps(start []byte, end []byte, depth int) uint64 {
 
 	// We have no need to handle negative exponents, so uints are fine.
 	pow := func(x uint64, y uint) uint64 {
-		if 0 == y {
-			return 1
-		}
-		ret := x
+		ret := uint64(1)
 		for i := uint(0); i < y; i++ {
 			ret *= x
 		}
-		return x
+		return ret
 	}
 
 	// Fix the paths.
@@ -166,6 +299,15 @@ func estimateSteps(start []byte, end []byte, depth int) uint64 {
 	return ret
 }
 
+// pathToKey converts an even-length path of nibbles to the key bytes it prefixes.
+func pathToKey(path []byte) []byte {
+	key := make([]byte, len(path)/2)
+	for i := range key {
+		key[i] = path[2*i]<<4 | path[2*i+1]
+	}
+	return key
+}
+
 func max(a int, b int) int {
 	if a > b {
 		return a
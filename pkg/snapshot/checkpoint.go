@@ -0,0 +1,163 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/prom"
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkpointSuffix is appended to the name of a recovery file to name the copy kept of it until
+// the batch is committed. An empty copy records that the file did not exist.
+const checkpointSuffix = ".checkpoint"
+
+var (
+	// errCheckpoint is returned by the sinks to stop the traversal at a checkpoint
+	errCheckpoint = errors.New("checkpoint reached")
+	// errInterrupted is returned by the sinks to stop the traversal on a signal
+	errInterrupted = errors.New("interrupted")
+)
+
+// checkpointer keeps the output of a traversal consistent with its recovery files.
+//
+// The tracker saves the position of each iterator to the recovery file when the traversal stops,
+// so all nodes before those positions must be committed; likewise for the accounts recorded in the
+// watched storage progress file. The traversal is run in segments of up to interval state nodes,
+// and at the end of each the batch is committed and a new one begun. If a commit fails, the
+// recovery files of the previous checkpoint are restored, so they never record progress which was
+// not committed. Nodes written again on resuming from a checkpoint are skipped by the indexer.
+type checkpointer struct {
+	recoveryFile string
+	meta         *RecoveryMeta
+	workers      uint
+	// interval is the number of state nodes per segment, or zero for a single segment
+	interval uint64
+	// begin begins the batch of the next segment
+	begin func() indexer.Batch
+
+	tx          indexer.Batch
+	count       atomic.Uint64
+	interrupted atomic.Bool
+	// saved records whether the recovery files have been copied
+	saved bool
+}
+
+// interrupt stops the traversal at the next node, as at a checkpoint.
+func (c *checkpointer) interrupt() {
+	c.interrupted.Store(true)
+}
+
+// check returns an error if the traversal should stop before writing another node.
+func (c *checkpointer) check() error {
+	if c.interrupted.Load() {
+		return errInterrupted
+	}
+	if c.interval != 0 && c.count.Load() >= c.interval {
+		return errCheckpoint
+	}
+	return nil
+}
+
+// run runs the traversal in segments, committing the batch at each checkpoint. The batch of the
+// final segment is left for the caller to complete with commit, whether or not the traversal
+// failed: the recovery file records the nodes written as done, so they must be committed.
+func (c *checkpointer) run(traverse func(indexer.Batch, *prom.MetricsTracker) error) error {
+	for segment := 1; ; segment++ {
+		if err := c.save(); err != nil {
+			return err
+		}
+		c.count.Store(0)
+		tr := prom.NewTracker(c.recoveryFile, c.workers)
+		tr.SetMode(string(c.meta.Mode))
+		err := traverse(c.tx, tr)
+		closeTracker(tr, c.recoveryFile, c.meta)
+		if !errors.Is(err, errCheckpoint) {
+			return err
+		}
+		if err = c.commit(nil); err != nil {
+			return err
+		}
+		log.WithField("segment", segment).WithField("nodes", c.count.Load()).Info("Committed checkpoint")
+		c.tx = c.begin()
+	}
+}
+
+// commit submits the batch, and returns err, or the error of the submission. If the submission
+// fails, the batch is rolled back and the recovery file of the previous checkpoint is restored.
+func (c *checkpointer) commit(err error) error {
+	start := time.Now()
+	serr := c.tx.Submit()
+	prom.ObserveSubmit(string(c.meta.Mode), time.Since(start))
+	if serr == nil {
+		c.discard()
+		return err
+	}
+	c.tx.RollbackOnFailure(serr)
+	if rerr := c.restore(); rerr != nil {
+		log.Errorf("failed to restore recovery file: %v", rerr)
+	}
+	if err != nil {
+		log.Errorf("batch transaction submission failed: %v", serr)
+		return err
+	}
+	return fmt.Errorf("batch transaction submission failed: %w", serr)
+}
+
+// save copies the recovery files, so they can be restored if the batch is not committed.
+func (c *checkpointer) save() error {
+	for _, file := range recoveryFiles(c.recoveryFile) {
+		data, err := os.ReadFile(file)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err = os.WriteFile(file+checkpointSuffix, data, 0644); err != nil {
+			return err
+		}
+	}
+	c.saved = true
+	return nil
+}
+
+// restore restores the recovery files saved at the previous checkpoint.
+func (c *checkpointer) restore() error {
+	if !c.saved {
+		return nil
+	}
+	c.saved = false
+	_, err := restoreCheckpoint(c.recoveryFile)
+	return err
+}
+
+// discard removes the copies of the recovery files, once the batch is committed.
+func (c *checkpointer) discard() {
+	if !c.saved {
+		return
+	}
+	c.saved = false
+	for _, file := range recoveryFiles(c.recoveryFile) {
+		if err := removeFile(file + checkpointSuffix); err != nil {
+			log.Errorf("failed to remove recovery checkpoint: %v", err)
+		}
+	}
+}
@@ -17,9 +17,14 @@ package snapshot
 
 import (
 	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
 
 	"github.com/sirupsen/logrus"
 
@@ -33,12 +38,19 @@ import (
 type SnapshotMode string
 
 const (
-	PgSnapshot   SnapshotMode = "postgres"
-	FileSnapshot SnapshotMode = "file"
+	PgSnapshot     SnapshotMode = "postgres"
+	PgCopySnapshot SnapshotMode = "postgres-copy"
+	FileSnapshot   SnapshotMode = "file"
 
 	defaultOutputDir = "./snapshot_output"
 )
 
+// Supported source database engines
+const (
+	EngineLevelDB = "leveldb"
+	EnginePebble  = "pebble"
+)
+
 // Config contains params for both databases the service uses
 type Config struct {
 	Eth     *EthConfig
@@ -51,18 +63,100 @@ type Config struct {
 type EthConfig struct {
 	LevelDBPath   string
 	AncientDBPath string
-	NodeInfo      ethNode.Info
+	// Engine is the source database engine; if empty, it is detected from the database files.
+	Engine   string
+	NodeInfo ethNode.Info
+}
+
+// InitNodeInfo fills in the genesis block, chain ID and network ID of the node info from the chain
+// database, where they are not set. It returns an error if a set value contradicts the database.
+// The network ID is not stored in the database, so if unset it is assumed to equal the chain ID;
+// if set, it must be a number, as written by the statediff service.
+func (c *EthConfig) InitNodeInfo(edb ethdb.Database) error {
+	info := &c.NodeInfo
+	genesis := rawdb.ReadCanonicalHash(edb, 0)
+	if genesis == (common.Hash{}) {
+		return fmt.Errorf("no genesis block found in the chain database")
+	}
+	if info.GenesisBlock == "" {
+		info.GenesisBlock = genesis.Hex()
+	} else if common.HexToHash(info.GenesisBlock) != genesis {
+		return fmt.Errorf("configured genesis block %s does not match the chain database (%s)",
+			info.GenesisBlock, genesis)
+	}
+
+	chainConfig := rawdb.ReadChainConfig(edb, genesis)
+	switch {
+	case chainConfig == nil || chainConfig.ChainID == nil:
+		if info.ChainID == 0 {
+			return fmt.Errorf("no chain ID configured, and no chain config found in the chain database")
+		}
+		logrus.Warnf("no chain config found in the chain database, unable to check chain ID %d", info.ChainID)
+	case info.ChainID == 0:
+		info.ChainID = chainConfig.ChainID.Uint64()
+	case info.ChainID != chainConfig.ChainID.Uint64():
+		return fmt.Errorf("configured chain ID %d does not match the chain database (%s)",
+			info.ChainID, chainConfig.ChainID)
+	}
+
+	chainID := strconv.FormatUint(info.ChainID, 10)
+	if info.NetworkID == "" {
+		info.NetworkID = chainID
+		logrus.Infof("no network ID configured, assuming it equals the chain ID")
+	} else if _, err := strconv.ParseUint(info.NetworkID, 10, 64); err != nil {
+		return fmt.Errorf("configured network ID %q is not a number", info.NetworkID)
+	} else if info.NetworkID != chainID {
+		logrus.Warnf("configured network ID %s differs from the chain ID %s", info.NetworkID, chainID)
+	}
+	logrus.WithField("genesis", info.GenesisBlock).WithField("chainID", info.ChainID).
+		WithField("networkID", info.NetworkID).Info("node info initialized")
+	return nil
 }
 
-// DBConfig contains options for DB output mode.
+// DBConfig contains options for DB output modes.
 type DBConfig = postgres.Config
 
-// FileConfig contains options for file output mode.  Note that this service currently only supports
-// CSV output, and does not record watched addresses, so not all fields are used.
-type FileConfig = file.Config
+// FileFormat specifies the format of the files written in file output mode
+type FileFormat string
+
+const (
+	CSVFormat     FileFormat = "csv"
+	ParquetFormat FileFormat = "parquet"
+)
+
+// FileConfig contains options for file output mode. CSV output is written by the statediff file
+// indexer; this service does not record watched addresses, so not all of its fields are used.
+type FileConfig struct {
+	file.Config
+	Format FileFormat
+	// Finalize indicates whether to combine and deduplicate CSV output once the snapshot is complete
+	Finalize bool
+	// QuarantineDir is where rows failing validation are moved to; if empty, they are only reported
+	QuarantineDir string
+}
 
 type ServiceConfig struct {
 	AllowedAccounts []common.Address
+	// WatchedStorage maps accounts to the only storage slots to include for them
+	WatchedStorage map[common.Address][]common.Hash
+	// Filter excludes accounts from the output; nil if no filters are configured
+	Filter *AccountFilter
+	// FullBlock indicates whether to index the complete block at the snapshot height
+	FullBlock bool
+	// AllowMissingBlockData indicates whether to index a header with zero total difficulty or
+	// reward if they cannot be determined, rather than failing
+	AllowMissingBlockData bool
+	// ManifestPath is where to write the manifest of the run; if empty, it is written to the
+	// output directory in file mode, or the working directory otherwise
+	ManifestPath string
+	// DiscardRecovery indicates whether to discard a recovery file written by a different run,
+	// rather than refusing to start
+	DiscardRecovery bool
+	// CommitInterval is the number of state nodes after which the output is committed in postgres
+	// modes, or zero to commit once complete
+	CommitInterval uint64
+	// Partition, if set, is the slice of the state trie key space to snapshot
+	Partition *Partition
 }
 
 func NewConfig(mode SnapshotMode) (*Config, error) {
@@ -106,14 +200,24 @@ func (c *Config) Init(mode SnapshotMode) error {
 
 	viper.BindEnv(LEVELDB_ANCIENT_TOML, LEVELDB_ANCIENT)
 	viper.BindEnv(LEVELDB_PATH_TOML, LEVELDB_PATH)
+	viper.BindEnv(LEVELDB_ENGINE_TOML, LEVELDB_ENGINE)
 
 	c.Eth.AncientDBPath = viper.GetString(LEVELDB_ANCIENT_TOML)
 	c.Eth.LevelDBPath = viper.GetString(LEVELDB_PATH_TOML)
+	switch engine := viper.GetString(LEVELDB_ENGINE_TOML); engine {
+	case "", "auto":
+	case EngineLevelDB, EnginePebble:
+		c.Eth.Engine = engine
+	default:
+		return fmt.Errorf("unsupported database engine: %s", engine)
+	}
 
 	switch mode {
 	case FileSnapshot:
-		InitFile(c.File)
-	case PgSnapshot:
+		if err := InitFile(c.File); err != nil {
+			return err
+		}
+	case PgSnapshot, PgCopySnapshot:
 		InitDB(c.DB)
 	default:
 		return fmt.Errorf("no output mode specified")
@@ -152,8 +256,23 @@ func InitFile(c *FileConfig) error {
 		logrus.Infof("no output directory set, using default: %s", defaultOutputDir)
 		c.OutputDir = defaultOutputDir
 	}
-	// Only support CSV for now
+	// The statediff file indexer is only used for CSV
 	c.Mode = file.CSV
+
+	viper.BindEnv(FILE_FORMAT_TOML, FILE_FORMAT)
+	switch format := FileFormat(viper.GetString(FILE_FORMAT_TOML)); format {
+	case "":
+		c.Format = CSVFormat
+	case CSVFormat, ParquetFormat:
+		c.Format = format
+	default:
+		return fmt.Errorf("unsupported file format: %s", format)
+	}
+
+	viper.BindEnv(FILE_FINALIZE_TOML, FILE_FINALIZE)
+	c.Finalize = viper.GetBool(FILE_FINALIZE_TOML)
+	viper.BindEnv(FILE_QUARANTINE_DIR_TOML, FILE_QUARANTINE_DIR)
+	c.QuarantineDir = viper.GetString(FILE_QUARANTINE_DIR_TOML)
 	return nil
 }
 
@@ -162,6 +281,13 @@ func (c *ServiceConfig) Init() error {
 	viper.BindEnv(SNAPSHOT_MODE_TOML, SNAPSHOT_MODE)
 	viper.BindEnv(SNAPSHOT_WORKERS_TOML, SNAPSHOT_WORKERS)
 	viper.BindEnv(SNAPSHOT_RECOVERY_FILE_TOML, SNAPSHOT_RECOVERY_FILE)
+	viper.BindEnv(SNAPSHOT_START_HEIGHT_TOML, SNAPSHOT_START_HEIGHT)
+	viper.BindEnv(SNAPSHOT_STOP_HEIGHT_TOML, SNAPSHOT_STOP_HEIGHT)
+	viper.BindEnv(SNAPSHOT_HEIGHT_STEP_TOML, SNAPSHOT_HEIGHT_STEP)
+	viper.BindEnv(SNAPSHOT_HEIGHTS_TOML, SNAPSHOT_HEIGHTS)
+	viper.BindEnv(SNAPSHOT_DEDUP_IPLDS_TOML, SNAPSHOT_DEDUP_IPLDS)
+	viper.BindEnv(SNAPSHOT_FROM_HEIGHT_TOML, SNAPSHOT_FROM_HEIGHT)
+	viper.BindEnv(SNAPSHOT_TO_HEIGHT_TOML, SNAPSHOT_TO_HEIGHT)
 
 	viper.BindEnv(PROM_DB_STATS_TOML, PROM_DB_STATS)
 	viper.BindEnv(PROM_HTTP_TOML, PROM_HTTP)
@@ -181,5 +307,157 @@ func (c *ServiceConfig) Init() error {
 	} else {
 		logrus.Infof("no snapshot addresses specified, will perform snapshot of entire trie(s)")
 	}
+
+	viper.BindEnv(SNAPSHOT_STORAGE_TOML, SNAPSHOT_STORAGE)
+	watchedStorage, err := parseWatchedStorage(viper.Get(SNAPSHOT_STORAGE_TOML))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", SNAPSHOT_STORAGE_TOML, err)
+	}
+	if len(watchedStorage) != 0 {
+		c.WatchedStorage = watchedStorage
+	}
+
+	viper.BindEnv(SNAPSHOT_FULL_BLOCK_TOML, SNAPSHOT_FULL_BLOCK)
+	c.FullBlock = viper.GetBool(SNAPSHOT_FULL_BLOCK_TOML)
+	viper.BindEnv(SNAPSHOT_ALLOW_MISSING_TOML, SNAPSHOT_ALLOW_MISSING)
+	c.AllowMissingBlockData = viper.GetBool(SNAPSHOT_ALLOW_MISSING_TOML)
+	viper.BindEnv(SNAPSHOT_MANIFEST_TOML, SNAPSHOT_MANIFEST)
+	c.ManifestPath = viper.GetString(SNAPSHOT_MANIFEST_TOML)
+	viper.BindEnv(SNAPSHOT_DISCARD_RECOVERY_TOML, SNAPSHOT_DISCARD_RECOVERY)
+	c.DiscardRecovery = viper.GetBool(SNAPSHOT_DISCARD_RECOVERY_TOML)
+	viper.BindEnv(SNAPSHOT_COMMIT_INTERVAL_TOML, SNAPSHOT_COMMIT_INTERVAL)
+	c.CommitInterval = viper.GetUint64(SNAPSHOT_COMMIT_INTERVAL_TOML)
+	viper.BindEnv(SNAPSHOT_PARTITION_TOML, SNAPSHOT_PARTITION)
+	if partition := viper.GetString(SNAPSHOT_PARTITION_TOML); partition != "" {
+		if c.Partition, err = ParsePartition(partition); err != nil {
+			return fmt.Errorf("invalid %s: %w", SNAPSHOT_PARTITION_TOML, err)
+		}
+	}
+
+	filter, err := initAccountFilter()
+	if err != nil {
+		return err
+	}
+	c.Filter = filter
 	return nil
 }
+
+// initAccountFilter reads the account filters, returning nil if none are set.
+func initAccountFilter() (*AccountFilter, error) {
+	viper.BindEnv(SNAPSHOT_DENY_ACCOUNTS_TOML, SNAPSHOT_DENY_ACCOUNTS)
+	viper.BindEnv(SNAPSHOT_EOA_ONLY_TOML, SNAPSHOT_EOA_ONLY)
+	viper.BindEnv(SNAPSHOT_CONTRACTS_ONLY_TOML, SNAPSHOT_CONTRACTS_ONLY)
+	viper.BindEnv(SNAPSHOT_MIN_BALANCE_TOML, SNAPSHOT_MIN_BALANCE)
+	viper.BindEnv(SNAPSHOT_CODE_HASHES_TOML, SNAPSHOT_CODE_HASHES)
+	viper.BindEnv(SNAPSHOT_MAX_STORAGE_SLOTS_TOML, SNAPSHOT_MAX_STORAGE_SLOTS)
+
+	filter := &AccountFilter{
+		EOAOnly:         viper.GetBool(SNAPSHOT_EOA_ONLY_TOML),
+		ContractsOnly:   viper.GetBool(SNAPSHOT_CONTRACTS_ONLY_TOML),
+		MaxStorageSlots: viper.GetUint64(SNAPSHOT_MAX_STORAGE_SLOTS_TOML),
+	}
+	for _, addr := range viper.GetStringSlice(SNAPSHOT_DENY_ACCOUNTS_TOML) {
+		if !common.IsHexAddress(addr) {
+			return nil, fmt.Errorf("invalid %s: invalid address %q", SNAPSHOT_DENY_ACCOUNTS_TOML, addr)
+		}
+		filter.DeniedAccounts = append(filter.DeniedAccounts, common.HexToAddress(addr))
+	}
+	for _, hash := range viper.GetStringSlice(SNAPSHOT_CODE_HASHES_TOML) {
+		if !isHexHash(hash) {
+			return nil, fmt.Errorf("invalid %s: invalid code hash %q", SNAPSHOT_CODE_HASHES_TOML, hash)
+		}
+		filter.CodeHashes = append(filter.CodeHashes, common.HexToHash(hash))
+	}
+	if minBalance := viper.GetString(SNAPSHOT_MIN_BALANCE_TOML); minBalance != "" {
+		value, ok := new(big.Int).SetString(minBalance, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: %q", SNAPSHOT_MIN_BALANCE_TOML, minBalance)
+		}
+		filter.MinBalance = value
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	if len(filter.DeniedAccounts) == 0 && len(filter.CodeHashes) == 0 && filter.MinBalance == nil &&
+		!filter.EOAOnly && !filter.ContractsOnly && filter.MaxStorageSlots == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// parseWatchedStorage reads watched storage slots, given either as a TOML table mapping addresses
+// to lists of slot keys, or as a list of "address:slot,slot..." entries (from the CLI), or as a
+// string of such entries separated by whitespace (from the environment).
+func parseWatchedStorage(value interface{}) (map[common.Address][]common.Hash, error) {
+	watched := make(map[common.Address][]common.Hash)
+	add := func(addr string, slots []string) error {
+		if !common.IsHexAddress(addr) {
+			return fmt.Errorf("invalid address %q", addr)
+		}
+		address := common.HexToAddress(addr)
+		for _, slot := range slots {
+			slot = strings.TrimSpace(slot)
+			if !isHexHash(slot) {
+				return fmt.Errorf("invalid storage slot key %q for %s", slot, addr)
+			}
+			watched[address] = append(watched[address], common.HexToHash(slot))
+		}
+		return nil
+	}
+	addEntries := func(entries []string) error {
+		for _, entry := range entries {
+			addr, slots, ok := strings.Cut(entry, ":")
+			if !ok {
+				return fmt.Errorf("expected <address>:<slot>[,<slot>...], got %q", entry)
+			}
+			if err := add(strings.TrimSpace(addr), strings.Split(slots, ",")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch value := value.(type) {
+	case nil:
+	case map[string]interface{}:
+		for addr, slots := range value {
+			list, ok := slots.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected a list of storage slot keys for %s", addr)
+			}
+			var keys []string
+			for _, slot := range list {
+				keys = append(keys, fmt.Sprint(slot))
+			}
+			if err := add(addr, keys); err != nil {
+				return nil, err
+			}
+		}
+	case []string:
+		if err := addEntries(value); err != nil {
+			return nil, err
+		}
+	case string:
+		if err := addEntries(strings.Fields(value)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unexpected type %T", value)
+	}
+	return watched, nil
+}
+
+// isHexHash returns whether s is a hex string of at most 32 bytes, with or without a 0x prefix.
+func isHexHash(s string) bool {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if len(s) == 0 || len(s) > 2*common.HashLength {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,17 +1,23 @@
 package snapshot_test
 
 import (
+	"strconv"
+	"testing"
+
 	"github.com/cerc-io/plugeth-statediff/indexer/database/sql/postgres"
 	ethnode "github.com/cerc-io/plugeth-statediff/indexer/node"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
 )
 
 var (
 	DefaultNodeInfo = ethnode.Info{
-		ID:           "test_nodeid",
-		ClientName:   "test_client",
-		GenesisBlock: "TEST_GENESIS",
-		NetworkID:    "test_network",
-		ChainID:      0,
+		ID:         "test_nodeid",
+		ClientName: "test_client",
+		// the genesis block, network ID and chain ID are read from the chain database
 	}
 	DefaultPgConfig = postgres.Config{
 		Hostname:     "localhost",
@@ -25,3 +31,104 @@ var (
 		MaxConns:        4,
 	}
 )
+
+func TestInitNodeInfo(t *testing.T) {
+	config := testConfig(fixture.ChainB.ChainData, fixture.ChainB.Ancient)
+	edb, err := NewLevelDB(config.Eth)
+	require.NoError(t, err)
+	defer edb.Close()
+
+	genesis := rawdb.ReadCanonicalHash(edb, 0)
+	chainConfig, err := ReadChainConfig(edb)
+	require.NoError(t, err)
+	chainID := chainConfig.ChainID.Uint64()
+
+	t.Run("fills missing fields", func(t *testing.T) {
+		eth := &EthConfig{NodeInfo: ethnode.Info{ID: "test_nodeid"}}
+		require.NoError(t, eth.InitNodeInfo(edb))
+		require.Equal(t, ethnode.Info{
+			ID:           "test_nodeid",
+			GenesisBlock: genesis.Hex(),
+			ChainID:      chainID,
+			NetworkID:    strconv.FormatUint(chainID, 10),
+		}, eth.NodeInfo)
+	})
+
+	t.Run("accepts matching fields", func(t *testing.T) {
+		info := ethnode.Info{GenesisBlock: genesis.Hex(), ChainID: chainID, NetworkID: "4242"}
+		eth := &EthConfig{NodeInfo: info}
+		require.NoError(t, eth.InitNodeInfo(edb))
+		require.Equal(t, info, eth.NodeInfo)
+	})
+
+	t.Run("rejects wrong genesis block", func(t *testing.T) {
+		eth := &EthConfig{NodeInfo: ethnode.Info{GenesisBlock: "0x01"}}
+		require.Error(t, eth.InitNodeInfo(edb))
+	})
+
+	t.Run("rejects wrong chain ID", func(t *testing.T) {
+		eth := &EthConfig{NodeInfo: ethnode.Info{ChainID: chainID + 1}}
+		require.Error(t, eth.InitNodeInfo(edb))
+	})
+
+	t.Run("rejects invalid network ID", func(t *testing.T) {
+		eth := &EthConfig{NodeInfo: ethnode.Info{NetworkID: "test_network"}}
+		require.ErrorContains(t, eth.InitNodeInfo(edb), "network ID")
+	})
+
+	t.Run("on opening the database", func(t *testing.T) {
+		config := testConfig(fixture.ChainB.ChainData, fixture.ChainB.Ancient)
+		edb, err := NewLevelDB(config.Eth)
+		require.NoError(t, err)
+		require.NoError(t, edb.Close())
+		require.Equal(t, genesis.Hex(), config.Eth.NodeInfo.GenesisBlock)
+		require.Equal(t, chainID, config.Eth.NodeInfo.ChainID)
+
+		config.Eth.NodeInfo.ChainID = chainID + 1
+		_, err = NewLevelDB(config.Eth)
+		require.ErrorContains(t, err, "chain ID")
+	})
+}
+
+func TestParsePartition(t *testing.T) {
+	p, err := ParsePartition("2/5")
+	require.NoError(t, err)
+	require.Equal(t, &Partition{Index: 2, Count: 5}, p)
+	require.Equal(t, "2/5", p.String())
+
+	for _, invalid := range []string{"", "2", "5/5", "1/0", "-1/2", "a/2", "0/65537"} {
+		_, err := ParsePartition(invalid)
+		require.Error(t, err, invalid)
+	}
+
+	// every key and path is in exactly one partition
+	keys := [][]byte{{0, 0, 0, 0}, {0x55, 0x55, 0x55, 0x55}, {0x80}, {0xff, 0xff, 0xff, 0xff}}
+	for _, key := range keys {
+		var in int
+		for i := uint64(0); i < 7; i++ {
+			if (&Partition{Index: i, Count: 7}).ContainsLeaf(key) {
+				in++
+			}
+		}
+		require.Equal(t, 1, in, "key %x", key)
+	}
+	paths := [][]byte{{}, {0x2}, {0x4, 0x9, 0x2, 0x4, 0x9, 0x2, 0x4, 0x9}, {0xf, 0xf, 0xf, 0xf, 0xf, 0xf, 0xf, 0xf, 0xf}}
+	for _, path := range paths {
+		var in int
+		for i := uint64(0); i < 7; i++ {
+			if (&Partition{Index: i, Count: 7}).ContainsPath(path) {
+				in++
+			}
+		}
+		require.Equal(t, 1, in, "path %x", path)
+	}
+
+	// a node is in the partition of the range which iterates it, which for a node near the root is
+	// not that of the keys below it
+	p = &Partition{Index: 1, Count: 2}
+	require.True(t, p.ContainsLeaf([]byte{0x80}))
+	require.True(t, p.ContainsPath([]byte{0x8}))
+	require.False(t, p.ContainsPath([]byte{0x7, 0xf}))
+	require.False(t, (&Partition{Index: 1, Count: 3}).ContainsPath([]byte{0x5}))
+	require.True(t, (&Partition{Index: 0, Count: 3}).ContainsPath([]byte{0x5}))
+}
@@ -17,25 +17,53 @@ package snapshot
 
 // ENV variables
 const (
-	SNAPSHOT_BLOCK_HEIGHT  = "SNAPSHOT_BLOCK_HEIGHT"
-	SNAPSHOT_WORKERS       = "SNAPSHOT_WORKERS"
-	SNAPSHOT_RECOVERY_FILE = "SNAPSHOT_RECOVERY_FILE"
-	SNAPSHOT_MODE          = "SNAPSHOT_MODE"
-	SNAPSHOT_ACCOUNTS      = "SNAPSHOT_ACCOUNTS"
-
-	LOG_LEVEL = "LOG_LEVEL"
-	LOG_FILE  = "LOG_FILE"
-
-	PROM_METRICS   = "PROM_METRICS"
-	PROM_HTTP      = "PROM_HTTP"
-	PROM_HTTP_ADDR = "PROM_HTTP_ADDR"
-	PROM_HTTP_PORT = "PROM_HTTP_PORT"
-	PROM_DB_STATS  = "PROM_DB_STATS"
-
-	FILE_OUTPUT_DIR = "FILE_OUTPUT_DIR"
+	SNAPSHOT_BLOCK_HEIGHT      = "SNAPSHOT_BLOCK_HEIGHT"
+	SNAPSHOT_WORKERS           = "SNAPSHOT_WORKERS"
+	SNAPSHOT_RECOVERY_FILE     = "SNAPSHOT_RECOVERY_FILE"
+	SNAPSHOT_DISCARD_RECOVERY  = "SNAPSHOT_DISCARD_RECOVERY"
+	SNAPSHOT_COMMIT_INTERVAL   = "SNAPSHOT_COMMIT_INTERVAL"
+	SNAPSHOT_PARTITION         = "SNAPSHOT_PARTITION"
+	SNAPSHOT_MODE              = "SNAPSHOT_MODE"
+	SNAPSHOT_ACCOUNTS          = "SNAPSHOT_ACCOUNTS"
+	SNAPSHOT_STORAGE           = "SNAPSHOT_STORAGE"
+	SNAPSHOT_DENY_ACCOUNTS     = "SNAPSHOT_DENY_ACCOUNTS"
+	SNAPSHOT_EOA_ONLY          = "SNAPSHOT_EOA_ONLY"
+	SNAPSHOT_CONTRACTS_ONLY    = "SNAPSHOT_CONTRACTS_ONLY"
+	SNAPSHOT_MIN_BALANCE       = "SNAPSHOT_MIN_BALANCE"
+	SNAPSHOT_CODE_HASHES       = "SNAPSHOT_CODE_HASHES"
+	SNAPSHOT_MAX_STORAGE_SLOTS = "SNAPSHOT_MAX_STORAGE_SLOTS"
+	SNAPSHOT_FULL_BLOCK        = "SNAPSHOT_FULL_BLOCK"
+	SNAPSHOT_ALLOW_MISSING     = "SNAPSHOT_ALLOW_MISSING_BLOCK_DATA"
+	SNAPSHOT_MANIFEST          = "SNAPSHOT_MANIFEST"
+	SNAPSHOT_START_HEIGHT      = "SNAPSHOT_START_HEIGHT"
+	SNAPSHOT_STOP_HEIGHT       = "SNAPSHOT_STOP_HEIGHT"
+	SNAPSHOT_HEIGHT_STEP       = "SNAPSHOT_HEIGHT_STEP"
+	SNAPSHOT_HEIGHTS           = "SNAPSHOT_HEIGHTS"
+	SNAPSHOT_DEDUP_IPLDS       = "SNAPSHOT_DEDUP_IPLDS"
+	SNAPSHOT_FROM_HEIGHT       = "SNAPSHOT_FROM_HEIGHT"
+	SNAPSHOT_TO_HEIGHT         = "SNAPSHOT_TO_HEIGHT"
+
+	LOG_LEVEL             = "LOG_LEVEL"
+	LOG_FILE              = "LOG_FILE"
+	LOG_PROGRESS_INTERVAL = "LOG_PROGRESS_INTERVAL"
+
+	PROM_METRICS       = "PROM_METRICS"
+	PROM_HTTP          = "PROM_HTTP"
+	PROM_HTTP_ADDR     = "PROM_HTTP_ADDR"
+	PROM_HTTP_PORT     = "PROM_HTTP_PORT"
+	PROM_DB_STATS      = "PROM_DB_STATS"
+	PROM_PUSH_URL      = "PROM_PUSH_URL"
+	PROM_PUSH_JOB      = "PROM_PUSH_JOB"
+	PROM_PUSH_INTERVAL = "PROM_PUSH_INTERVAL"
+
+	FILE_OUTPUT_DIR     = "FILE_OUTPUT_DIR"
+	FILE_FORMAT         = "FILE_FORMAT"
+	FILE_FINALIZE       = "FILE_FINALIZE"
+	FILE_QUARANTINE_DIR = "FILE_QUARANTINE_DIR"
 
 	LEVELDB_ANCIENT = "LEVELDB_ANCIENT"
 	LEVELDB_PATH    = "LEVELDB_PATH"
+	LEVELDB_ENGINE  = "LEVELDB_ENGINE"
 
 	ETH_CLIENT_NAME   = "ETH_CLIENT_NAME"
 	ETH_GENESIS_BLOCK = "ETH_GENESIS_BLOCK"
@@ -55,25 +83,53 @@ const (
 
 // TOML bindings
 const (
-	SNAPSHOT_BLOCK_HEIGHT_TOML  = "snapshot.blockHeight"
-	SNAPSHOT_WORKERS_TOML       = "snapshot.workers"
-	SNAPSHOT_RECOVERY_FILE_TOML = "snapshot.recoveryFile"
-	SNAPSHOT_MODE_TOML          = "snapshot.mode"
-	SNAPSHOT_ACCOUNTS_TOML      = "snapshot.accounts"
-
-	LOG_LEVEL_TOML = "log.level"
-	LOG_FILE_TOML  = "log.file"
-
-	PROM_METRICS_TOML   = "prom.metrics"
-	PROM_HTTP_TOML      = "prom.http"
-	PROM_HTTP_ADDR_TOML = "prom.httpAddr"
-	PROM_HTTP_PORT_TOML = "prom.httpPort"
-	PROM_DB_STATS_TOML  = "prom.dbStats"
-
-	FILE_OUTPUT_DIR_TOML = "file.outputDir"
+	SNAPSHOT_BLOCK_HEIGHT_TOML      = "snapshot.blockHeight"
+	SNAPSHOT_WORKERS_TOML           = "snapshot.workers"
+	SNAPSHOT_RECOVERY_FILE_TOML     = "snapshot.recoveryFile"
+	SNAPSHOT_DISCARD_RECOVERY_TOML  = "snapshot.discardRecovery"
+	SNAPSHOT_COMMIT_INTERVAL_TOML   = "snapshot.commitInterval"
+	SNAPSHOT_PARTITION_TOML         = "snapshot.partition"
+	SNAPSHOT_MODE_TOML              = "snapshot.mode"
+	SNAPSHOT_ACCOUNTS_TOML          = "snapshot.accounts"
+	SNAPSHOT_STORAGE_TOML           = "snapshot.storage"
+	SNAPSHOT_DENY_ACCOUNTS_TOML     = "snapshot.denyAccounts"
+	SNAPSHOT_EOA_ONLY_TOML          = "snapshot.eoaOnly"
+	SNAPSHOT_CONTRACTS_ONLY_TOML    = "snapshot.contractsOnly"
+	SNAPSHOT_MIN_BALANCE_TOML       = "snapshot.minBalance"
+	SNAPSHOT_CODE_HASHES_TOML       = "snapshot.codeHashes"
+	SNAPSHOT_MAX_STORAGE_SLOTS_TOML = "snapshot.maxStorageSlots"
+	SNAPSHOT_FULL_BLOCK_TOML        = "snapshot.fullBlock"
+	SNAPSHOT_ALLOW_MISSING_TOML     = "snapshot.allowMissingBlockData"
+	SNAPSHOT_MANIFEST_TOML          = "snapshot.manifest"
+	SNAPSHOT_START_HEIGHT_TOML      = "snapshot.startHeight"
+	SNAPSHOT_STOP_HEIGHT_TOML       = "snapshot.stopHeight"
+	SNAPSHOT_HEIGHT_STEP_TOML       = "snapshot.heightStep"
+	SNAPSHOT_HEIGHTS_TOML           = "snapshot.heights"
+	SNAPSHOT_DEDUP_IPLDS_TOML       = "snapshot.dedupIPLDs"
+	SNAPSHOT_FROM_HEIGHT_TOML       = "snapshot.fromHeight"
+	SNAPSHOT_TO_HEIGHT_TOML         = "snapshot.toHeight"
+
+	LOG_LEVEL_TOML             = "log.level"
+	LOG_FILE_TOML              = "log.file"
+	LOG_PROGRESS_INTERVAL_TOML = "log.progressInterval"
+
+	PROM_METRICS_TOML       = "prom.metrics"
+	PROM_HTTP_TOML          = "prom.http"
+	PROM_HTTP_ADDR_TOML     = "prom.httpAddr"
+	PROM_HTTP_PORT_TOML     = "prom.httpPort"
+	PROM_DB_STATS_TOML      = "prom.dbStats"
+	PROM_PUSH_URL_TOML      = "prom.pushURL"
+	PROM_PUSH_JOB_TOML      = "prom.pushJob"
+	PROM_PUSH_INTERVAL_TOML = "prom.pushInterval"
+
+	FILE_OUTPUT_DIR_TOML     = "file.outputDir"
+	FILE_FORMAT_TOML         = "file.format"
+	FILE_FINALIZE_TOML       = "file.finalize"
+	FILE_QUARANTINE_DIR_TOML = "file.quarantineDir"
 
 	LEVELDB_ANCIENT_TOML = "leveldb.ancient"
 	LEVELDB_PATH_TOML    = "leveldb.path"
+	LEVELDB_ENGINE_TOML  = "leveldb.engine"
 
 	ETH_CLIENT_NAME_TOML   = "ethereum.clientName"
 	ETH_GENESIS_BLOCK_TOML = "ethereum.genesisBlock"
@@ -93,25 +149,53 @@ const (
 
 // CLI flags
 const (
-	SNAPSHOT_BLOCK_HEIGHT_CLI  = "block-height"
-	SNAPSHOT_WORKERS_CLI       = "workers"
-	SNAPSHOT_RECOVERY_FILE_CLI = "recovery-file"
-	SNAPSHOT_MODE_CLI          = "snapshot-mode"
-	SNAPSHOT_ACCOUNTS_CLI      = "snapshot-accounts"
-
-	LOG_LEVEL_CLI = "log-level"
-	LOG_FILE_CLI  = "log-file"
-
-	PROM_METRICS_CLI   = "prom-metrics"
-	PROM_HTTP_CLI      = "prom-http"
-	PROM_HTTP_ADDR_CLI = "prom-httpAddr"
-	PROM_HTTP_PORT_CLI = "prom-httpPort"
-	PROM_DB_STATS_CLI  = "prom-dbStats"
-
-	FILE_OUTPUT_DIR_CLI = "output-dir"
+	SNAPSHOT_BLOCK_HEIGHT_CLI      = "block-height"
+	SNAPSHOT_WORKERS_CLI           = "workers"
+	SNAPSHOT_RECOVERY_FILE_CLI     = "recovery-file"
+	SNAPSHOT_DISCARD_RECOVERY_CLI  = "discard-recovery"
+	SNAPSHOT_COMMIT_INTERVAL_CLI   = "commit-interval"
+	SNAPSHOT_PARTITION_CLI         = "partition"
+	SNAPSHOT_MODE_CLI              = "snapshot-mode"
+	SNAPSHOT_ACCOUNTS_CLI          = "snapshot-accounts"
+	SNAPSHOT_STORAGE_CLI           = "snapshot-storage"
+	SNAPSHOT_DENY_ACCOUNTS_CLI     = "deny-accounts"
+	SNAPSHOT_EOA_ONLY_CLI          = "eoa-only"
+	SNAPSHOT_CONTRACTS_ONLY_CLI    = "contracts-only"
+	SNAPSHOT_MIN_BALANCE_CLI       = "min-balance"
+	SNAPSHOT_CODE_HASHES_CLI       = "code-hashes"
+	SNAPSHOT_MAX_STORAGE_SLOTS_CLI = "max-storage-slots"
+	SNAPSHOT_FULL_BLOCK_CLI        = "full-block"
+	SNAPSHOT_ALLOW_MISSING_CLI     = "allow-missing-block-data"
+	SNAPSHOT_MANIFEST_CLI          = "manifest"
+	SNAPSHOT_START_HEIGHT_CLI      = "start-height"
+	SNAPSHOT_STOP_HEIGHT_CLI       = "stop-height"
+	SNAPSHOT_HEIGHT_STEP_CLI       = "height-step"
+	SNAPSHOT_HEIGHTS_CLI           = "heights"
+	SNAPSHOT_DEDUP_IPLDS_CLI       = "dedup-iplds"
+	SNAPSHOT_FROM_HEIGHT_CLI       = "from-height"
+	SNAPSHOT_TO_HEIGHT_CLI         = "to-height"
+
+	LOG_LEVEL_CLI             = "log-level"
+	LOG_FILE_CLI              = "log-file"
+	LOG_PROGRESS_INTERVAL_CLI = "log-progress-interval"
+
+	PROM_METRICS_CLI       = "prom-metrics"
+	PROM_HTTP_CLI          = "prom-http"
+	PROM_HTTP_ADDR_CLI     = "prom-httpAddr"
+	PROM_HTTP_PORT_CLI     = "prom-httpPort"
+	PROM_DB_STATS_CLI      = "prom-dbStats"
+	PROM_PUSH_URL_CLI      = "prom-pushURL"
+	PROM_PUSH_JOB_CLI      = "prom-pushJob"
+	PROM_PUSH_INTERVAL_CLI = "prom-pushInterval"
+
+	FILE_OUTPUT_DIR_CLI     = "output-dir"
+	FILE_FORMAT_CLI         = "file-format"
+	FILE_FINALIZE_CLI       = "finalize"
+	FILE_QUARANTINE_DIR_CLI = "quarantine-dir"
 
 	LEVELDB_ANCIENT_CLI = "ancient-path"
 	LEVELDB_PATH_CLI    = "leveldb-path"
+	LEVELDB_ENGINE_CLI  = "leveldb-engine"
 
 	ETH_CLIENT_NAME_CLI   = "ethereum-client-name"
 	ETH_GENESIS_BLOCK_CLI = "ethereum-genesis-block"
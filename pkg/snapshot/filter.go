@@ -0,0 +1,210 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// FilterReason is the reason an account was excluded from a snapshot.
+type FilterReason string
+
+const (
+	FilterDenied      FilterReason = "denied"
+	FilterNotEOA      FilterReason = "not_eoa"
+	FilterNotContract FilterReason = "not_contract"
+	FilterBalance     FilterReason = "min_balance"
+	FilterCodeHash    FilterReason = "code_hash"
+	FilterStorageSize FilterReason = "max_storage_slots"
+)
+
+// AccountFilter excludes accounts from a snapshot by address or by predicates on their fields.
+// In a snapshot, accounts are filtered as the state trie is traversed, before their storage: the
+// storage trie of an excluded account is not traversed, and neither its rows nor its storage trie
+// nodes are written. The state trie nodes of excluded accounts are still written as IPLDs, so the
+// state trie remains complete. The zero value excludes nothing.
+type AccountFilter struct {
+	// DeniedAccounts are always excluded
+	DeniedAccounts []common.Address `json:"deniedAccounts,omitempty"`
+	// EOAOnly excludes accounts with code; ContractsOnly excludes accounts without
+	EOAOnly       bool `json:"eoaOnly,omitempty"`
+	ContractsOnly bool `json:"contractsOnly,omitempty"`
+	// MinBalance excludes accounts with a lower balance, if set
+	MinBalance *big.Int `json:"minBalance,omitempty"`
+	// CodeHashes, if not empty, excludes accounts whose code hash is not one of them
+	CodeHashes []common.Hash `json:"codeHashes,omitempty"`
+	// MaxStorageSlots, if not zero, excludes accounts with more storage slots. In a state diff,
+	// only the slots in the diff are counted.
+	MaxStorageSlots uint64 `json:"maxStorageSlots,omitempty"`
+
+	initOnce   sync.Once
+	deniedKeys map[common.Hash]struct{}
+	codeHashes map[common.Hash]struct{}
+}
+
+// Validate checks the filter predicates are consistent.
+func (f *AccountFilter) Validate() error {
+	if f.EOAOnly && f.ContractsOnly {
+		return fmt.Errorf("EOA-only and contract-only filters are mutually exclusive")
+	}
+	if f.MinBalance != nil && f.MinBalance.Sign() < 0 {
+		return fmt.Errorf("minimum balance must not be negative")
+	}
+	return nil
+}
+
+func (f *AccountFilter) init() {
+	f.deniedKeys = make(map[common.Hash]struct{}, len(f.DeniedAccounts))
+	for _, addr := range f.DeniedAccounts {
+		f.deniedKeys[crypto.Keccak256Hash(addr.Bytes())] = struct{}{}
+	}
+	f.codeHashes = make(map[common.Hash]struct{}, len(f.CodeHashes))
+	for _, hash := range f.CodeHashes {
+		f.codeHashes[hash] = struct{}{}
+	}
+}
+
+// Check returns the reason the state leaf of a state diff should be excluded, or an empty string
+// if it should be included. Removed leaves can only be excluded by address.
+func (f *AccountFilter) Check(node types.StateLeafNode) FilterReason {
+	account := node.AccountWrapper.Account
+	if node.Removed || account == nil {
+		f.initOnce.Do(f.init)
+		if _, denied := f.deniedKeys[common.BytesToHash(node.AccountWrapper.LeafKey)]; denied {
+			return FilterDenied
+		}
+		return ""
+	}
+	reason, _ := f.checkAccount(node.AccountWrapper.LeafKey, account, func(uint64) (uint64, error) {
+		return uint64(len(node.StorageDiff)), nil
+	})
+	return reason
+}
+
+// checkAccount returns the reason the account with the leaf key should be excluded, or an empty
+// string if it should be included. Its storage slots are counted by countSlots only if every other
+// predicate passes, and need not be counted beyond limit.
+func (f *AccountFilter) checkAccount(leafKey []byte, account *gethtypes.StateAccount,
+	countSlots func(limit uint64) (uint64, error)) (FilterReason, error) {
+	f.initOnce.Do(f.init)
+	if _, denied := f.deniedKeys[common.BytesToHash(leafKey)]; denied {
+		return FilterDenied, nil
+	}
+	isContract := !bytes.Equal(account.CodeHash, emptyCodeHash)
+	switch {
+	case f.EOAOnly && isContract:
+		return FilterNotEOA, nil
+	case f.ContractsOnly && !isContract:
+		return FilterNotContract, nil
+	case f.MinBalance != nil && account.Balance.Cmp(f.MinBalance) < 0:
+		return FilterBalance, nil
+	}
+	if len(f.codeHashes) != 0 {
+		if _, match := f.codeHashes[common.BytesToHash(account.CodeHash)]; !match {
+			return FilterCodeHash, nil
+		}
+	}
+	if f.MaxStorageSlots != 0 {
+		slots, err := countSlots(f.MaxStorageSlots + 1)
+		if err != nil {
+			return "", err
+		}
+		if slots > f.MaxStorageSlots {
+			return FilterStorageSize, nil
+		}
+	}
+	return "", nil
+}
+
+// filterKey returns a canonical encoding of the filter, by which the filters of runs are compared.
+func filterKey(f *AccountFilter) string {
+	if f == nil {
+		return ""
+	}
+	canonical := &AccountFilter{
+		DeniedAccounts:  sortedAddresses(f.DeniedAccounts),
+		EOAOnly:         f.EOAOnly,
+		ContractsOnly:   f.ContractsOnly,
+		MinBalance:      f.MinBalance,
+		CodeHashes:      append([]common.Hash(nil), f.CodeHashes...),
+		MaxStorageSlots: f.MaxStorageSlots,
+	}
+	sort.Slice(canonical.CodeHashes, func(i, j int) bool {
+		return bytes.Compare(canonical.CodeHashes[i][:], canonical.CodeHashes[j][:]) < 0
+	})
+	data, _ := json.Marshal(canonical)
+	return string(data)
+}
+
+// FilterSummary counts the accounts included in and excluded from a snapshot.
+type FilterSummary struct {
+	mu       sync.Mutex
+	Included uint64                  `json:"included"`
+	Excluded map[FilterReason]uint64 `json:"excluded"`
+}
+
+func newFilterSummary() *FilterSummary {
+	return &FilterSummary{Excluded: make(map[FilterReason]uint64)}
+}
+
+func (s *FilterSummary) record(reason FilterReason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reason == "" {
+		s.Included++
+	} else {
+		s.Excluded[reason]++
+	}
+}
+
+// add adds the counts of another summary.
+func (s *FilterSummary) add(other *FilterSummary) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Included += other.Included
+	for reason, count := range other.Excluded {
+		s.Excluded[reason] += count
+	}
+}
+
+// String lists the counts, e.g. "included=10 denied=1 min_balance=2".
+func (s *FilterSummary) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parts := []string{fmt.Sprintf("included=%d", s.Included)}
+	var reasons []string
+	for reason := range s.Excluded {
+		reasons = append(reasons, string(reason))
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		parts = append(parts, fmt.Sprintf("%s=%d", reason, s.Excluded[FilterReason(reason)]))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,258 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+)
+
+// ManifestFileName is the name of the manifest written to the output directory in file mode.
+const ManifestFileName = "metadata.json"
+
+// Manifest describes the output of a run. It is written as JSON once the run is complete.
+type Manifest struct {
+	// Type is the kind of run: "snapshot", "snapshotRange" or "stateDiff"
+	Type    string `json:"type"`
+	Version string `json:"version"`
+	Range   struct {
+		Start uint64 `json:"start"`
+		Stop  uint64 `json:"stop"`
+	} `json:"range"`
+	Blocks []ManifestBlock `json:"blocks"`
+
+	NodeID       string `json:"nodeId"`
+	ClientName   string `json:"clientName"`
+	GenesisBlock string `json:"genesisBlock"`
+	NetworkID    string `json:"networkId"`
+	ChainID      string `json:"chainId"`
+
+	Mode             SnapshotMode                     `json:"mode"`
+	Format           FileFormat                       `json:"format,omitempty"`
+	Workers          uint                             `json:"workers"`
+	WatchedAddresses []common.Address                 `json:"watchedAddresses,omitempty"`
+	WatchedStorage   map[common.Address][]common.Hash `json:"watchedStorage,omitempty"`
+	// Partition is the slice of the state written, if the snapshot is partitioned
+	Partition *Partition `json:"partition,omitempty"`
+	// Filter is the account filter of the run, and FilterSummary counts the accounts it included
+	// and excluded
+	Filter        *AccountFilter `json:"filter,omitempty"`
+	FilterSummary *FilterSummary `json:"filterSummary,omitempty"`
+
+	// Rows counts the rows written by the service to each table. IPLD blocks of the transactions
+	// and receipts of full blocks are written by the indexer, and are not counted.
+	Rows map[string]uint64 `json:"rows"`
+	Time struct {
+		Start time.Time `json:"start"`
+		Stop  time.Time `json:"stop"`
+	} `json:"time"`
+	// Files are the output files in file mode, with paths relative to the output directory
+	Files []ManifestFile `json:"files,omitempty"`
+}
+
+// ManifestBlock identifies a block written by a run.
+type ManifestBlock struct {
+	Height    uint64      `json:"height"`
+	Hash      common.Hash `json:"hash"`
+	StateRoot common.Hash `json:"stateRoot"`
+}
+
+// ManifestFile describes an output file.
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// SetNodeInfo records the node info of the config.
+func (m *Manifest) SetNodeInfo(eth *EthConfig) {
+	m.NodeID = eth.NodeInfo.ID
+	m.ClientName = eth.NodeInfo.ClientName
+	m.GenesisBlock = eth.NodeInfo.GenesisBlock
+	m.NetworkID = eth.NodeInfo.NetworkID
+	m.ChainID = strconv.FormatUint(eth.NodeInfo.ChainID, 10)
+}
+
+// AddFiles records the size and checksum of each file under the output directory, other than the
+// manifest itself.
+func (m *Manifest) AddFiles(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == ManifestFileName {
+			return nil
+		}
+		file, err := checksumFile(path)
+		if err != nil {
+			return err
+		}
+		file.Path = filepath.ToSlash(rel)
+		m.Files = append(m.Files, *file)
+		return nil
+	})
+}
+
+// ReadManifest reads a manifest written by Write.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// Write writes the manifest as indented JSON to the path.
+func (m *Manifest) Write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func checksumFile(path string) (*ManifestFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return &ManifestFile{Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// toolVersion returns the version of the module the binary was built from, with the VCS revision
+// if known.
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision != "" {
+		version += "+" + revision
+		if modified == "true" {
+			version += "-dirty"
+		}
+	}
+	return version
+}
+
+// runStats records the blocks and rows written by the service, and the accounts filtered.
+type runStats struct {
+	sync.Mutex
+	blocks  []ManifestBlock
+	rows    map[string]uint64
+	summary *FilterSummary
+}
+
+func newRunStats() *runStats {
+	return &runStats{rows: make(map[string]uint64)}
+}
+
+func (r *runStats) addRows(table *schema.Table, count int) {
+	if count == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.rows[table.Name] += uint64(count)
+}
+
+// addBlock records the header of a block, and its header IPLD.
+func (r *runStats) addBlock(header *gethtypes.Header) {
+	r.Lock()
+	defer r.Unlock()
+	r.blocks = append(r.blocks, ManifestBlock{
+		Height:    header.Number.Uint64(),
+		Hash:      header.Hash(),
+		StateRoot: header.Root,
+	})
+	r.rows[schema.TableHeader.Name]++
+	r.rows[schema.TableIPLDBlock.Name]++
+}
+
+// addFilterSummary adds the summary of the account filter of a snapshot or state diff.
+func (r *runStats) addFilterSummary(summary *FilterSummary) {
+	r.Lock()
+	defer r.Unlock()
+	if r.summary == nil {
+		r.summary = newFilterSummary()
+	}
+	r.summary.add(summary)
+}
+
+// Manifest returns a manifest of the blocks and rows written by the service so far, with its
+// type, version and range set. The caller fills in the details of the run.
+func (s *Service) Manifest(kind string) *Manifest {
+	s.stats.Lock()
+	defer s.stats.Unlock()
+	m := &Manifest{
+		Type:    kind,
+		Version: toolVersion(),
+		Blocks:  append([]ManifestBlock(nil), s.stats.blocks...),
+		Rows:    make(map[string]uint64, len(s.stats.rows)),
+	}
+	for table, count := range s.stats.rows {
+		m.Rows[table] = count
+	}
+	if s.stats.summary != nil {
+		m.FilterSummary = newFilterSummary()
+		m.FilterSummary.add(s.stats.summary)
+	}
+	sort.Slice(m.Blocks, func(i, j int) bool { return m.Blocks[i].Height < m.Blocks[j].Height })
+	if len(m.Blocks) != 0 {
+		m.Range.Start = m.Blocks[0].Height
+		m.Range.Stop = m.Blocks[len(m.Blocks)-1].Height
+	}
+	return m
+}
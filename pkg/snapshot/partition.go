@@ -0,0 +1,224 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/prom"
+)
+
+// partitionDepth is the depth, in nibbles, of the paths at which the state trie is partitioned.
+// The key space is divided on the integer value of the first partitionDepth nibbles of the keys.
+const (
+	partitionDepth = 8
+	partitionSpace = uint64(1) << (4 * partitionDepth)
+
+	// MaxPartitions is the greatest number of partitions
+	MaxPartitions = 1 << 16
+)
+
+// Partition identifies one of Count equal slices of the state trie key space, so that a snapshot
+// can be taken by Count processes, each writing the state of its own slice. The trie is divided
+// by node path, so a leaf near the root of a sparse trie, whose path is shorter than the
+// partition depth, belongs to the partition containing its path rather than its key.
+type Partition struct {
+	Index uint64 `json:"index"`
+	Count uint64 `json:"count"`
+}
+
+// ParsePartition parses a partition given as "<index>/<count>", with index counted from 0.
+func ParsePartition(s string) (*Partition, error) {
+	index, count, found := strings.Cut(s, "/")
+	if !found {
+		return nil, fmt.Errorf("partition %q is not of the form <index>/<count>", s)
+	}
+	p := &Partition{}
+	var err error
+	if p.Index, err = strconv.ParseUint(strings.TrimSpace(index), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid partition index %q: %w", index, err)
+	}
+	if p.Count, err = strconv.ParseUint(strings.TrimSpace(count), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid partition count %q: %w", count, err)
+	}
+	return p, p.Validate()
+}
+
+// Validate checks the index is within the count, and the count is valid.
+func (p *Partition) Validate() error {
+	if p.Count == 0 || p.Count > MaxPartitions {
+		return fmt.Errorf("partition count must be between 1 and %d", MaxPartitions)
+	}
+	if p.Index >= p.Count {
+		return fmt.Errorf("partition index %d is out of range for %d partitions", p.Index, p.Count)
+	}
+	return nil
+}
+
+func (p *Partition) String() string {
+	return fmt.Sprintf("%d/%d", p.Index, p.Count)
+}
+
+// bounds returns the slice of the key space of the partition, from lo (inclusive) to hi
+// (exclusive).
+func (p *Partition) bounds() (lo, hi uint64) {
+	return p.Index * partitionSpace / p.Count, (p.Index + 1) * partitionSpace / p.Count
+}
+
+// ContainsPath returns whether the trie node at the path, as nibbles, is iterated within the
+// partition. This is the test of the bounded iterators of its ranges: whether the path is ordered
+// between the paths at which the partition starts and ends.
+func (p *Partition) ContainsPath(path []byte) bool {
+	lo, hi := p.bounds()
+	return (lo == 0 || bytes.Compare(path, partitionPath(lo)) >= 0) &&
+		(hi == partitionSpace || bytes.Compare(path, partitionPath(hi)) < 0)
+}
+
+// ContainsLeaf returns whether the account with the leaf key (the hash of its address) is written
+// within the partition. Accounts are written at the value node of their leaf, whose path is the
+// whole key, even if the leaf node itself is nearer the root.
+func (p *Partition) ContainsLeaf(key []byte) bool {
+	path := make([]byte, 2*len(key)+1)
+	for i, b := range key {
+		path[2*i], path[2*i+1] = b>>4, b&0xf
+	}
+	// the path of a value node ends with the terminator
+	path[len(path)-1] = 16
+	return p.ContainsPath(path)
+}
+
+// Ranges divides the partition into the path ranges iterated by each worker.
+func (p *Partition) Ranges(workers uint) []prom.PathRange {
+	lo, hi := p.bounds()
+	n := uint64(workers)
+	if n == 0 {
+		n = 1
+	}
+	if n > hi-lo {
+		n = hi - lo
+	}
+	ranges := make([]prom.PathRange, n)
+	for i := uint64(0); i < n; i++ {
+		start, end := lo+i*(hi-lo)/n, lo+(i+1)*(hi-lo)/n
+		if start != 0 {
+			ranges[i].Start = partitionPath(start)
+		}
+		if end != partitionSpace {
+			ranges[i].End = partitionPath(end)
+		}
+	}
+	return ranges
+}
+
+// partitionPath returns the trie path, as nibbles, of a point in the key space.
+func partitionPath(x uint64) []byte {
+	path := make([]byte, partitionDepth)
+	for i := partitionDepth - 1; i >= 0; i-- {
+		path[i] = byte(x & 0xf)
+		x >>= 4
+	}
+	return path
+}
+
+// MergePartitions checks the manifests of a partitioned snapshot are of every partition of a
+// snapshot of the same blocks, and merges them into a manifest of the whole snapshot. The rows
+// of each partition are summed, so rows written by every partition, such as the header, are
+// counted once per partition.
+func MergePartitions(manifests []*Manifest) (*Manifest, error) {
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("no manifests")
+	}
+	for _, m := range manifests {
+		if m.Partition == nil {
+			return nil, fmt.Errorf("manifest of %s at height %d is not of a partition", m.Type, m.Range.Stop)
+		}
+	}
+	sorted := append([]*Manifest(nil), manifests...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Partition.Index < sorted[j].Partition.Index })
+	first := sorted[0]
+	count := first.Partition.Count
+	if uint64(len(sorted)) != count {
+		return nil, fmt.Errorf("have %d manifests for %d partitions", len(sorted), count)
+	}
+
+	merged := &Manifest{
+		Type:             first.Type,
+		Version:          first.Version,
+		Range:            first.Range,
+		Blocks:           first.Blocks,
+		NodeID:           first.NodeID,
+		ClientName:       first.ClientName,
+		GenesisBlock:     first.GenesisBlock,
+		NetworkID:        first.NetworkID,
+		ChainID:          first.ChainID,
+		Mode:             first.Mode,
+		Format:           first.Format,
+		WatchedAddresses: first.WatchedAddresses,
+		WatchedStorage:   first.WatchedStorage,
+		Filter:           first.Filter,
+		Rows:             make(map[string]uint64),
+	}
+	for i, m := range sorted {
+		switch {
+		case m.Partition.Count != count:
+			return nil, fmt.Errorf("partition %s is not one of %d partitions", m.Partition, count)
+		case m.Partition.Index != uint64(i):
+			return nil, fmt.Errorf("partition %d/%d is missing or duplicated", i, count)
+		case m.Type != first.Type:
+			return nil, fmt.Errorf("partition %s is of a %s, not a %s", m.Partition, m.Type, first.Type)
+		case !sameBlocks(m.Blocks, first.Blocks):
+			return nil, fmt.Errorf("partition %s is not of the same blocks as partition %s",
+				m.Partition, first.Partition)
+		case m.GenesisBlock != first.GenesisBlock || m.ChainID != first.ChainID:
+			return nil, fmt.Errorf("partition %s is not of the same chain as partition %s",
+				m.Partition, first.Partition)
+		}
+		for table, rows := range m.Rows {
+			merged.Rows[table] += rows
+		}
+		if m.FilterSummary != nil {
+			if merged.FilterSummary == nil {
+				merged.FilterSummary = newFilterSummary()
+			}
+			merged.FilterSummary.add(m.FilterSummary)
+		}
+		merged.Workers += m.Workers
+		merged.Files = append(merged.Files, m.Files...)
+		if merged.Time.Start.IsZero() || m.Time.Start.Before(merged.Time.Start) {
+			merged.Time.Start = m.Time.Start
+		}
+		if m.Time.Stop.After(merged.Time.Stop) {
+			merged.Time.Stop = m.Time.Stop
+		}
+	}
+	return merged, nil
+}
+
+func sameBlocks(a, b []ManifestBlock) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
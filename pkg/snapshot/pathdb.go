@@ -0,0 +1,226 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+var errReadOnlyTrie = errors.New("path-based trie source is read-only")
+
+// ReadStateScheme returns the trie node storage scheme used by the database. Under the path-based
+// scheme the account trie root is stored under the empty path, so its presence identifies it.
+func ReadStateScheme(db ethdb.KeyValueReader) string {
+	if blob, _ := rawdb.ReadAccountTrieNode(db, nil); len(blob) != 0 {
+		return rawdb.PathScheme
+	}
+	return rawdb.HashScheme
+}
+
+// pathStateDatabase is a read-only state.Database which resolves trie nodes stored by path.
+//
+// Only the persisted (disk layer) state is available, so tries can only be opened at the state root
+// which was last flushed to disk; the diff layers above it are only held in the memory of the node.
+// Storage trie nodes are keyed by the owning account hash, which the tries are not opened with, so
+// the owner is resolved from the account leaf at which an account trie iterator is positioned when
+// the storage trie is opened.
+type pathStateDatabase struct {
+	state.Database // used for contract code
+
+	disk ethdb.Database
+
+	// leaves records the account leaf at which each account trie iterator is positioned
+	leaves sync.Map // *ownerTrackingIterator => accountLeaf
+}
+
+// accountLeaf is the key and storage root of an account leaf.
+type accountLeaf struct {
+	owner, root common.Hash
+}
+
+func newPathStateDatabase(edb ethdb.Database) *pathStateDatabase {
+	return &pathStateDatabase{
+		Database: state.NewDatabase(edb),
+		disk:     edb,
+	}
+}
+
+// diskRoot returns the state root of the persisted state.
+func (db *pathStateDatabase) diskRoot() common.Hash {
+	_, root := rawdb.ReadAccountTrieNode(db.disk, nil)
+	return root
+}
+
+// OpenTrie opens the account trie if root is the persisted state root, otherwise the storage trie
+// with the given root of the account leaf at which an account trie iterator is positioned. Empty
+// tries can always be opened.
+func (db *pathStateDatabase) OpenTrie(root common.Hash) (state.Trie, error) {
+	diskRoot := db.diskRoot()
+	if root == diskRoot {
+		return db.openTrie(trie.StateTrieID(root))
+	}
+	if root == emptyContractRoot {
+		return db.openTrie(trie.StorageTrieID(diskRoot, common.Hash{}, root))
+	}
+	owner, ok := db.owner(root)
+	if !ok {
+		return nil, fmt.Errorf("state root %s is not the persisted state root %s", root, diskRoot)
+	}
+	return db.openTrie(trie.StorageTrieID(diskRoot, owner, root))
+}
+
+// OpenStorageTrie opens the storage trie of an account.
+func (db *pathStateDatabase) OpenStorageTrie(stateRoot common.Hash, addrHash, root common.Hash) (state.Trie, error) {
+	return db.openTrie(trie.StorageTrieID(stateRoot, addrHash, root))
+}
+
+func (db *pathStateDatabase) openTrie(id *trie.ID) (state.Trie, error) {
+	tr, err := trie.New(id, db)
+	if err != nil {
+		return nil, err
+	}
+	return &pathTrie{Trie: tr, db: db, owner: id.Owner}, nil
+}
+
+// CopyTrie returns an independent copy of the given trie.
+func (db *pathStateDatabase) CopyTrie(t state.Trie) state.Trie {
+	switch t := t.(type) {
+	case *pathTrie:
+		return &pathTrie{Trie: t.Trie.Copy(), db: t.db, owner: t.owner}
+	default:
+		panic(fmt.Errorf("unknown trie type %T", t))
+	}
+}
+
+// Reader implements trie.NodeReader.
+func (db *pathStateDatabase) Reader(root common.Hash) trie.Reader {
+	if root != db.diskRoot() {
+		return nil
+	}
+	return pathNodeReader{db.disk}
+}
+
+// owner returns the account hash of an account leaf with the given storage root, at which an
+// account trie iterator is positioned. If several accounts have the same storage root, their
+// storage tries are identical, so any of them can be read.
+func (db *pathStateDatabase) owner(storageRoot common.Hash) (owner common.Hash, ok bool) {
+	db.leaves.Range(func(_, value any) bool {
+		if leaf := value.(accountLeaf); leaf.root == storageRoot {
+			owner, ok = leaf.owner, true
+		}
+		return !ok
+	})
+	return owner, ok
+}
+
+// pathNodeReader reads trie nodes from the path-keyed disk layer.
+type pathNodeReader struct {
+	disk ethdb.KeyValueReader
+}
+
+// Node retrieves the trie node at the path, checking that it has the expected hash.
+func (r pathNodeReader) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	var (
+		blob  []byte
+		nhash common.Hash
+	)
+	if owner == (common.Hash{}) {
+		blob, nhash = rawdb.ReadAccountTrieNode(r.disk, path)
+	} else {
+		blob, nhash = rawdb.ReadStorageTrieNode(r.disk, owner, path)
+	}
+	if nhash != hash {
+		return nil, fmt.Errorf("unexpected node at path %x of trie %s: have %s, want %s", path, owner, nhash, hash)
+	}
+	return blob, nil
+}
+
+// pathTrie adapts a raw trie over path-keyed nodes to the state.Trie interface. Reads take
+// unhashed keys, as with trie.StateTrie; writes are not supported.
+type pathTrie struct {
+	*trie.Trie
+	db    *pathStateDatabase
+	owner common.Hash
+}
+
+func (t *pathTrie) GetKey(shaKey []byte) []byte {
+	return rawdb.ReadPreimage(t.db.disk, common.BytesToHash(shaKey))
+}
+
+func (t *pathTrie) GetStorage(_ common.Address, key []byte) ([]byte, error) {
+	return t.Trie.Get(crypto.Keccak256(key))
+}
+
+func (t *pathTrie) GetAccount(address common.Address) (*gethtypes.StateAccount, error) {
+	res, err := t.Trie.Get(crypto.Keccak256(address.Bytes()))
+	if res == nil || err != nil {
+		return nil, err
+	}
+	ret := new(gethtypes.StateAccount)
+	err = rlp.DecodeBytes(res, ret)
+	return ret, err
+}
+
+func (t *pathTrie) UpdateStorage(common.Address, []byte, []byte) error { return errReadOnlyTrie }
+
+func (t *pathTrie) UpdateAccount(common.Address, *gethtypes.StateAccount) error {
+	return errReadOnlyTrie
+}
+
+func (t *pathTrie) DeleteStorage(common.Address, []byte) error { return errReadOnlyTrie }
+
+func (t *pathTrie) DeleteAccount(common.Address) error { return errReadOnlyTrie }
+
+// NodeIterator returns an iterator over the trie nodes. Account trie iterators record the account
+// leaf they are positioned at, so that its storage trie can be opened.
+func (t *pathTrie) NodeIterator(start []byte) trie.NodeIterator {
+	it := t.Trie.NodeIterator(start)
+	if t.owner != (common.Hash{}) {
+		return it
+	}
+	return &ownerTrackingIterator{NodeIterator: it, db: t.db}
+}
+
+// ownerTrackingIterator records the account leaf it is positioned at, until it moves on.
+type ownerTrackingIterator struct {
+	trie.NodeIterator
+	db *pathStateDatabase
+}
+
+func (it *ownerTrackingIterator) Next(descend bool) bool {
+	it.db.leaves.Delete(it)
+	if !it.NodeIterator.Next(descend) {
+		return false
+	}
+	if it.Leaf() {
+		var account gethtypes.StateAccount
+		if err := rlp.DecodeBytes(it.LeafBlob(), &account); err == nil && account.Root != emptyContractRoot {
+			it.db.leaves.Store(it, accountLeaf{owner: common.BytesToHash(it.LeafKey()), root: account.Root})
+		}
+	}
+	return true
+}
@@ -0,0 +1,265 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RecoveryMetaSuffix is appended to the name of a recovery file to name its metadata file.
+	RecoveryMetaSuffix = ".meta"
+	// WatchedStorageSuffix is appended to the name of a recovery file to name the file recording the
+	// accounts whose watched storage has been written.
+	WatchedStorageSuffix = ".watched"
+)
+
+// recoveryFiles returns the files recording the progress of a run: the recovery file of the
+// iterators, and the progress of the watched storage.
+func recoveryFiles(recoveryFile string) []string {
+	return []string{recoveryFile, recoveryFile + WatchedStorageSuffix}
+}
+
+// RecoveryMeta describes the run which wrote a recovery file. It is written alongside the
+// recovery file, so that the file is only used to resume the same run.
+type RecoveryMeta struct {
+	// Kind is the kind of run: "snapshot" or "stateDiff"
+	Kind      string      `json:"kind"`
+	Height    uint64      `json:"height"`
+	StateRoot common.Hash `json:"stateRoot"`
+	// FromHeight and FromStateRoot are the base of a state diff
+	FromHeight       uint64                           `json:"fromHeight"`
+	FromStateRoot    common.Hash                      `json:"fromStateRoot"`
+	Workers          uint                             `json:"workers"`
+	WatchedAddresses []common.Address                 `json:"watchedAddresses,omitempty"`
+	WatchedStorage   map[common.Address][]common.Hash `json:"watchedStorage,omitempty"`
+	Partition        *Partition                       `json:"partition,omitempty"`
+	Filter           *AccountFilter                   `json:"filter,omitempty"`
+	Mode             SnapshotMode                     `json:"mode"`
+}
+
+// ReadRecoveryMeta reads the metadata of a recovery file.
+func ReadRecoveryMeta(recoveryFile string) (*RecoveryMeta, error) {
+	data, err := os.ReadFile(recoveryFile + RecoveryMetaSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var meta RecoveryMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// mismatches lists the fields which differ from another run.
+func (m *RecoveryMeta) mismatches(other *RecoveryMeta) []string {
+	var ret []string
+	check := func(field string, a, b any) {
+		if fmt.Sprint(a) != fmt.Sprint(b) {
+			ret = append(ret, fmt.Sprintf("%s %v (current run: %v)", field, a, b))
+		}
+	}
+	check("kind", m.Kind, other.Kind)
+	check("height", m.Height, other.Height)
+	check("state root", m.StateRoot, other.StateRoot)
+	check("from height", m.FromHeight, other.FromHeight)
+	check("from state root", m.FromStateRoot, other.FromStateRoot)
+	check("workers", m.Workers, other.Workers)
+	check("watched addresses", sortedAddresses(m.WatchedAddresses), sortedAddresses(other.WatchedAddresses))
+	check("watched storage", sortedStorage(m.WatchedStorage), sortedStorage(other.WatchedStorage))
+	check("partition", m.Partition, other.Partition)
+	check("account filter", filterKey(m.Filter), filterKey(other.Filter))
+	check("mode", m.Mode, other.Mode)
+	return ret
+}
+
+// checkRecovery checks that an existing recovery file was written by the same run as described
+// by meta. A recovery file without metadata cannot be checked, so is treated as not matching. If
+// discard is set, a recovery file which does not match is removed, otherwise it is an error.
+func checkRecovery(recoveryFile string, meta *RecoveryMeta, discard bool) error {
+	// Copies from a checkpoint are left if a run stopped before committing its batch, in which case
+	// they record the progress which was committed
+	if restored, err := restoreCheckpoint(recoveryFile); err != nil {
+		return err
+	} else if restored {
+		log.WithField("file", recoveryFile).Warn("Restored recovery file from the last checkpoint")
+	}
+	if exists, err := hasRecoveryFiles(recoveryFile); err != nil || !exists {
+		return err
+	}
+
+	var problem string
+	saved, err := ReadRecoveryMeta(recoveryFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		problem = "it has no metadata file"
+	} else if err != nil {
+		problem = fmt.Sprintf("its metadata could not be read: %v", err)
+	} else if mismatches := saved.mismatches(meta); len(mismatches) != 0 {
+		problem = "it was written by a different run: " + strings.Join(mismatches, ", ")
+	}
+	if problem == "" {
+		log.WithField("file", recoveryFile).Info("Resuming from recovery file")
+		return nil
+	}
+	if !discard {
+		return fmt.Errorf("cannot resume from recovery file %s, as %s; "+
+			"remove it, or set %s (--%s) to discard it",
+			recoveryFile, problem, SNAPSHOT_DISCARD_RECOVERY_TOML, SNAPSHOT_DISCARD_RECOVERY_CLI)
+	}
+	log.WithField("file", recoveryFile).Warnf("Discarding recovery file, as %s", problem)
+	for _, file := range append(recoveryFiles(recoveryFile), recoveryFile+RecoveryMetaSuffix) {
+		if err := removeFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreCheckpoint restores the recovery files from their copies at the last checkpoint, and
+// returns whether there were any.
+func restoreCheckpoint(recoveryFile string) (bool, error) {
+	var restored bool
+	for _, file := range recoveryFiles(recoveryFile) {
+		info, err := os.Stat(file + checkpointSuffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return restored, err
+		}
+		restored = true
+		if info.Size() == 0 {
+			// the file did not exist at the checkpoint
+			if err = removeFile(file); err == nil {
+				err = removeFile(file + checkpointSuffix)
+			}
+		} else {
+			err = os.Rename(file+checkpointSuffix, file)
+		}
+		if err != nil {
+			return restored, err
+		}
+	}
+	if exists, err := hasRecoveryFiles(recoveryFile); err != nil || exists {
+		return restored, err
+	}
+	return restored, removeFile(recoveryFile + RecoveryMetaSuffix)
+}
+
+// hasRecoveryFiles returns whether any of the recovery files exist.
+func hasRecoveryFiles(recoveryFile string) (bool, error) {
+	for _, file := range recoveryFiles(recoveryFile) {
+		if _, err := os.Stat(file); err == nil {
+			return true, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func removeFile(file string) error {
+	if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// saveRecoveryMeta writes the metadata of the recovery files if any were written, or removes any
+// stale metadata if none were.
+func saveRecoveryMeta(recoveryFile string, meta *RecoveryMeta) error {
+	metaFile := recoveryFile + RecoveryMetaSuffix
+	if exists, err := hasRecoveryFiles(recoveryFile); err != nil {
+		return err
+	} else if !exists {
+		return removeFile(metaFile)
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaFile, append(data, '\n'), 0644)
+}
+
+// watchedProgress records the accounts whose watched storage has been written, so that a resumed
+// run continues after them. It is saved alongside the recovery file once the state traversal is
+// complete, so its presence also records that.
+type watchedProgress struct {
+	file string
+	done map[common.Address]struct{}
+}
+
+// readWatchedProgress reads the progress saved to the file, or returns nil if there is none.
+func readWatchedProgress(file string) (*watchedProgress, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var done []common.Address
+	if err := json.Unmarshal(data, &done); err != nil {
+		return nil, fmt.Errorf("invalid watched storage progress file %s: %w", file, err)
+	}
+	p := newWatchedProgress(file)
+	for _, addr := range done {
+		p.done[addr] = struct{}{}
+	}
+	return p, nil
+}
+
+func newWatchedProgress(file string) *watchedProgress {
+	return &watchedProgress{file: file, done: make(map[common.Address]struct{})}
+}
+
+func (p *watchedProgress) save() error {
+	done := make([]common.Address, 0, len(p.done))
+	for addr := range p.done {
+		done = append(done, addr)
+	}
+	data, err := json.Marshal(sortedAddresses(done))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.file, data, 0644)
+}
+
+func sortedAddresses(addrs []common.Address) []common.Address {
+	ret := append([]common.Address(nil), addrs...)
+	sort.Slice(ret, func(i, j int) bool { return bytes.Compare(ret[i][:], ret[j][:]) < 0 })
+	return ret
+}
+
+// sortedStorage returns the watched slots as a sorted list of strings, for comparison.
+func sortedStorage(storage map[common.Address][]common.Hash) []string {
+	var ret []string
+	for addr, slots := range storage {
+		for _, slot := range slots {
+			ret = append(ret, addr.Hex()+":"+slot.Hex())
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -16,24 +16,32 @@
 package snapshot
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"math/big"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/prom"
 	statediff "github.com/cerc-io/plugeth-statediff"
 	"github.com/cerc-io/plugeth-statediff/adapt"
 	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
 	"github.com/cerc-io/plugeth-statediff/types"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
 	log "github.com/sirupsen/logrus"
 )
@@ -54,120 +62,919 @@ type Service struct {
 	indexer      indexer.Indexer
 	maxBatchSize uint
 	recoveryFile string
+	stateScheme  string
+	stats        *runStats
+	// mode is recorded with recovery files, and discardRecovery allows recovery files written by a
+	// different run to be discarded
+	mode            SnapshotMode
+	discardRecovery bool
 }
 
+// NewLevelDB opens the chain database read-only, with the freezer attached. The database engine is
+// taken from the config if set, otherwise it is detected from the files on disk and recorded in
+// the config. The node info of the config is filled in and checked against the database, so that
+// it is complete before the indexer is created with it.
 func NewLevelDB(con *EthConfig) (ethdb.Database, error) {
-	kvdb, err := rawdb.NewLevelDBDatabase(con.LevelDBPath, 1024, 256, "ipld-eth-state-snapshot", true)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect LevelDB: %s", err)
+	if con.Engine == "" {
+		engine, err := DetectEngine(con.LevelDBPath)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("detected %s database at %s", engine, con.LevelDBPath)
+		con.Engine = engine
 	}
-	edb, err := rawdb.NewDatabaseWithFreezer(kvdb, con.AncientDBPath, "ipld-eth-state-snapshot", true)
+	edb, err := rawdb.Open(rawdb.OpenOptions{
+		Type:              con.Engine,
+		Directory:         con.LevelDBPath,
+		AncientsDirectory: con.AncientDBPath,
+		Namespace:         prom.ChainDBNamespace,
+		Cache:             1024,
+		Handles:           256,
+		ReadOnly:          true,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect LevelDB freezer: %s", err)
+		return nil, fmt.Errorf("failed to connect %s database: %s", con.Engine, err)
+	}
+	if err := con.InitNodeInfo(edb); err != nil {
+		edb.Close()
+		return nil, err
 	}
 	return edb, nil
 }
 
+// DetectEngine returns the engine of the database at the given path, using the same
+// heuristic as geth: both engines write a CURRENT file, but only Pebble writes OPTIONS files.
+func DetectEngine(path string) (string, error) {
+	if _, err := os.Stat(filepath.Join(path, "CURRENT")); err != nil {
+		return "", fmt.Errorf("no database found at %s: %w", path, err)
+	}
+	matches, err := filepath.Glob(filepath.Join(path, "OPTIONS*"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) > 0 {
+		return EnginePebble, nil
+	}
+	return EngineLevelDB, nil
+}
+
 // NewSnapshotService creates Service.
+// The state scheme (hash- or path-based) of the trie nodes is detected from the database.
 func NewSnapshotService(edb ethdb.Database, indexer indexer.Indexer, recoveryFile string) (*Service, error) {
+	scheme := ReadStateScheme(edb)
+	log.Infof("using %s trie node storage", scheme)
+	var stateDB state.Database
+	if scheme == rawdb.PathScheme {
+		stateDB = newPathStateDatabase(edb)
+	} else {
+		stateDB = state.NewDatabase(edb)
+	}
 	return &Service{
 		ethDB:        edb,
-		stateDB:      state.NewDatabase(edb),
+		stateDB:      stateDB,
 		indexer:      indexer,
 		maxBatchSize: defaultBatchSize,
 		recoveryFile: recoveryFile,
+		stateScheme:  scheme,
+		stats:        newRunStats(),
 	}, nil
 }
 
 type SnapshotParams struct {
 	WatchedAddresses []common.Address
-	Height           uint64
-	Workers          uint
+	// WatchedStorage maps accounts to the storage slot keys to snapshot. For these accounts, only
+	// the given slots are included, rather than the entire storage trie.
+	WatchedStorage map[common.Address][]common.Hash
+	// Filter, if set, excludes accounts from the output
+	Filter *AccountFilter
+	// FullBlock indicates whether to index the complete block, rather than only the header
+	FullBlock bool
+	// AllowMissingBlockData indicates whether to index the header with zero total difficulty or
+	// reward if the data to compute them is missing, rather than failing
+	AllowMissingBlockData bool
+	// CommitInterval is the number of state nodes after which the batch is committed with the
+	// recovery file; if zero, the batch is committed once the snapshot is complete
+	CommitInterval uint64
+	// Partition, if set, restricts the snapshot to a slice of the state trie key space
+	Partition *Partition
+	// DedupIPLDs, in CreateSnapshotRange, skips IPLDs already emitted for an earlier height
+	DedupIPLDs bool
+	Height     uint64
+	Workers    uint
+}
+
+type StateDiffParams struct {
+	WatchedAddresses []common.Address
+	// Filter, if set, excludes accounts from the output
+	Filter *AccountFilter
+	// FullBlock indicates whether to index the complete block at ToHeight, rather than only the header
+	FullBlock bool
+	// AllowMissingBlockData indicates whether to index the header with zero total difficulty or
+	// reward if the data to compute them is missing, rather than failing
+	AllowMissingBlockData bool
+	// CommitInterval is the number of state nodes after which the batch is committed with the
+	// recovery file; if zero, the batch is committed once the diff is complete
+	CommitInterval uint64
+	FromHeight     uint64
+	ToHeight       uint64
+	Workers        uint
 }
 
 func (s *Service) CreateSnapshot(params SnapshotParams) error {
+	return s.createSnapshot(params, s.recoveryFile, nil)
+}
+
+// CreateSnapshotRange creates a snapshot at each of the given heights in turn (ignores height
+// param). Each height writes its own recovery file.
+//
+// Contract code is written once per height, unless params.DedupIPLDs is set. Then IPLD blocks,
+// including code, which were already emitted for an earlier height in the run are not emitted
+// again, so they are only written with the block number of the first height they appear at. As
+// ipld-eth-db joins IPLD blocks on both key and block number, the state of later heights can then
+// not be looked up in the database as usual.
+func (s *Service) CreateSnapshotRange(heights []uint64, params SnapshotParams) error {
+	var emitted *diskCIDSet
+	if params.DedupIPLDs {
+		var err error
+		if emitted, err = newDiskCIDSet(); err != nil {
+			return err
+		}
+		defer emitted.close()
+	}
+	for _, height := range heights {
+		params.Height = height
+		recoveryFile := rangeRecoveryFile(s.recoveryFile, height)
+		if err := s.createSnapshot(params, recoveryFile, emitted); err != nil {
+			return fmt.Errorf("snapshot at height %d failed: %w", height, err)
+		}
+		log.WithField("height", height).Info("Snapshot complete")
+	}
+	return nil
+}
+
+// createSnapshot performs a snapshot using the given recovery file. If emitted is non-nil, it is
+// used to skip IPLDs which have already been emitted.
+func (s *Service) createSnapshot(params SnapshotParams, recoveryFile string, emitted *diskCIDSet) (err error) {
+	prom.StartRun(prom.RunInfo{Kind: "snapshot", Height: params.Height, Mode: string(s.mode)})
+	defer func() { prom.EndRun(err) }()
 	// extract header from lvldb and publish to PG-IPFS
 	// hold onto the headerID so that we can link the state nodes to this header
-	hash := rawdb.ReadCanonicalHash(s.ethDB, params.Height)
-	header := rawdb.ReadHeader(s.ethDB, hash, params.Height)
-	if header == nil {
-		return fmt.Errorf("unable to read canonical header at height %d", params.Height)
+	header, err := s.readCanonicalHeader(params.Height)
+	if err != nil {
+		return err
+	}
+	prom.SetRunBlock(header.Hash(), header.Root)
+	if err = s.checkStateAvailable(header); err != nil {
+		return err
+	}
+	log.WithField("height", params.Height).WithField("hash", header.Hash()).Info("Creating snapshot")
+	meta := &RecoveryMeta{
+		Kind:             "snapshot",
+		Height:           params.Height,
+		StateRoot:        header.Root,
+		Workers:          params.Workers,
+		WatchedAddresses: params.WatchedAddresses,
+		WatchedStorage:   params.WatchedStorage,
+		Partition:        params.Partition,
+		Filter:           params.Filter,
+		Mode:             s.mode,
+	}
+	if err = checkRecovery(recoveryFile, meta, s.discardRecovery); err != nil {
+		return err
 	}
-	log.WithField("height", params.Height).WithField("hash", hash).Info("Creating snapshot")
 
 	// Context for snapshot work
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	defer cancelCtx()
-	// Cancel context on receiving a signal. On cancellation, all tracked iterators complete
-	// processing of their current node before stopping.
-	captureSignal(cancelCtx)
 
-	var err error
-	tx := s.indexer.BeginTx(header.Number, ctx)
-	defer tx.RollbackOnFailure(err)
+	tx, headerid, err := s.beginBlock(ctx, header, params.FullBlock, params.AllowMissingBlockData)
+	if err != nil {
+		return err
+	}
+	cp := &checkpointer{
+		recoveryFile: recoveryFile,
+		meta:         meta,
+		workers:      params.Workers,
+		interval:     params.CommitInterval,
+		begin:        func() indexer.Batch { return s.indexer.BeginTx(header.Number, ctx) },
+		tx:           tx,
+	}
+	// On receiving a signal, all tracked iterators complete processing of their current node
+	// before stopping, and the nodes written are committed.
+	stopSignal := captureSignal(cp.interrupt)
+	defer stopSignal()
+
+	opts := sinkOptions{
+		emitted:     emitted,
+		filter:      params.Filter,
+		summary:     newFilterSummary(),
+		prefiltered: true,
+		codes:       newCIDSet(),
+		checkpoint:  cp,
+	}
+	// Watched storage is written once the state traversal is complete, which the presence of its
+	// progress file records. If only storage slots are watched, the whole state is not needed.
+	progress, err := readWatchedProgress(recoveryFile + WatchedStorageSuffix)
+	if err != nil {
+		return err
+	}
+	stateDone := progress != nil || (len(params.WatchedAddresses) == 0 && len(params.WatchedStorage) > 0)
+	if progress == nil {
+		progress = newWatchedProgress(recoveryFile + WatchedStorageSuffix)
+	}
+	sdparams := statediff.Params{
+		WatchedAddresses: params.WatchedAddresses,
+	}
+	sdparams.ComputeWatchedAddressesLeafPaths()
+	var size *prom.TrieSize
+	if !stateDone && prom.ProgressEnabled() {
+		size = s.estimateTrieSize(header.Root)
+	}
+	err = cp.run(func(tx indexer.Batch, tr *prom.MetricsTracker) error {
+		nodeSink, ipldSink := s.newSinks(tx, headerid, opts)
+		if !stateDone {
+			tr.SetSize(size)
+			if params.Partition != nil {
+				tr.SetRanges(params.Partition.Ranges(params.Workers))
+			}
+			if params.Filter != nil {
+				tr.SetLeafFilter(s.skipExcluded(header.Root, params, opts.summary))
+			}
+			builder := statediff.NewBuilder(adapt.GethStateView(s.stateDB))
+			builder.SetSubtrieWorkers(params.Workers)
+			if err := builder.WriteStateSnapshot(header.Root, sdparams, nodeSink, ipldSink, tr); err != nil {
+				return err
+			}
+			stateDone = true
+		}
+		if len(params.WatchedStorage) == 0 {
+			return nil
+		}
+		err := s.writeWatchedStorage(header.Root, params, progress, opts.summary, nodeSink, ipldSink)
+		if serr := progress.save(); serr != nil {
+			log.Errorf("failed to write watched storage progress: %v", serr)
+		}
+		return err
+	})
+	if err = cp.commit(err); err != nil {
+		return err
+	}
+	// The progress of the watched storage is only needed until it is committed
+	if err = removeFile(progress.file); err != nil {
+		return err
+	}
+	if err = saveRecoveryMeta(recoveryFile, meta); err != nil {
+		return err
+	}
+	s.logFilterSummary(params.Filter, opts.summary)
+	return nil
+}
+
+// CreateStateDiff writes only the state which changed between the canonical blocks at the
+// FromHeight and ToHeight, linked to the header at ToHeight. Applied to a snapshot at FromHeight,
+// this produces a snapshot at ToHeight.
+func (s *Service) CreateStateDiff(params StateDiffParams) (err error) {
+	prom.StartRun(prom.RunInfo{Kind: "stateDiff", Height: params.ToHeight, Mode: string(s.mode)})
+	defer func() { prom.EndRun(err) }()
+	fromHeader, err := s.readCanonicalHeader(params.FromHeight)
+	if err != nil {
+		return err
+	}
+	header, err := s.readCanonicalHeader(params.ToHeight)
+	if err != nil {
+		return err
+	}
+	prom.SetRunBlock(header.Hash(), header.Root)
+	for _, h := range []*gethtypes.Header{fromHeader, header} {
+		if err = s.checkStateAvailable(h); err != nil {
+			return err
+		}
+	}
+	log.WithField("from", params.FromHeight).WithField("to", params.ToHeight).
+		WithField("hash", header.Hash()).Info("Creating state diff")
+	meta := &RecoveryMeta{
+		Kind:             "stateDiff",
+		Height:           params.ToHeight,
+		StateRoot:        header.Root,
+		FromHeight:       params.FromHeight,
+		FromStateRoot:    fromHeader.Root,
+		Workers:          params.Workers,
+		WatchedAddresses: params.WatchedAddresses,
+		Filter:           params.Filter,
+		Mode:             s.mode,
+	}
+	if err = checkRecovery(s.recoveryFile, meta, s.discardRecovery); err != nil {
+		return err
+	}
 
-	var headerid string
-	headerid, err = s.indexer.PushHeader(tx, header, big.NewInt(0), big.NewInt(0))
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	tx, headerid, err := s.beginBlock(ctx, header, params.FullBlock, params.AllowMissingBlockData)
 	if err != nil {
 		return err
 	}
+	cp := &checkpointer{
+		recoveryFile: s.recoveryFile,
+		meta:         meta,
+		workers:      params.Workers,
+		interval:     params.CommitInterval,
+		begin:        func() indexer.Batch { return s.indexer.BeginTx(header.Number, ctx) },
+		tx:           tx,
+	}
+	stopSignal := captureSignal(cp.interrupt)
+	defer stopSignal()
+
+	opts := sinkOptions{
+		filter:     params.Filter,
+		summary:    newFilterSummary(),
+		checkpoint: cp,
+	}
+	args := statediff.Args{
+		OldStateRoot: fromHeader.Root,
+		NewStateRoot: header.Root,
+		BlockHash:    header.Hash(),
+		BlockNumber:  header.Number,
+	}
+	sdparams := statediff.Params{
+		WatchedAddresses: params.WatchedAddresses,
+	}
+	sdparams.ComputeWatchedAddressesLeafPaths()
+	err = cp.run(func(tx indexer.Batch, tr *prom.MetricsTracker) error {
+		nodeSink, ipldSink := s.newSinks(tx, headerid, opts)
+		builder := statediff.NewBuilder(adapt.GethStateView(s.stateDB))
+		builder.SetSubtrieWorkers(params.Workers)
+		return builder.WriteStateDiffTracked(args, sdparams, nodeSink, ipldSink, tr)
+	})
+	if err = cp.commit(err); err != nil {
+		return err
+	}
+	s.logFilterSummary(params.Filter, opts.summary)
+	return nil
+}
+
+// estimateTrieSize samples the state trie to estimate its size, by which the progress of the
+// snapshot is reported. On failure, nil is returned, and progress is estimated without it.
+func (s *Service) estimateTrieSize(root common.Hash) *prom.TrieSize {
+	start := time.Now()
+	tr, err := s.stateDB.OpenTrie(root)
+	if err != nil {
+		log.Warnf("failed to open state trie to estimate its size: %v", err)
+		return nil
+	}
+	size, err := prom.EstimateTrieSize(tr.NodeIterator, prom.DefaultEstimateParams)
+	if err != nil {
+		log.Warnf("failed to estimate state trie size: %v", err)
+		return nil
+	}
+	log.WithField("leaves", uint64(size.Total())).
+		WithField("stderr", uint64(size.StdErr())).
+		WithField("exact", size.Exact()).
+		WithField("duration", time.Since(start)).
+		Info("Estimated state trie size")
+	return size
+}
+
+// closeTracker saves the state of any incomplete iterators to the recovery file, with the metadata
+// of the run.
+func closeTracker(tr *prom.MetricsTracker, recoveryFile string, meta *RecoveryMeta) {
+	if err := tr.CloseAndSave(); err != nil {
+		log.Errorf("failed to write recovery file: %v", err)
+	}
+	if err := saveRecoveryMeta(recoveryFile, meta); err != nil {
+		log.Errorf("failed to write recovery metadata: %v", err)
+	}
+}
+
+// beginBlock begins the batch for the block with the header, and indexes either the header alone
+// or, if full is set, the complete block with its transactions, receipts, logs and uncles. It
+// returns the batch and the ID of the header. The header alone is indexed with zero total
+// difficulty or reward if they cannot be determined only if allowMissing is set.
+func (s *Service) beginBlock(ctx context.Context, header *gethtypes.Header, full, allowMissing bool) (indexer.Batch, string, error) {
+	hash, height := header.Hash(), header.Number.Uint64()
+	// The chain config is needed to derive the receipt fields, and for the terminal total difficulty
+	config, configErr := ReadChainConfig(s.ethDB)
+	td, tdErr := s.readTotalDifficulty(header, config)
+	var (
+		block    *gethtypes.Block
+		receipts gethtypes.Receipts
+		blockErr = configErr
+	)
+	if config != nil {
+		block, receipts, blockErr = s.readBlock(header, config)
+	}
 
-	tr := prom.NewTracker(s.recoveryFile, params.Workers)
-	defer func() {
-		err := tr.CloseAndSave()
+	if full {
+		for _, err := range []error{tdErr, blockErr} {
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		tx, err := s.indexer.PushBlock(block, receipts, td)
 		if err != nil {
-			log.Errorf("failed to write recovery file: %v", err)
+			return nil, "", fmt.Errorf("failed to index block at height %d: %w", height, err)
 		}
-	}()
+		log.WithField("height", height).WithField("transactions", len(block.Transactions())).
+			WithField("uncles", len(block.Uncles())).Info("Indexed full block")
+		s.stats.addBlock(header)
+		s.stats.addRows(&schema.TableUncle, len(block.Uncles()))
+		s.stats.addRows(&schema.TableTransaction, len(block.Transactions()))
+		s.stats.addRows(&schema.TableReceipt, len(receipts))
+		for _, receipt := range receipts {
+			s.stats.addRows(&schema.TableLog, len(receipt.Logs))
+		}
+		return tx, hash.String(), nil
+	}
+
+	// If allowed, the header is still indexed when the values cannot be determined, as they are
+	// not needed for the state; its row then differs from a statediffed one
+	for _, err := range []error{tdErr, blockErr} {
+		if err != nil && !allowMissing {
+			return nil, "", fmt.Errorf("%w (set %s to index the header with zero values)", err, SNAPSHOT_ALLOW_MISSING_TOML)
+		}
+	}
+	if tdErr != nil {
+		log.WithError(tdErr).Warn("Indexing header with zero total difficulty")
+		td = big.NewInt(0)
+	}
+	reward := big.NewInt(0)
+	if blockErr != nil {
+		log.WithError(blockErr).Warn("Indexing header with zero reward")
+	} else {
+		reward = shared.CalcEthBlockReward(header, block.Uncles(), block.Transactions(), receipts)
+	}
+	tx := s.indexer.BeginTx(header.Number, ctx)
+	headerID, err := s.indexer.PushHeader(tx, header, reward, td)
+	if err != nil {
+		tx.RollbackOnFailure(err)
+		return nil, "", err
+	}
+	s.stats.addBlock(header)
+	return tx, headerID, nil
+}
 
+// readBlock reads the block with the header and its receipts.
+func (s *Service) readBlock(header *gethtypes.Header, config *params.ChainConfig) (*gethtypes.Block, gethtypes.Receipts, error) {
+	hash, height := header.Hash(), header.Number.Uint64()
+	block := rawdb.ReadBlock(s.ethDB, hash, height)
+	if block == nil {
+		return nil, nil, fmt.Errorf("unable to read block at height %d", height)
+	}
+	receipts := rawdb.ReadReceipts(s.ethDB, hash, height, header.Time, config)
+	if receipts == nil {
+		return nil, nil, fmt.Errorf("unable to read receipts at height %d", height)
+	}
+	return block, receipts, nil
+}
+
+// readTotalDifficulty reads the total difficulty of the block with the header. If it is not
+// stored for a post-merge block, it is the terminal total difficulty of the chain config.
+func (s *Service) readTotalDifficulty(header *gethtypes.Header, config *params.ChainConfig) (*big.Int, error) {
+	if td := rawdb.ReadTd(s.ethDB, header.Hash(), header.Number.Uint64()); td != nil {
+		return td, nil
+	}
+	if header.Difficulty.Sign() == 0 && config != nil && config.TerminalTotalDifficulty != nil {
+		return new(big.Int).Set(config.TerminalTotalDifficulty), nil
+	}
+	return nil, fmt.Errorf("unable to read total difficulty at height %d", header.Number)
+}
+
+// ReadChainConfig reads the chain config stored for the genesis block of the database.
+func ReadChainConfig(edb ethdb.Database) (*params.ChainConfig, error) {
+	genesis := rawdb.ReadCanonicalHash(edb, 0)
+	config := rawdb.ReadChainConfig(edb, genesis)
+	if config == nil {
+		return nil, fmt.Errorf("no chain config found for genesis block %s", genesis)
+	}
+	return config, nil
+}
+
+// sinkOptions configure the sinks of a snapshot or state diff.
+type sinkOptions struct {
+	// emitted, if set, is used to skip IPLDs which have already been emitted
+	emitted *diskCIDSet
+	// filter, if set, excludes state nodes, and each decision is recorded in summary
+	filter  *AccountFilter
+	summary *FilterSummary
+	// prefiltered records that excluded accounts are skipped before reaching the sinks, which
+	// then only record the accounts included
+	prefiltered bool
+	// codes, if set, is used to emit the code of each included contract once. It is kept per
+	// snapshot, so in a range of snapshots code is written again at each height, unless emitted
+	// is set.
+	codes *cidSet
+	// checkpoint, if set, stops the traversal at checkpoints and counts the state nodes written
+	checkpoint *checkpointer
+}
+
+// newSinks returns the state node and IPLD sinks which publish to the given batch.
+func (s *Service) newSinks(tx indexer.Batch, headerID string, opts sinkOptions) (types.StateNodeSink, types.IPLDSink) {
 	var nodeMtx, ipldMtx sync.Mutex
+	mode := string(s.mode)
+	// isCode is set for the contract code emitted by emitCode
+	pushIPLD := func(c types.IPLD, isCode bool) error {
+		// Check before recording the CID, as the IPLD is not written if stopped
+		if opts.checkpoint != nil {
+			if err := opts.checkpoint.check(); err != nil {
+				return err
+			}
+		}
+		if isCode && !opts.codes.add(c.CID) {
+			return nil
+		}
+		if opts.emitted != nil {
+			if added, err := opts.emitted.add(c.CID); err != nil || !added {
+				return err
+			}
+		}
+		wait := time.Now()
+		ipldMtx.Lock()
+		defer ipldMtx.Unlock()
+		prom.ObserveLockWait(mode, "ipld", time.Since(wait))
+		start := time.Now()
+		if err := s.indexer.PushIPLD(tx, c); err != nil {
+			return err
+		}
+		prom.ObservePush(mode, "ipld", time.Since(start))
+		prom.AddIPLDBytes(mode, len(c.Content))
+		if isCode {
+			prom.IncCodeNodeCount()
+		}
+		s.stats.addRows(&schema.TableIPLDBlock, 1)
+		return nil
+	}
+	ipldSink := func(c types.IPLD) error { return pushIPLD(c, false) }
+	codeSink := func(c types.IPLD) error { return pushIPLD(c, true) }
 	nodeSink := func(node types.StateLeafNode) error {
+		if opts.checkpoint != nil {
+			if err := opts.checkpoint.check(); err != nil {
+				return err
+			}
+		}
+		if opts.filter != nil {
+			var reason FilterReason
+			if !opts.prefiltered {
+				reason = opts.filter.Check(node)
+			}
+			opts.summary.record(reason)
+			if reason != "" {
+				return nil
+			}
+		}
+		if opts.codes != nil {
+			if err := s.emitCode(node, opts.codes, codeSink); err != nil {
+				return err
+			}
+		}
+		wait := time.Now()
 		nodeMtx.Lock()
 		defer nodeMtx.Unlock()
+		prom.ObserveLockWait(mode, "node", time.Since(wait))
+		start := time.Now()
+		if err := s.indexer.PushStateNode(tx, node, headerID); err != nil {
+			return err
+		}
+		prom.ObservePush(mode, "state", time.Since(start))
 		prom.IncStateNodeCount()
 		prom.AddStorageNodeCount(len(node.StorageDiff))
-		return s.indexer.PushStateNode(tx, node, headerid)
+		s.stats.addRows(&schema.TableStateNode, 1)
+		s.stats.addRows(&schema.TableStorageNode, len(node.StorageDiff))
+		if opts.checkpoint != nil {
+			opts.checkpoint.count.Add(1)
+		}
+		return nil
 	}
-	ipldSink := func(c types.IPLD) error {
-		ipldMtx.Lock()
-		defer ipldMtx.Unlock()
-		return s.indexer.PushIPLD(tx, c)
+	return nodeSink, ipldSink
+}
+
+// emitCode emits the code of a contract account as a raw IPLD to the code sink, which adds it to
+// codes, unless it is already in codes.
+func (s *Service) emitCode(node types.StateLeafNode, codes *cidSet, codeSink types.IPLDSink) error {
+	account := node.AccountWrapper.Account
+	if node.Removed || account == nil || bytes.Equal(account.CodeHash, emptyCodeHash) {
+		return nil
 	}
+	c := ipld.Keccak256ToCid(ipld.RawBinary, account.CodeHash).String()
+	if codes.has(c) {
+		return nil
+	}
+	codeHash := common.BytesToHash(account.CodeHash)
+	code, err := s.stateDB.ContractCode(common.BytesToHash(node.AccountWrapper.LeafKey), codeHash)
+	if err != nil {
+		return fmt.Errorf("failed to read code %s: %w", codeHash, err)
+	}
+	return codeSink(types.IPLD{CID: c, Content: code})
+}
 
-	sdparams := statediff.Params{
-		WatchedAddresses: params.WatchedAddresses,
+// skipExcluded returns the leaf filter by which the iterators of a snapshot skip the accounts
+// excluded by its filter, before their storage tries are traversed. The exclusions are recorded in
+// the summary. Accounts which are not written, as they are not watched, are not filtered.
+func (s *Service) skipExcluded(root common.Hash, params SnapshotParams, summary *FilterSummary) prom.LeafFilter {
+	watched := make(map[common.Hash]struct{}, len(params.WatchedAddresses))
+	for _, addr := range params.WatchedAddresses {
+		watched[crypto.Keccak256Hash(addr.Bytes())] = struct{}{}
 	}
-	sdparams.ComputeWatchedAddressesLeafPaths()
-	builder := statediff.NewBuilder(adapt.GethStateView(s.stateDB))
-	builder.SetSubtrieWorkers(params.Workers)
-	if err = builder.WriteStateSnapshot(header.Root, sdparams, nodeSink, ipldSink, tr); err != nil {
+	return func(key, value []byte) bool {
+		leafKey := common.BytesToHash(key)
+		if _, has := watched[leafKey]; len(watched) != 0 && !has {
+			return false
+		}
+		var account gethtypes.StateAccount
+		if err := rlp.DecodeBytes(value, &account); err != nil {
+			// left to the builder, which fails on the same leaf
+			return false
+		}
+		reason, err := params.Filter.checkAccount(key, &account, func(limit uint64) (uint64, error) {
+			return s.countStorageSlots(root, leafKey, account.Root, limit)
+		})
+		if err != nil {
+			// the builder fails on reading the same storage
+			log.WithField("key", leafKey).Warnf("failed to count storage slots: %v", err)
+			return false
+		}
+		if reason == "" {
+			return false
+		}
+		summary.record(reason)
+		return true
+	}
+}
+
+// countStorageSlots counts the leaves of a storage trie, up to limit.
+func (s *Service) countStorageSlots(stateRoot, addrHash, root common.Hash, limit uint64) (uint64, error) {
+	if root == emptyContractRoot {
+		return 0, nil
+	}
+	tr, err := s.stateDB.OpenStorageTrie(stateRoot, addrHash, root)
+	if err != nil {
+		return 0, err
+	}
+	var count uint64
+	it := tr.NodeIterator(nil)
+	for count < limit && it.Next(true) {
+		if it.Leaf() {
+			count++
+		}
+	}
+	return count, it.Error()
+}
+
+// writeWatchedStorage writes the state leaf of each account with watched storage slots, with only
+// the storage leaves of those slots. The trie nodes on the paths from the roots to the leaves are
+// written as IPLDs, so that the proofs of the accounts and slots are intact. Accounts which are
+// also watched in full are skipped, as they are written by the builder, as are accounts excluded by
+// the filter, whose exclusions are recorded in the summary.
+func (s *Service) writeWatchedStorage(root common.Hash, params SnapshotParams, progress *watchedProgress,
+	summary *FilterSummary, nodeSink types.StateNodeSink, ipldSink types.IPLDSink) error {
+	watchedAccounts := make(map[common.Address]struct{}, len(params.WatchedAddresses))
+	for _, addr := range params.WatchedAddresses {
+		watchedAccounts[addr] = struct{}{}
+	}
+	stateTrie, err := s.stateDB.OpenTrie(root)
+	if err != nil {
 		return err
 	}
+	// Proofs share nodes near the root, which need only be written once
+	written := newCIDSet()
+	writeProof := func(codec uint64, proof proofList) error {
+		for _, node := range proof {
+			c := ipld.Keccak256ToCid(codec, crypto.Keccak256(node)).String()
+			if written.has(c) {
+				continue
+			}
+			if err := ipldSink(types.IPLD{CID: c, Content: node}); err != nil {
+				return err
+			}
+			written.add(c)
+		}
+		return nil
+	}
 
-	if err = tx.Submit(); err != nil {
-		return fmt.Errorf("batch transaction submission failed: %w", err)
+	// Accounts are written in order, and recorded as done once written
+	addrs := make([]common.Address, 0, len(params.WatchedStorage))
+	for addr := range params.WatchedStorage {
+		addrs = append(addrs, addr)
 	}
-	return err
+	for _, addr := range sortedAddresses(addrs) {
+		slots := params.WatchedStorage[addr]
+		if _, has := watchedAccounts[addr]; has {
+			continue
+		}
+		if _, done := progress.done[addr]; done {
+			continue
+		}
+		leafKey := crypto.Keccak256(addr.Bytes())
+		if params.Partition != nil && !params.Partition.ContainsLeaf(leafKey) {
+			continue
+		}
+		account, err := stateTrie.GetAccount(addr)
+		if err != nil {
+			return err
+		}
+		if account == nil {
+			log.WithField("address", addr).Warn("watched account does not exist")
+			continue
+		}
+		if params.Filter != nil {
+			reason, err := params.Filter.checkAccount(leafKey, account, func(limit uint64) (uint64, error) {
+				return s.countStorageSlots(root, common.BytesToHash(leafKey), account.Root, limit)
+			})
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				summary.record(reason)
+				continue
+			}
+		}
+		var proof proofList
+		if err := stateTrie.Prove(leafKey, 0, &proof); err != nil {
+			return err
+		}
+		if err := writeProof(ipld.MEthStateTrie, proof); err != nil {
+			return err
+		}
+
+		storageTrie, err := s.stateDB.OpenStorageTrie(root, common.BytesToHash(leafKey), account.Root)
+		if err != nil {
+			return err
+		}
+		var storage []types.StorageLeafNode
+		for _, slot := range slots {
+			slotKey := crypto.Keccak256(slot.Bytes())
+			value, err := storageTrie.GetStorage(addr, slot.Bytes())
+			if err != nil {
+				return err
+			}
+			var slotProof proofList
+			if err := storageTrie.Prove(slotKey, 0, &slotProof); err != nil {
+				return err
+			}
+			// An absent slot still has its proof of exclusion written
+			if err := writeProof(ipld.MEthStorageTrie, slotProof); err != nil {
+				return err
+			}
+			if len(value) == 0 {
+				log.WithField("address", addr).WithField("slot", slot).Warn("watched storage slot is empty")
+				continue
+			}
+			storage = append(storage, types.StorageLeafNode{
+				Value:   value,
+				LeafKey: slotKey,
+				CID:     slotProof.leafCID(ipld.MEthStorageTrie),
+			})
+		}
+
+		err = nodeSink(types.StateLeafNode{
+			AccountWrapper: types.AccountWrapper{
+				Account: account,
+				LeafKey: leafKey,
+				CID:     proof.leafCID(ipld.MEthStateTrie),
+			},
+			StorageDiff: storage,
+		})
+		if err != nil {
+			return err
+		}
+		progress.done[addr] = struct{}{}
+	}
+	return nil
 }
 
-// CreateLatestSnapshot snapshot at head (ignores height param)
-func (s *Service) CreateLatestSnapshot(workers uint, watchedAddresses []common.Address) error {
-	log.Info("Creating snapshot at head")
+// logFilterSummary logs the summary of a run, and adds it to the summary of the service.
+func (s *Service) logFilterSummary(filter *AccountFilter, summary *FilterSummary) {
+	if filter == nil {
+		return
+	}
+	log.Infof("Account filter summary: %s", summary)
+	s.stats.addFilterSummary(summary)
+}
+
+func (s *Service) readCanonicalHeader(height uint64) (*gethtypes.Header, error) {
+	hash := rawdb.ReadCanonicalHash(s.ethDB, height)
+	header := rawdb.ReadHeader(s.ethDB, hash, height)
+	if header == nil {
+		return nil, fmt.Errorf("unable to read canonical header at height %d", height)
+	}
+	return header, nil
+}
+
+// checkStateAvailable returns an error if the state at the header is known to be unavailable. A
+// path-based database only keeps the state last persisted to disk; earlier states are flattened
+// into it and later ones are only held in memory by the node.
+func (s *Service) checkStateAvailable(header *gethtypes.Header) error {
+	if s.stateScheme != rawdb.PathScheme {
+		return nil
+	}
+	diskRoot := s.stateDB.(*pathStateDatabase).diskRoot()
+	if header.Root == diskRoot {
+		return nil
+	}
+	persisted := "at an unknown height"
+	if head, err := s.headHeight(); err == nil {
+		if height, ok := s.persistedHeight(head); ok {
+			persisted = fmt.Sprintf("at height %d", height)
+		}
+	}
+	return fmt.Errorf("state at height %d (root %s) is not available in the path-based database, "+
+		"which only holds the persisted state (root %s, %s); older states have been flattened away, "+
+		"and newer states are only held in memory by the node",
+		header.Number, header.Root, diskRoot, persisted)
+}
+
+// persistedSearchDepth is the number of blocks below head searched for the block of the state
+// persisted by a path-based node, which keeps the latest 128 states in memory.
+const persistedSearchDepth = 1024
+
+// persistedHeight returns the height of the latest canonical block at or below head whose state is
+// the one persisted in a path-based database.
+func (s *Service) persistedHeight(head uint64) (uint64, bool) {
+	diskRoot := s.stateDB.(*pathStateDatabase).diskRoot()
+	for height := head; ; height-- {
+		header := rawdb.ReadHeader(s.ethDB, rawdb.ReadCanonicalHash(s.ethDB, height), height)
+		if header != nil && header.Root == diskRoot {
+			return height, true
+		}
+		if height == 0 || head-height >= persistedSearchDepth {
+			return 0, false
+		}
+	}
+}
+
+// LatestHeight returns the height of the latest block whose state can be snapshotted: the head
+// block, or under the path-based scheme the block of the persisted state, which lags behind head.
+func (s *Service) LatestHeight() (uint64, error) {
+	head, err := s.headHeight()
+	if err != nil || s.stateScheme != rawdb.PathScheme {
+		return head, err
+	}
+	height, ok := s.persistedHeight(head)
+	if !ok {
+		return 0, fmt.Errorf("no block within %d blocks of head %d has the persisted state root %s",
+			persistedSearchDepth, head, s.stateDB.(*pathStateDatabase).diskRoot())
+	}
+	if height != head {
+		log.WithField("head", head).WithField("height", height).
+			Warnf("Head state is not persisted by the path-based database, using the persisted state %d blocks behind head",
+				head-height)
+	}
+	return height, nil
+}
+
+func (s *Service) headHeight() (uint64, error) {
 	hash := rawdb.ReadHeadHeaderHash(s.ethDB)
-	height := rawdb.ReadHeaderNumber(s.ethDB, hash)
-	if height == nil {
-		return fmt.Errorf("unable to read header height for header hash %s", hash)
+	head := rawdb.ReadHeaderNumber(s.ethDB, hash)
+	if head == nil {
+		return 0, fmt.Errorf("unable to read header height for header hash %s", hash)
 	}
-	return s.CreateSnapshot(SnapshotParams{Height: *height, Workers: workers, WatchedAddresses: watchedAddresses})
+	return *head, nil
 }
 
-func captureSignal(cb func()) {
+// CreateLatestSnapshot snapshot at the latest height, as returned by LatestHeight (ignores height
+// param)
+func (s *Service) CreateLatestSnapshot(params SnapshotParams) error {
+	log.Info("Creating snapshot at head")
+	height, err := s.LatestHeight()
+	if err != nil {
+		return err
+	}
+	params.Height = height
+	return s.CreateSnapshot(params)
+}
+
+// SetRecoveryFile sets the recovery file of snapshots and state diffs.
+func (s *Service) SetRecoveryFile(recoveryFile string) {
+	s.recoveryFile = recoveryFile
+}
+
+// SetRecoveryOptions sets the output mode recorded with recovery files, and whether a recovery
+// file written by a different run is discarded rather than refused.
+func (s *Service) SetRecoveryOptions(mode SnapshotMode, discard bool) {
+	s.mode = mode
+	s.discardRecovery = discard
+}
+
+// Close closes the indexer, completing any output.
+func (s *Service) Close() error {
+	return s.indexer.Close()
+}
+
+// captureSignal calls cb on receiving SIGINT or SIGTERM, until the returned stop function is called.
+func captureSignal(cb func()) (stop func()) {
 	sigChan := make(chan os.Signal, 1)
+	done := make(chan struct{})
 
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		sig := <-sigChan
-		log.Errorf("Signal received (%v), stopping", sig)
-		cb()
+		select {
+		case sig := <-sigChan:
+			log.Errorf("Signal received (%v), stopping", sig)
+			cb()
+		case <-done:
+		}
 	}()
+	return func() {
+		signal.Stop(sigChan)
+		close(done)
+	}
 }
@@ -1,20 +1,39 @@
 package snapshot_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math/big"
 	"math/rand"
+	"os"
 	"path/filepath"
 	"sort"
 	"testing"
 	"time"
 
 	"github.com/cerc-io/eth-testing/chaindata"
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
 	"github.com/cerc-io/plugeth-statediff/indexer/models"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ipfs/go-cid"
 	"github.com/stretchr/testify/require"
 
 	"github.com/cerc-io/ipld-eth-state-snapshot/internal/mocks"
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/prom"
 	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
 	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
 )
@@ -47,6 +66,72 @@ func testConfig(leveldbpath, ancientdbpath string) *Config {
 	}
 }
 
+func TestDetectEngine(t *testing.T) {
+	// touch creates empty files in a new directory
+	touch := func(t *testing.T, names ...string) string {
+		dir := t.TempDir()
+		for _, name := range names {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+		}
+		return dir
+	}
+	levelDB := func(t *testing.T) string {
+		dir := t.TempDir()
+		db, err := rawdb.NewLevelDBDatabase(dir, 16, 16, "", false)
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+		return dir
+	}
+
+	cases := []struct {
+		name     string
+		dir      func(*testing.T) string
+		expected string
+	}{
+		{"leveldb", levelDB, EngineLevelDB},
+		{"leveldb fixture", func(*testing.T) string { return fixture.ChainA.ChainData }, EngineLevelDB},
+		{"pebble", func(t *testing.T) string {
+			return touch(t, "CURRENT", "MANIFEST-000001", "OPTIONS-000003")
+		}, EnginePebble},
+		{"empty", func(t *testing.T) string { return t.TempDir() }, ""},
+		{"missing", func(t *testing.T) string { return filepath.Join(t.TempDir(), "chaindata") }, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			engine, err := DetectEngine(tc.dir(t))
+			if tc.expected == "" {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, engine)
+		})
+	}
+
+	t.Run("configured engine", func(t *testing.T) {
+		config := testConfig(fixture.ChainA.ChainData, fixture.ChainA.Ancient)
+		config.Eth.Engine = EngineLevelDB
+		edb, err := NewLevelDB(config.Eth)
+		require.NoError(t, err)
+		require.NoError(t, edb.Close())
+		require.Equal(t, EngineLevelDB, config.Eth.Engine)
+
+		// the configured engine is used without detection, so fails on a LevelDB database
+		config.Eth.Engine = EnginePebble
+		_, err = NewLevelDB(config.Eth)
+		require.Error(t, err)
+		require.Equal(t, EnginePebble, config.Eth.Engine)
+	})
+
+	t.Run("detected engine", func(t *testing.T) {
+		config := testConfig(fixture.ChainA.ChainData, fixture.ChainA.Ancient)
+		edb, err := NewLevelDB(config.Eth)
+		require.NoError(t, err)
+		require.NoError(t, edb.Close())
+		require.Equal(t, EngineLevelDB, config.Eth.Engine)
+	})
+}
+
 func TestSnapshot(t *testing.T) {
 	runCase := func(t *testing.T, workers uint) {
 		params := SnapshotParams{Height: 1, Workers: workers}
@@ -78,6 +163,612 @@ func TestAccountSelectiveSnapshot(t *testing.T) {
 	}
 }
 
+func TestStorageSelectiveSnapshot(t *testing.T) {
+	height := uint64(32)
+	watchedStorage, expected := watchedStorageData_chainBblock32()
+
+	runCase := func(t *testing.T, workers uint) {
+		params := SnapshotParams{
+			Height:         height,
+			Workers:        workers,
+			WatchedStorage: watchedStorage,
+		}
+		data := doSnapshot(t, fixture.ChainB, params)
+		expected.verify(t, data)
+		verifyProofs(t, data, height)
+	}
+
+	for _, tc := range subtrieWorkerCases {
+		t.Run(fmt.Sprintf("with %d subtries", tc), func(t *testing.T) { runCase(t, tc) })
+	}
+
+	// Accounts watched in full take precedence over their watched slots
+	t.Run("with watched accounts", func(t *testing.T) {
+		watchedAddresses, expectedAccounts := watchedAccountData_chainBblock32()
+		params := SnapshotParams{
+			Height:           height,
+			Workers:          4,
+			WatchedAddresses: watchedAddresses[:1],
+			WatchedStorage:   watchedStorage,
+		}
+		leafKey := crypto.Keccak256Hash(watchedAddresses[0][:]).String()
+		expectedMixed := selectiveData{
+			StateNodes:   expected.StateNodes,
+			StorageNodes: make(map[string]map[string]*models.StorageNodeModel),
+		}
+		for key, storage := range expected.StorageNodes {
+			expectedMixed.StorageNodes[key] = storage
+		}
+		expectedMixed.StorageNodes[leafKey] = expectedAccounts.StorageNodes[leafKey]
+		data := doSnapshot(t, fixture.ChainB, params)
+		expectedMixed.verify(t, data)
+		verifyProofs(t, data, height)
+	})
+
+	// Watched accounts committed before a failure are not written again on resuming
+	t.Run("with checkpoints", func(t *testing.T) {
+		config := testConfig(fixture.ChainB.ChainData, fixture.ChainB.Ancient)
+		edb, err := NewLevelDB(config.Eth)
+		require.NoError(t, err)
+		defer edb.Close()
+
+		params := SnapshotParams{Height: height, Workers: 1, WatchedStorage: watchedStorage, CommitInterval: 1}
+		recoveryFile := filepath.Join(t.TempDir(), "recover.csv")
+		// the first account is committed, and the commit of the second fails
+		idx := mocks.NewTxIndexer(t)
+		idx.FailSubmit = 2
+		service, err := NewSnapshotService(edb, idx, recoveryFile)
+		require.NoError(t, err)
+		require.ErrorContains(t, service.CreateSnapshot(params), "mock submission failure")
+		require.Len(t, idx.StateNodes, 1)
+
+		data, err := os.ReadFile(recoveryFile + WatchedStorageSuffix)
+		require.NoError(t, err)
+		var done []common.Address
+		require.NoError(t, json.Unmarshal(data, &done))
+		require.Equal(t, []common.Address{common.HexToAddress("0x0616F59D291a898e796a1FAD044C5926ed2103eC")}, done)
+
+		idx.FailSubmit = 0
+		service, err = NewSnapshotService(edb, idx, recoveryFile)
+		require.NoError(t, err)
+		require.NoError(t, service.CreateSnapshot(params))
+		expected.verify(t, idx.IndexerData)
+		verifyProofs(t, idx.IndexerData, height)
+		require.NoFileExists(t, recoveryFile+WatchedStorageSuffix)
+	})
+}
+
+func TestSnapshotCode(t *testing.T) {
+	height := uint64(32)
+	runCase := func(t *testing.T, params SnapshotParams) {
+		data := doSnapshot(t, fixture.ChainB, params)
+		require.NotEmpty(t, data.StateNodes)
+		verifyCode(t, data)
+	}
+
+	for _, tc := range subtrieWorkerCases {
+		t.Run(fmt.Sprintf("with %d subtries", tc), func(t *testing.T) {
+			runCase(t, SnapshotParams{Height: height, Workers: tc})
+		})
+	}
+	t.Run("with watched storage", func(t *testing.T) {
+		watchedStorage, _ := watchedStorageData_chainBblock32()
+		runCase(t, SnapshotParams{Height: height, Workers: 4, WatchedStorage: watchedStorage})
+	})
+}
+
+func TestFullBlockSnapshot(t *testing.T) {
+	height := uint64(32)
+	headerOnly := doSnapshot(t, fixture.ChainB, SnapshotParams{Height: height, Workers: 4})
+	require.Empty(t, headerOnly.Blocks)
+
+	data := doSnapshot(t, fixture.ChainB, SnapshotParams{Height: height, Workers: 4, FullBlock: true})
+	block := data.Blocks[height]
+	require.NotNil(t, block, "block not indexed")
+	require.Equal(t, headerOnly.Headers[height].Hash(), block.Hash())
+	require.Equal(t, block.Header(), data.Headers[height])
+
+	receipts := data.Receipts[height]
+	require.Len(t, receipts, len(block.Transactions()))
+	for i, receipt := range receipts {
+		require.Equal(t, block.Transactions()[i].Hash(), receipt.TxHash)
+		require.Equal(t, block.Hash(), receipt.BlockHash)
+	}
+	// The state is unaffected
+	require.Equal(t, stateLeaves(headerOnly.StateNodes), stateLeaves(data.StateNodes))
+}
+
+func TestSnapshotHeaderValues(t *testing.T) {
+	height := uint64(32)
+	config := testConfig(fixture.ChainB.ChainData, fixture.ChainB.Ancient)
+	edb, err := NewLevelDB(config.Eth)
+	require.NoError(t, err)
+	chainConfig, err := ReadChainConfig(edb)
+	require.NoError(t, err)
+	hash := rawdb.ReadCanonicalHash(edb, height)
+	block := rawdb.ReadBlock(edb, hash, height)
+	receipts := rawdb.ReadReceipts(edb, hash, height, block.Time(), chainConfig)
+	expectedTd := rawdb.ReadTd(edb, hash, height)
+	expectedReward := shared.CalcEthBlockReward(block.Header(), block.Uncles(), block.Transactions(), receipts)
+	edb.Close()
+
+	data := doSnapshot(t, fixture.ChainB, SnapshotParams{Height: height, Workers: 4})
+	require.NotNil(t, expectedTd)
+	require.NotZero(t, expectedTd.Sign(), "fixture should have a total difficulty")
+	require.Equal(t, expectedTd, data.TDs[height])
+	require.Equal(t, expectedReward, data.Rewards[height])
+
+	full := doSnapshot(t, fixture.ChainB, SnapshotParams{Height: height, Workers: 4, FullBlock: true})
+	require.Equal(t, expectedTd, full.TDs[height])
+
+	// Without the total difficulty and block body, the header is only indexed if allowed
+	t.Run("missing block data", func(t *testing.T) {
+		edb := rawdb.NewMemoryDatabase()
+		header := &types.Header{Number: big.NewInt(0), Root: types.EmptyRootHash, Difficulty: big.NewInt(1)}
+		rawdb.WriteChainConfig(edb, header.Hash(), params.TestChainConfig)
+		rawdb.WriteCanonicalHash(edb, header.Hash(), 0)
+		rawdb.WriteHeader(edb, header)
+
+		_, err := runServiceDB(t, edb, func(service *Service) error {
+			return service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1})
+		})
+		require.ErrorContains(t, err, "total difficulty")
+		require.ErrorContains(t, err, SNAPSHOT_ALLOW_MISSING_TOML)
+
+		data, err := runServiceDB(t, edb, func(service *Service) error {
+			return service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1, AllowMissingBlockData: true})
+		})
+		require.NoError(t, err)
+		require.Zero(t, data.TDs[0].Sign())
+		require.Zero(t, data.Rewards[0].Sign())
+	})
+}
+
+func TestSnapshotStatus(t *testing.T) {
+	config := testConfig(fixture.ChainA.ChainData, fixture.ChainA.Ancient)
+	edb, err := NewLevelDB(config.Eth)
+	require.NoError(t, err)
+	header := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, 1), 1)
+	edb.Close()
+
+	data := doSnapshot(t, fixture.ChainA, SnapshotParams{Height: 1, Workers: 4})
+	status := prom.CurrentStatus()
+	require.Equal(t, "snapshot", status.Kind)
+	require.Equal(t, uint64(1), status.Height)
+	require.Equal(t, header.Hash(), status.Hash)
+	require.Equal(t, header.Root, status.StateRoot)
+	require.False(t, status.Running)
+	require.Empty(t, status.LastError)
+	require.NotNil(t, status.Started)
+	require.Equal(t, uint64(len(data.StateNodes)), status.StateNodes)
+	require.NotEmpty(t, status.Workers)
+	for _, worker := range status.Workers {
+		require.True(t, worker.Done)
+	}
+	require.Equal(t, 100.0, status.Progress)
+
+	// a failed run records its error, as the run at the requested height, whose block is unknown
+	_, err = doSnapshotErr(t, fixture.ChainA, SnapshotParams{Height: 1 << 20, Workers: 4})
+	require.Error(t, err)
+	status = prom.CurrentStatus()
+	require.Equal(t, err.Error(), status.LastError)
+	require.Equal(t, "snapshot", status.Kind)
+	require.Equal(t, uint64(1<<20), status.Height)
+	require.Equal(t, common.Hash{}, status.Hash)
+	require.Equal(t, common.Hash{}, status.StateRoot)
+	require.False(t, status.Running)
+	require.Empty(t, status.Workers)
+}
+
+func TestSnapshotManifest(t *testing.T) {
+	height := uint64(32)
+	var manifest *Manifest
+	idx, err := runService(t, fixture.ChainB, func(service *Service) error {
+		if err := service.CreateSnapshot(SnapshotParams{Height: height, Workers: 4}); err != nil {
+			return err
+		}
+		manifest = service.Manifest("snapshot")
+		return nil
+	})
+	require.NoError(t, err)
+
+	header := idx.Headers[height]
+	require.Equal(t, "snapshot", manifest.Type)
+	require.Equal(t, height, manifest.Range.Start)
+	require.Equal(t, height, manifest.Range.Stop)
+	require.Equal(t, []ManifestBlock{{Height: height, Hash: header.Hash(), StateRoot: header.Root}}, manifest.Blocks)
+
+	var storageNodes int
+	for _, node := range idx.StateNodes {
+		storageNodes += len(node.StorageDiff)
+	}
+	require.Equal(t, uint64(1), manifest.Rows[schema.TableHeader.Name])
+	require.Equal(t, uint64(len(idx.StateNodes)), manifest.Rows[schema.TableStateNode.Name])
+	require.Equal(t, uint64(storageNodes), manifest.Rows[schema.TableStorageNode.Name])
+	// the header IPLD is written with the header
+	require.Equal(t, uint64(len(idx.IPLDs)+1), manifest.Rows[schema.TableIPLDBlock.Name])
+
+	dir := t.TempDir()
+	data := []byte("test output")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "output.csv"), data, 0644))
+	path := filepath.Join(dir, ManifestFileName)
+	// a manifest already in the directory is not listed
+	require.NoError(t, os.WriteFile(path, []byte("{}"), 0644))
+	require.NoError(t, manifest.AddFiles(dir))
+	checksum := sha256.Sum256(data)
+	require.Equal(t, []ManifestFile{
+		{Path: "output.csv", Size: int64(len(data)), SHA256: hex.EncodeToString(checksum[:])},
+	}, manifest.Files)
+	require.NoError(t, manifest.Write(path))
+
+	written, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var decoded Manifest
+	require.NoError(t, json.Unmarshal(written, &decoded))
+	require.Equal(t, manifest.Blocks, decoded.Blocks)
+	require.Equal(t, manifest.Rows, decoded.Rows)
+	require.Equal(t, manifest.Files, decoded.Files)
+}
+
+func TestFilteredSnapshot(t *testing.T) {
+	height := uint64(32)
+	all := doSnapshot(t, fixture.ChainB, SnapshotParams{Height: height, Workers: 4})
+	allLeaves := stateLeaves(all.StateNodes)
+	accounts := make(map[string]*types.StateAccount)
+	maxBalance := new(big.Int)
+	for _, node := range all.StateNodes {
+		account := node.AccountWrapper.Account
+		accounts[common.BytesToHash(node.AccountWrapper.LeafKey).String()] = account
+		if account.Balance.Cmp(maxBalance) > 0 {
+			maxBalance = account.Balance
+		}
+	}
+	emptyCodeHash := crypto.Keccak256([]byte{})
+
+	denied := common.HexToAddress("0x825a6eec09e44Cb0fa19b84353ad0f7858d7F61a")
+	deniedKey := crypto.Keccak256Hash(denied[:]).String()
+	contractCodeHash := common.BytesToHash(accounts[deniedKey].CodeHash)
+
+	cases := []struct {
+		name    string
+		filter  *AccountFilter
+		include func(key string, account *types.StateAccount) bool
+	}{
+		{
+			"deny list",
+			&AccountFilter{DeniedAccounts: []common.Address{denied}},
+			func(key string, _ *types.StateAccount) bool { return key != deniedKey },
+		},
+		{
+			"EOAs only",
+			&AccountFilter{EOAOnly: true},
+			func(_ string, account *types.StateAccount) bool {
+				return bytes.Equal(account.CodeHash, emptyCodeHash)
+			},
+		},
+		{
+			"contracts only",
+			&AccountFilter{ContractsOnly: true},
+			func(_ string, account *types.StateAccount) bool {
+				return !bytes.Equal(account.CodeHash, emptyCodeHash)
+			},
+		},
+		{
+			"minimum balance",
+			&AccountFilter{MinBalance: maxBalance},
+			func(_ string, account *types.StateAccount) bool { return account.Balance.Cmp(maxBalance) >= 0 },
+		},
+		{
+			"code hash",
+			&AccountFilter{CodeHashes: []common.Hash{contractCodeHash}},
+			func(_ string, account *types.StateAccount) bool {
+				return common.BytesToHash(account.CodeHash) == contractCodeHash
+			},
+		},
+		{
+			"max storage slots",
+			&AccountFilter{MaxStorageSlots: 2},
+			func(key string, _ *types.StateAccount) bool { return len(allLeaves[key].storage) <= 2 },
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			expected := make(map[string]stateLeaf)
+			for key, leaf := range allLeaves {
+				if tc.include(key, accounts[key]) {
+					expected[key] = leaf
+				}
+			}
+			require.NotEqual(t, len(allLeaves), len(expected), "filter should exclude some accounts")
+
+			params := SnapshotParams{Height: height, Workers: 4, Filter: tc.filter}
+			var manifest *Manifest
+			data, err := runService(t, fixture.ChainB, func(service *Service) error {
+				if err := service.CreateSnapshot(params); err != nil {
+					return err
+				}
+				manifest = service.Manifest("snapshot")
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, expected, stateLeaves(data.StateNodes))
+			require.Equal(t, uint64(len(expected)), manifest.FilterSummary.Included)
+			var excluded uint64
+			for _, count := range manifest.FilterSummary.Excluded {
+				excluded += count
+			}
+			require.Equal(t, uint64(len(allLeaves)-len(expected)), excluded)
+
+			// The state trie nodes of excluded accounts are still written, but not their storage
+			require.Subset(t, all.IPLDs, data.IPLDs)
+			written := make(map[string]bool)
+			for _, node := range data.IPLDs {
+				written[node.CID] = true
+			}
+			for _, node := range all.IPLDs {
+				c, err := cid.Decode(node.CID)
+				require.NoError(t, err)
+				if c.Type() == ipld.MEthStateTrie {
+					require.True(t, written[node.CID], "missing state trie node %s", node.CID)
+				}
+			}
+			includedRoots := make(map[common.Hash]bool)
+			for key := range expected {
+				includedRoots[accounts[key].Root] = true
+			}
+			for key, account := range accounts {
+				if account.Root == types.EmptyRootHash || includedRoots[account.Root] {
+					continue
+				}
+				root := ipld.Keccak256ToCid(ipld.MEthStorageTrie, account.Root.Bytes()).String()
+				require.False(t, written[root], "storage trie of excluded account %s written", key)
+			}
+			for root := range includedRoots {
+				if root != types.EmptyRootHash {
+					require.True(t, written[ipld.Keccak256ToCid(ipld.MEthStorageTrie, root.Bytes()).String()])
+				}
+			}
+		})
+	}
+
+	t.Run("with watched storage", func(t *testing.T) {
+		watchedStorage, expected := watchedStorageData_chainBblock32()
+		// the slots of the whole storage trie are counted, not only those watched: the account
+		// with five slots is excluded, and that with two included
+		filter := &AccountFilter{MaxStorageSlots: 2}
+		params := SnapshotParams{Height: height, Workers: 4, WatchedStorage: watchedStorage, Filter: filter}
+		data := doSnapshot(t, fixture.ChainB, params)
+		excludedKey := crypto.Keccak256Hash(common.HexToAddress("0x0616F59D291a898e796a1FAD044C5926ed2103eC").Bytes())
+		require.Len(t, data.StateNodes, len(expected.StateNodes)-1)
+		for _, node := range data.StateNodes {
+			require.NotEqual(t, excludedKey.Bytes(), node.AccountWrapper.LeafKey)
+		}
+	})
+
+	t.Run("conflicting predicates", func(t *testing.T) {
+		filter := &AccountFilter{EOAOnly: true, ContractsOnly: true}
+		require.Error(t, filter.Validate())
+	})
+}
+
+func TestSnapshotRange(t *testing.T) {
+	heights := []uint64{30, 31, 32}
+
+	snapshotRange := func(t *testing.T, params SnapshotParams) mocks.IndexerData {
+		data, err := runService(t, fixture.ChainB, func(service *Service) error {
+			return service.CreateSnapshotRange(heights, params)
+		})
+		require.NoError(t, err)
+		for _, height := range heights {
+			require.Contains(t, data.Headers, height)
+		}
+		return data
+	}
+
+	runCase := func(t *testing.T, workers uint) {
+		// Expect the IPLDs of individual snapshots at each height
+		var expected []string
+		expectedCids := make(map[string]struct{})
+		for _, height := range heights {
+			params := SnapshotParams{Height: height, Workers: workers}
+			for _, ipld := range doSnapshot(t, fixture.ChainB, params).IPLDs {
+				expected = append(expected, ipld.CID)
+				expectedCids[ipld.CID] = struct{}{}
+			}
+		}
+
+		t.Run("complete", func(t *testing.T) {
+			data := snapshotRange(t, SnapshotParams{Workers: workers})
+			var cids []string
+			for _, ipld := range data.IPLDs {
+				cids = append(cids, ipld.CID)
+			}
+			require.ElementsMatch(t, expected, cids)
+		})
+
+		t.Run("deduplicated", func(t *testing.T) {
+			data := snapshotRange(t, SnapshotParams{Workers: workers, DedupIPLDs: true})
+			// Each IPLD should be emitted exactly once over the whole range
+			ipldCids := make(map[string]struct{})
+			for _, ipld := range data.IPLDs {
+				require.NotContains(t, ipldCids, ipld.CID, "duplicate IPLD")
+				ipldCids[ipld.CID] = struct{}{}
+			}
+			require.Equal(t, expectedCids, ipldCids)
+		})
+	}
+
+	for _, tc := range subtrieWorkerCases {
+		t.Run(fmt.Sprintf("with %d subtries", tc), func(t *testing.T) { runCase(t, tc) })
+	}
+}
+
+func TestStateDiff(t *testing.T) {
+	from, to := uint64(31), uint64(32)
+
+	runCase := func(t *testing.T, workers uint) {
+		base := doSnapshot(t, fixture.ChainB, SnapshotParams{Height: from, Workers: workers})
+		expected := doSnapshot(t, fixture.ChainB, SnapshotParams{Height: to, Workers: workers})
+
+		params := StateDiffParams{FromHeight: from, ToHeight: to, Workers: workers}
+		diff, err := runService(t, fixture.ChainB, func(service *Service) error {
+			return service.CreateStateDiff(params)
+		})
+		require.NoError(t, err)
+		require.Contains(t, diff.Headers, to)
+
+		// Applying the diff to the base snapshot should yield the snapshot at the later height
+		state := stateLeaves(base.StateNodes)
+		for _, node := range diff.StateNodes {
+			key := common.BytesToHash(node.AccountWrapper.LeafKey).String()
+			if node.Removed {
+				delete(state, key)
+				continue
+			}
+			storage := state[key].storage
+			if storage == nil {
+				storage = make(map[string]string)
+			}
+			for _, slot := range node.StorageDiff {
+				slotKey := common.BytesToHash(slot.LeafKey).String()
+				if slot.Removed {
+					delete(storage, slotKey)
+				} else {
+					storage[slotKey] = slot.CID
+				}
+			}
+			state[key] = stateLeaf{cid: node.AccountWrapper.CID, storage: storage}
+		}
+		require.Equal(t, stateLeaves(expected.StateNodes), state)
+
+		ipldCids := make(map[string]struct{})
+		for _, ipld := range append(base.IPLDs, diff.IPLDs...) {
+			ipldCids[ipld.CID] = struct{}{}
+		}
+		for _, ipld := range expected.IPLDs {
+			require.Contains(t, ipldCids, ipld.CID, "missing IPLD")
+		}
+	}
+
+	for _, tc := range subtrieWorkerCases {
+		t.Run(fmt.Sprintf("with %d subtries", tc), func(t *testing.T) { runCase(t, tc) })
+	}
+}
+
+func TestPathSchemeSnapshot(t *testing.T) {
+	height := uint64(32)
+
+	config := testConfig(fixture.ChainB.ChainData, fixture.ChainB.Ancient)
+	edb, err := NewLevelDB(config.Eth)
+	require.NoError(t, err)
+	defer edb.Close()
+	pdb := copyToPathScheme(t, edb, height, height)
+	require.Equal(t, rawdb.PathScheme, ReadStateScheme(pdb))
+
+	runCase := func(t *testing.T, workers uint) {
+		params := SnapshotParams{Height: height, Workers: workers}
+		expected := doSnapshot(t, fixture.ChainB, params)
+		idx, err := runServiceDB(t, pdb, func(service *Service) error {
+			return service.CreateSnapshot(params)
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, stateLeaves(expected.StateNodes), stateLeaves(idx.StateNodes))
+		expectedCids := make(map[string]struct{})
+		for _, ipld := range expected.IPLDs {
+			expectedCids[ipld.CID] = struct{}{}
+		}
+		ipldCids := make(map[string]struct{})
+		for _, ipld := range idx.IPLDs {
+			ipldCids[ipld.CID] = struct{}{}
+		}
+		require.Equal(t, expectedCids, ipldCids)
+	}
+
+	for _, tc := range subtrieWorkerCases {
+		t.Run(fmt.Sprintf("with %d subtries", tc), func(t *testing.T) { runCase(t, tc) })
+	}
+
+	t.Run("flattened state", func(t *testing.T) {
+		_, err := runServiceDB(t, pdb, func(service *Service) error {
+			return service.CreateSnapshot(SnapshotParams{Height: height - 1, Workers: 1})
+		})
+		require.ErrorContains(t, err, "flattened")
+		require.ErrorContains(t, err, fmt.Sprintf("at height %d", height))
+	})
+
+	// The persisted state lags behind head
+	lagging := copyToPathScheme(t, edb, height-2, height)
+
+	t.Run("state above persisted state", func(t *testing.T) {
+		_, err := runServiceDB(t, lagging, func(service *Service) error {
+			return service.CreateSnapshot(SnapshotParams{Height: height, Workers: 1})
+		})
+		require.ErrorContains(t, err, fmt.Sprintf("at height %d", height-2))
+	})
+
+	t.Run("latest state", func(t *testing.T) {
+		expected := doSnapshot(t, fixture.ChainB, SnapshotParams{Height: height - 2, Workers: 4})
+		data, err := runServiceDB(t, lagging, func(service *Service) error {
+			latest, err := service.LatestHeight()
+			require.NoError(t, err)
+			require.Equal(t, height-2, latest)
+			return service.CreateLatestSnapshot(SnapshotParams{Workers: 4})
+		})
+		require.NoError(t, err)
+		require.Contains(t, data.Headers, height-2)
+		require.NotContains(t, data.Headers, height)
+		require.Equal(t, stateLeaves(expected.StateNodes), stateLeaves(data.StateNodes))
+	})
+}
+
+// TestPathSchemeSharedStorage checks the storage tries of accounts with the same storage root are
+// read from a path-based database, in which each is stored under its own account.
+func TestPathSchemeSharedStorage(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	sdb := state.NewDatabase(edb)
+	statedb, err := state.New(types.EmptyRootHash, sdb, nil)
+	require.NoError(t, err)
+	for i := 0; i < 16; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(i + 1)))
+		statedb.SetBalance(addr, big.NewInt(int64(i+1)))
+		// half of the accounts have the same storage
+		for slot := 0; slot < 8; slot++ {
+			value := big.NewInt(int64(slot + 1))
+			if i%2 == 1 {
+				value.Add(value, big.NewInt(int64(i)))
+			}
+			statedb.SetState(addr, common.BigToHash(big.NewInt(int64(slot))), common.BigToHash(value))
+		}
+	}
+	root, err := statedb.Commit(false)
+	require.NoError(t, err)
+	require.NoError(t, sdb.TrieDB().Commit(root, false))
+
+	header := &types.Header{Number: big.NewInt(0), Root: root, Difficulty: big.NewInt(1)}
+	rawdb.WriteChainConfig(edb, header.Hash(), params.TestChainConfig)
+	rawdb.WriteCanonicalHash(edb, header.Hash(), 0)
+	rawdb.WriteBlock(edb, types.NewBlockWithHeader(header))
+	rawdb.WriteReceipts(edb, header.Hash(), 0, nil)
+	rawdb.WriteTd(edb, header.Hash(), 0, header.Difficulty)
+	rawdb.WriteHeadHeaderHash(edb, header.Hash())
+	pdb := copyToPathScheme(t, edb, 0, 0)
+
+	for _, workers := range []uint{1, 4} {
+		t.Run(fmt.Sprintf("with %d subtries", workers), func(t *testing.T) {
+			snapshot := func(service *Service) error {
+				return service.CreateSnapshot(SnapshotParams{Height: 0, Workers: workers})
+			}
+			expected, err := runServiceDB(t, edb, snapshot)
+			require.NoError(t, err)
+			data, err := runServiceDB(t, pdb, snapshot)
+			require.NoError(t, err)
+			require.Len(t, data.StateNodes, 16)
+			require.Equal(t, stateLeaves(expected.StateNodes), stateLeaves(data.StateNodes))
+		})
+	}
+}
+
 func TestSnapshotRecovery(t *testing.T) {
 	runCase := func(t *testing.T, workers uint, interruptAt uint) {
 		params := SnapshotParams{Height: 1, Workers: workers}
@@ -123,6 +814,202 @@ func TestAccountSelectiveSnapshotRecovery(t *testing.T) {
 	}
 }
 
+func TestCheckpointedSnapshotRecovery(t *testing.T) {
+	config := testConfig(fixture.ChainA.ChainData, fixture.ChainA.Ancient)
+	edb, err := NewLevelDB(config.Eth)
+	require.NoError(t, err)
+	defer edb.Close()
+
+	runCase := func(t *testing.T, workers uint) {
+		params := SnapshotParams{
+			Height:         1,
+			Workers:        workers,
+			CommitInterval: uint64(len(fixture.ChainA_Block1_StateNodeLeafKeys) / 8),
+		}
+		recoveryFile := filepath.Join(t.TempDir(), "recover.csv")
+		// fail the commit of the third segment, losing its nodes
+		idx := mocks.NewTxIndexer(t)
+		idx.FailSubmit = 3
+		service, err := NewSnapshotService(edb, idx, recoveryFile)
+		require.NoError(t, err)
+		require.ErrorContains(t, service.CreateSnapshot(params), "mock submission failure")
+		require.Less(t, len(idx.StateNodes), len(fixture.ChainA_Block1_StateNodeLeafKeys))
+		// the recovery file of the second checkpoint is restored
+		require.FileExists(t, recoveryFile)
+		require.NoFileExists(t, recoveryFile+".checkpoint")
+
+		service, err = NewSnapshotService(edb, idx, recoveryFile)
+		require.NoError(t, err)
+		require.NoError(t, service.CreateSnapshot(params))
+		verify_chainAblock1(t, idx.IndexerData)
+	}
+
+	for _, tc := range subtrieWorkerCases {
+		t.Run(fmt.Sprintf("with %d subtries", tc), func(t *testing.T) { runCase(t, tc) })
+	}
+}
+
+func TestPartitionedSnapshot(t *testing.T) {
+	runCase := func(t *testing.T, count uint64, workers uint) {
+		var all mocks.IndexerData
+		manifests := make([]*Manifest, count)
+		for i := uint64(0); i < count; i++ {
+			partition := &Partition{Index: i, Count: count}
+			params := SnapshotParams{Height: 1, Workers: workers, Partition: partition}
+			idx, err := runService(t, fixture.ChainA, func(service *Service) error {
+				if err := service.CreateSnapshot(params); err != nil {
+					return err
+				}
+				manifests[i] = service.Manifest("snapshot")
+				return nil
+			})
+			require.NoError(t, err)
+			all.StateNodes = append(all.StateNodes, idx.StateNodes...)
+			all.IPLDs = append(all.IPLDs, idx.IPLDs...)
+			manifests[i].Partition = partition
+		}
+		// the partitions are disjoint and complete
+		verify_chainAblock1(t, all)
+
+		merged, err := MergePartitions(manifests)
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(all.StateNodes)), merged.Rows[schema.TableStateNode.Name])
+		if count > 1 {
+			_, err = MergePartitions(manifests[1:])
+			require.Error(t, err, "missing partition")
+			manifests[1].Blocks[0].StateRoot = common.Hash{}
+			_, err = MergePartitions(manifests)
+			require.Error(t, err, "different state root")
+		}
+	}
+
+	for _, count := range []uint64{1, 3, 16} {
+		for _, workers := range []uint{1, 4} {
+			t.Run(fmt.Sprintf("%d partitions with %d workers", count, workers),
+				func(t *testing.T) { runCase(t, count, workers) })
+		}
+	}
+}
+
+func TestTrieSizeEstimate(t *testing.T) {
+	runCase := func(t *testing.T, chain *chaindata.Paths, height uint64) {
+		config := testConfig(chain.ChainData, chain.Ancient)
+		edb, err := NewLevelDB(config.Eth)
+		require.NoError(t, err)
+		defer edb.Close()
+
+		header := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, height), height)
+		tr, err := state.NewDatabase(edb).OpenTrie(header.Root)
+		require.NoError(t, err)
+		var leaves int
+		it := tr.NodeIterator(nil)
+		for it.Next(true) {
+			if it.Leaf() {
+				leaves++
+			}
+		}
+		require.NoError(t, it.Error())
+		require.NotZero(t, leaves)
+
+		// with every stratum sampled, the estimate is within three standard errors
+		params := prom.EstimateParams{
+			Depth:      0,
+			ExactLimit: 0,
+			Probes:     4096,
+			Rand:       rand.New(rand.NewSource(1)),
+		}
+		size, err := prom.EstimateTrieSize(tr.NodeIterator, params)
+		require.NoError(t, err)
+		require.False(t, size.Exact())
+		require.NotZero(t, size.StdErr())
+		require.InDelta(t, float64(leaves), size.Total(), 3*size.StdErr(), "estimate of %d leaves", leaves)
+
+		// progress measured against the estimate only increases, and reaches 100% at the end
+		tracker := prom.NewTracker(filepath.Join(t.TempDir(), "recover.csv"), 4)
+		defer tracker.CloseAndSave()
+		tracker.SetSize(size)
+		tracker.SetRanges([]prom.PathRange{
+			{End: []byte{0x4}},
+			{Start: []byte{0x4}, End: []byte{0x8}},
+			{Start: []byte{0x8}, End: []byte{0xc}},
+			{Start: []byte{0xc}},
+		})
+		iters, _, err := tracker.Restore(tr.NodeIterator)
+		require.NoError(t, err)
+		require.Len(t, iters, 4)
+		for i, it := range iters {
+			last := 0.0
+			for it.Next(true) {
+				workers, _ := tracker.Progress()
+				require.GreaterOrEqual(t, workers[i], last)
+				require.LessOrEqual(t, workers[i], 100.0)
+				last = workers[i]
+			}
+			require.NoError(t, it.Error())
+		}
+		workers, overall := tracker.Progress()
+		require.Equal(t, []float64{100, 100, 100, 100}, workers)
+		require.Equal(t, 100.0, overall)
+	}
+
+	t.Run("chain A", func(t *testing.T) { runCase(t, fixture.ChainA, 1) })
+	t.Run("chain B", func(t *testing.T) { runCase(t, fixture.ChainB, 32) })
+}
+
+func TestSnapshotRecoveryMismatch(t *testing.T) {
+	config := testConfig(fixture.ChainA.ChainData, fixture.ChainA.Ancient)
+	edb, err := NewLevelDB(config.Eth)
+	require.NoError(t, err)
+	defer edb.Close()
+
+	params := SnapshotParams{Height: 1, Workers: 4}
+	recoveryFile := filepath.Join(t.TempDir(), "recover.csv")
+	indexer := &mocks.InterruptingIndexer{
+		Indexer:        mocks.NewIndexer(t),
+		InterruptAfter: uint(len(fixture.ChainA_Block1_StateNodeLeafKeys) / 2),
+	}
+	service, err := NewSnapshotService(edb, indexer, recoveryFile)
+	require.NoError(t, err)
+	require.Error(t, service.CreateSnapshot(params))
+
+	meta, err := ReadRecoveryMeta(recoveryFile)
+	require.NoError(t, err)
+	require.Equal(t, "snapshot", meta.Kind)
+	require.Equal(t, uint64(1), meta.Height)
+	require.Equal(t, params.Workers, meta.Workers)
+
+	// a run with different parameters refuses the recovery file
+	mismatched := params
+	mismatched.Workers = 2
+	for field, other := range map[string]SnapshotParams{
+		"workers":        mismatched,
+		"account filter": {Height: 1, Workers: 4, Filter: &AccountFilter{EOAOnly: true}},
+		"watched storage": {Height: 1, Workers: 4, WatchedStorage: map[common.Address][]common.Hash{
+			common.HexToAddress("0x01"): {common.HexToHash("0x02")},
+		}},
+	} {
+		service, err = NewSnapshotService(edb, mocks.NewIndexer(t), recoveryFile)
+		require.NoError(t, err)
+		require.ErrorContains(t, service.CreateSnapshot(other), field)
+		require.FileExists(t, recoveryFile)
+	}
+
+	// and so does a run without metadata
+	data, err := os.ReadFile(recoveryFile + RecoveryMetaSuffix)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(recoveryFile+RecoveryMetaSuffix))
+	require.ErrorContains(t, service.CreateSnapshot(params), "no metadata")
+	require.NoError(t, os.WriteFile(recoveryFile+RecoveryMetaSuffix, data, 0644))
+
+	// unless it is discarded, when the run starts over
+	idx := mocks.NewIndexer(t)
+	service, err = NewSnapshotService(edb, idx, recoveryFile)
+	require.NoError(t, err)
+	service.SetRecoveryOptions("", true)
+	require.NoError(t, service.CreateSnapshot(mismatched))
+	verify_chainAblock1(t, idx.IndexerData)
+}
+
 func verify_chainAblock1(t *testing.T, data mocks.IndexerData) {
 	// Extract indexed keys and sort them for comparison
 	var indexedStateKeys []string
@@ -175,6 +1062,85 @@ func watchedAccountData_chainBblock32() ([]common.Address, selectiveData) {
 	return watchedAddresses, expected
 }
 
+func watchedStorageData_chainBblock32() (map[common.Address][]common.Hash, selectiveData) {
+	watchedStorage := map[common.Address][]common.Hash{
+		// hash 0xcabc5edb305583e33f66322ceee43088aa99277da772feb5053512d03a0a702b
+		common.HexToAddress("0x825a6eec09e44Cb0fa19b84353ad0f7858d7F61a"): {
+			common.HexToHash("0x0"),
+		},
+		// hash 0x33153abc667e873b6036c8a46bdd847e2ade3f89b9331c78ef2553fea194c50d
+		common.HexToAddress("0x0616F59D291a898e796a1FAD044C5926ed2103eC"): {
+			common.HexToHash("0x2"),
+			common.HexToHash("0x3"),
+		},
+	}
+	var expected selectiveData
+	expected.StateNodes = make(map[string]*models.StateNodeModel)
+	for _, index := range []int{0, 4} {
+		node := &fixture.ChainB_Block32_StateNodes[index]
+		expected.StateNodes[node.StateKey] = node
+	}
+
+	// Only the leaves of the watched slots are expected
+	expectedStorageNodeIndexes := map[string][]int{
+		"0xcabc5edb305583e33f66322ceee43088aa99277da772feb5053512d03a0a702b": {9},
+		"0x33153abc667e873b6036c8a46bdd847e2ade3f89b9331c78ef2553fea194c50d": {0, 6},
+	}
+	expected.StorageNodes = make(map[string]map[string]*models.StorageNodeModel)
+	for leafKey, indexes := range expectedStorageNodeIndexes {
+		storageNodes := make(map[string]*models.StorageNodeModel)
+		for _, index := range indexes {
+			node := &fixture.ChainB_Block32_StorageNodes[index]
+			storageNodes[node.StorageKey] = node
+		}
+		expected.StorageNodes[leafKey] = storageNodes
+	}
+	return watchedStorage, expected
+}
+
+// verifyProofs checks that the emitted IPLDs include the proof of each indexed state and storage leaf
+func verifyProofs(t *testing.T, data mocks.IndexerData, height uint64) {
+	proofDB := rawdb.NewMemoryDatabase()
+	for _, ipld := range data.IPLDs {
+		require.NoError(t, proofDB.Put(crypto.Keccak256(ipld.Content), ipld.Content))
+	}
+	root := data.Headers[height].Root
+	for _, stateNode := range data.StateNodes {
+		leafKey := stateNode.AccountWrapper.LeafKey
+		value, err := trie.VerifyProof(root, leafKey, proofDB)
+		require.NoError(t, err, "invalid account proof")
+		expected, err := rlp.EncodeToBytes(stateNode.AccountWrapper.Account)
+		require.NoError(t, err)
+		require.Equal(t, expected, value)
+
+		for _, storageNode := range stateNode.StorageDiff {
+			value, err := trie.VerifyProof(stateNode.AccountWrapper.Account.Root, storageNode.LeafKey, proofDB)
+			require.NoError(t, err, "invalid storage proof")
+			require.Equal(t, storageNode.Value, value)
+		}
+	}
+}
+
+// verifyCode checks that the code of each indexed contract is emitted exactly once
+func verifyCode(t *testing.T, data mocks.IndexerData) {
+	emitted := make(map[string][][]byte)
+	for _, block := range data.IPLDs {
+		emitted[block.CID] = append(emitted[block.CID], block.Content)
+	}
+	var contracts int
+	for _, stateNode := range data.StateNodes {
+		codeHash := stateNode.AccountWrapper.Account.CodeHash
+		if bytes.Equal(codeHash, types.EmptyCodeHash.Bytes()) {
+			continue
+		}
+		contracts++
+		code := emitted[ipld.Keccak256ToCid(ipld.RawBinary, codeHash).String()]
+		require.Len(t, code, 1, "code of contract should be emitted once")
+		require.Equal(t, codeHash, crypto.Keccak256(code[0]))
+	}
+	require.NotZero(t, contracts, "fixture should include contracts")
+}
+
 func (expected selectiveData) verify(t *testing.T, data mocks.IndexerData) {
 	// check that all indexed nodes are expected and correct
 	indexedStateKeys := make(map[string]struct{})
@@ -210,20 +1176,37 @@ func (expected selectiveData) verify(t *testing.T, data mocks.IndexerData) {
 }
 
 func doSnapshot(t *testing.T, chain *chaindata.Paths, params SnapshotParams) mocks.IndexerData {
+	data, err := doSnapshotErr(t, chain, params)
+	require.NoError(t, err)
+	return data
+}
+
+func doSnapshotErr(t *testing.T, chain *chaindata.Paths, params SnapshotParams) (mocks.IndexerData, error) {
+	return runService(t, chain, func(service *Service) error {
+		return service.CreateSnapshot(params)
+	})
+}
+
+// runService runs a snapshot service over the chain with a mock indexer, and returns the data
+// indexed by run.
+func runService(t *testing.T, chain *chaindata.Paths, run func(*Service) error) (mocks.IndexerData, error) {
 	chainDataPath, ancientDataPath := chain.ChainData, chain.Ancient
 	config := testConfig(chainDataPath, ancientDataPath)
 	edb, err := NewLevelDB(config.Eth)
 	require.NoError(t, err)
 	defer edb.Close()
+	return runServiceDB(t, edb, run)
+}
 
+// runServiceDB runs a snapshot service over an open database with a mock indexer.
+func runServiceDB(t *testing.T, edb ethdb.Database, run func(*Service) error) (mocks.IndexerData, error) {
 	idx := mocks.NewIndexer(t)
 	recovery := filepath.Join(t.TempDir(), "recover.csv")
 	service, err := NewSnapshotService(edb, idx, recovery)
 	require.NoError(t, err)
 
-	err = service.CreateSnapshot(params)
-	require.NoError(t, err)
-	return idx.IndexerData
+	err = run(service)
+	return idx.IndexerData, err
 }
 
 func doSnapshotWithRecovery(
@@ -264,6 +1247,78 @@ func doSnapshotWithRecovery(
 	return recoveryIndexer.IndexerData
 }
 
+// copyToPathScheme copies the blocks up to head and the state at the given height into an
+// in-memory database, with trie nodes stored by path as in a node using the path-based state
+// scheme, which persists the state some blocks behind head.
+func copyToPathScheme(t *testing.T, edb ethdb.Database, height, head uint64) ethdb.Database {
+	pdb := rawdb.NewMemoryDatabase()
+	genesis := rawdb.ReadCanonicalHash(edb, 0)
+	rawdb.WriteChainConfig(pdb, genesis, rawdb.ReadChainConfig(edb, genesis))
+	for h := uint64(0); h <= head; h++ {
+		hash := rawdb.ReadCanonicalHash(edb, h)
+		rawdb.WriteCanonicalHash(pdb, hash, h)
+		rawdb.WriteBlock(pdb, rawdb.ReadBlock(edb, hash, h))
+		rawdb.WriteReceipts(pdb, hash, h, rawdb.ReadRawReceipts(edb, hash, h))
+		rawdb.WriteTd(pdb, hash, h, rawdb.ReadTd(edb, hash, h))
+		if h == head {
+			rawdb.WriteHeadHeaderHash(pdb, hash)
+		}
+	}
+	header := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, height), height)
+
+	sdb := state.NewDatabase(edb)
+	tr, err := sdb.OpenTrie(header.Root)
+	require.NoError(t, err)
+	it := tr.NodeIterator(nil)
+	for it.Next(true) {
+		if it.Hash() != (common.Hash{}) {
+			rawdb.WriteAccountTrieNode(pdb, it.Path(), it.NodeBlob())
+		}
+		if !it.Leaf() {
+			continue
+		}
+		var account types.StateAccount
+		require.NoError(t, rlp.DecodeBytes(it.LeafBlob(), &account))
+		if code := rawdb.ReadCode(edb, common.BytesToHash(account.CodeHash)); len(code) != 0 {
+			rawdb.WriteCode(pdb, common.BytesToHash(account.CodeHash), code)
+		}
+		if account.Root == types.EmptyRootHash {
+			continue
+		}
+		owner := common.BytesToHash(it.LeafKey())
+		str, err := sdb.OpenStorageTrie(header.Root, owner, account.Root)
+		require.NoError(t, err)
+		sit := str.NodeIterator(nil)
+		for sit.Next(true) {
+			if sit.Hash() != (common.Hash{}) {
+				rawdb.WriteStorageTrieNode(pdb, owner, sit.Path(), sit.NodeBlob())
+			}
+		}
+		require.NoError(t, sit.Error())
+	}
+	require.NoError(t, it.Error())
+	return pdb
+}
+
+type stateLeaf struct {
+	cid     string
+	storage map[string]string
+}
+
+// stateLeaves maps the state leaf keys of indexed nodes to their CIDs and storage leaf CIDs
+func stateLeaves(nodes []sdtypes.StateLeafNode) map[string]stateLeaf {
+	ret := make(map[string]stateLeaf)
+	for _, node := range nodes {
+		storage := make(map[string]string)
+		for _, slot := range node.StorageDiff {
+			storage[common.BytesToHash(slot.LeafKey).String()] = slot.CID
+		}
+		key := common.BytesToHash(node.AccountWrapper.LeafKey).String()
+		ret[key] = stateLeaf{cid: node.AccountWrapper.CID, storage: storage}
+	}
+	return ret
+}
+
 func sliceToSet[T comparable](slice []T) map[T]struct{} {
 	set := make(map[T]struct{})
 	for _, v := range slice {
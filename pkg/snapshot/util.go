@@ -1,76 +1,130 @@
 package snapshot
 
 import (
-	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
 )
 
-// Estimate the number of iterations necessary to step from start to end.
-func estimateSteps(start []byte, end []byte, depth int) uint64 {
-	// We see paths in several forms (nil, 0600, 06, etc.). We need to adjust them to a comparable form.
-	// For nil, start and end indicate the extremes of 0x0 and 0x10.  For differences in depth, we often see a
-	// start/end range on a bounded iterator specified like 0500:0600, while the value returned by it.Path() may
-	// be shorter, like 06.  Since our goal is to estimate how many steps it would take to move from start to end,
-	// we want to perform the comparison at a stable depth, since to move from 05 to 06 is only 1 step, but
-	// to move from 0500:06 is 16.
-	normalizePathRange := func(start []byte, end []byte, depth int) ([]byte, []byte) {
-		if 0 == len(start) {
-			start = []byte{0x0}
-		}
-		if 0 == len(end) {
-			end = []byte{0x10}
-		}
-		normalizedStart := make([]byte, depth)
-		normalizedEnd := make([]byte, depth)
-		for i := 0; i < depth; i++ {
-			if i < len(start) {
-				normalizedStart[i] = start[i]
-			}
-			if i < len(end) {
-				normalizedEnd[i] = end[i]
-			}
+// HeightRange returns the heights from start to stop (inclusive) at the given step.
+func HeightRange(start, stop, step uint64) ([]uint64, error) {
+	if step == 0 {
+		return nil, fmt.Errorf("height step must be positive")
+	}
+	if start > stop {
+		return nil, fmt.Errorf("start height %d is greater than stop height %d", start, stop)
+	}
+	var heights []uint64
+	for height := start; height <= stop; height += step {
+		heights = append(heights, height)
+		// guard against overflow at the top of the range
+		if stop-height < step {
+			break
 		}
-		return normalizedStart, normalizedEnd
 	}
+	return heights, nil
+}
 
-	// We have no need to handle negative exponents, so uints are fine.
-	pow := func(x uint64, y uint) uint64 {
-		if 0 == y {
-			return 1
-		}
-		ret := x
-		for i := uint(0); i < y; i++ {
-			ret *= x
-		}
-		return x
+// rangeRecoveryFile derives the recovery file for a single height of a range snapshot, following
+// the "<height>_<name>" convention used for default recovery files.
+func rangeRecoveryFile(base string, height uint64) string {
+	dir, name := filepath.Split(base)
+	return filepath.Join(dir, fmt.Sprintf("%d_%s", height, name))
+}
+
+// cidSet is a concurrency-safe set of IPLD CIDs.
+type cidSet struct {
+	sync.Mutex
+	set map[string]struct{}
+}
+
+func newCIDSet() *cidSet {
+	return &cidSet{set: make(map[string]struct{})}
+}
+
+// add inserts a CID, and returns whether it was not already present.
+func (s *cidSet) add(cid string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, has := s.set[cid]; has {
+		return false
 	}
+	s.set[cid] = struct{}{}
+	return true
+}
 
-	// Fix the paths.
-	start, end = normalizePathRange(start, end, depth)
+// has returns whether the CID is present.
+func (s *cidSet) has(cid string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, has := s.set[cid]
+	return has
+}
+
+// diskCIDSet is a concurrency-safe set of IPLD CIDs kept in a temporary database on disk, for sets
+// too large to hold in memory.
+type diskCIDSet struct {
+	sync.Mutex
+	dir string
+	db  ethdb.Database
+}
 
-	// No negative distances, if the start is already >= end, the distance is 0.
-	if bytes.Compare(start, end) >= 0 {
-		return 0
+func newDiskCIDSet() (*diskCIDSet, error) {
+	dir, err := os.MkdirTemp("", "ipld-eth-state-snapshot-cids-")
+	if err != nil {
+		return nil, err
+	}
+	db, err := rawdb.NewLevelDBDatabase(dir, 64, 64, "", false)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
 	}
+	return &diskCIDSet{dir: dir, db: db}, nil
+}
 
-	// Subtract each component, right to left, carrying over if necessary.
-	difference := make([]byte, len(start))
-	var carry byte = 0
-	for i := len(start) - 1; i >= 0; i-- {
-		result := end[i] - start[i] - carry
-		if result > 0xf && i > 0 {
-			result &= 0xf
-			carry = 1
-		} else {
-			carry = 0
-		}
-		difference[i] = result
+// add inserts a CID, and returns whether it was not already present.
+func (s *diskCIDSet) add(cid string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	key := []byte(cid)
+	if has, err := s.db.Has(key); err != nil || has {
+		return false, err
 	}
+	return true, s.db.Put(key, []byte{})
+}
 
-	// Calculate the result.
-	var ret uint64 = 0
-	for i := 0; i < len(difference); i++ {
-		ret += uint64(difference[i]) * pow(16, uint(len(difference)-i-1))
+// close closes and removes the database.
+func (s *diskCIDSet) close() error {
+	err := s.db.Close()
+	if rerr := os.RemoveAll(s.dir); err == nil {
+		err = rerr
 	}
+	return err
+}
+
+// proofList collects the nodes of a Merkle proof, in order from the root.
+type proofList [][]byte
+
+func (l *proofList) Put(key []byte, value []byte) error {
+	*l = append(*l, value)
+	return nil
+}
 
-	return ret
+func (l *proofList) Delete(key []byte) error {
+	panic("not supported")
+}
+
+// leafCID returns the CID of the last node of the proof, which holds the leaf (it is the leaf
+// itself, unless the leaf is small enough to be embedded in its parent).
+func (l proofList) leafCID(codec uint64) string {
+	if len(l) == 0 {
+		return ""
+	}
+	return ipld.Keccak256ToCid(codec, crypto.Keccak256(l[len(l)-1])).String()
 }
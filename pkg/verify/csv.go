@@ -0,0 +1,192 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package verify
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/output"
+)
+
+var (
+	blockPrefix       = []byte("verify-block-")
+	heightBlockPrefix = []byte("verify-height-block-")
+)
+
+// CSVSource reads the CSV output of file mode snapshots. The IPLD blocks are loaded into a
+// key-value store, so they can be looked up by CID.
+type CSVSource struct {
+	dir    string
+	height uint64
+	store  ethdb.KeyValueStore
+}
+
+var _ Source = (*CSVSource)(nil)
+
+// NewCSVSource loads the IPLD blocks in the output directory into the store, recording which are
+// at the height.
+func NewCSVSource(dir string, height uint64, store ethdb.KeyValueStore) (*CSVSource, error) {
+	s := &CSVSource{dir: dir, height: height, store: store}
+	var count int
+	batch := store.NewBatch()
+	err := s.forEachRow(&schema.TableIPLDBlock, func(row map[string]string) error {
+		number, err := strconv.ParseUint(row["block_number"], 10, 64)
+		if err != nil {
+			return err
+		}
+		data, err := decodeBytea(row["data"])
+		if err != nil {
+			return err
+		}
+		key := []byte(row["key"])
+		if err := batch.Put(prefixed(blockPrefix, key), data); err != nil {
+			return err
+		}
+		if number == height {
+			if err := batch.Put(prefixed(heightBlockPrefix, key), nil); err != nil {
+				return err
+			}
+		}
+		count++
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := batch.Write(); err != nil {
+		return nil, err
+	}
+	log.WithField("blocks", count).Infof("Loaded IPLD blocks from %s", dir)
+	return s, nil
+}
+
+func (s *CSVSource) StateRoot(height uint64) (common.Hash, error) {
+	roots := make(map[string]struct{})
+	want := strconv.FormatUint(height, 10)
+	err := s.forEachRow(&schema.TableHeader, func(row map[string]string) error {
+		if row["block_number"] == want {
+			roots[row["state_root"]] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	switch len(roots) {
+	case 0:
+		return common.Hash{}, fmt.Errorf("no header at height %d", height)
+	case 1:
+		for root := range roots {
+			return common.HexToHash(root), nil
+		}
+	}
+	return common.Hash{}, fmt.Errorf("headers with differing state roots at height %d", height)
+}
+
+func (s *CSVSource) Block(key string) ([]byte, error) {
+	dbKey := prefixed(blockPrefix, []byte(key))
+	if has, err := s.store.Has(dbKey); err != nil || !has {
+		return nil, err
+	}
+	data, err := s.store.Get(dbKey)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
+
+func (s *CSVSource) ForEachBlock(height uint64, fn func(key string) error) error {
+	if height != s.height {
+		return fmt.Errorf("blocks were loaded for height %d, not %d", s.height, height)
+	}
+	it := s.store.NewIterator(heightBlockPrefix, nil)
+	defer it.Release()
+	for it.Next() {
+		if err := fn(string(it.Key()[len(heightBlockPrefix):])); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// forEachRow calls fn with each row of the table's CSV files, keyed by column name.
+func (s *CSVSource) forEachRow(table *schema.Table, fn func(map[string]string) error) error {
+	files, err := output.OutputFiles(s.dir, table)
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		if err := readCSV(path, table, fn); err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func readCSV(path string, table *schema.Table, fn func(map[string]string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = len(table.Columns)
+	row := make(map[string]string, len(table.Columns))
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, col := range table.Columns {
+			row[col.Name] = record[i]
+		}
+		if err := fn(row); err != nil {
+			line, _ := r.FieldPos(0)
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+func decodeBytea(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, `\x`) {
+		return nil, errors.New(`invalid bytea, missing \x prefix`)
+	}
+	return hex.DecodeString(s[2:])
+}
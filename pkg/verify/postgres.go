@@ -0,0 +1,109 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/database/sql/postgres"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	stateRootPgStr = `SELECT DISTINCT state_root FROM eth.header_cids WHERE block_number = $1`
+	blockPgStr     = `SELECT data FROM ipld.blocks WHERE key = $1 LIMIT 1`
+	blockKeysPgStr = `SELECT key FROM ipld.blocks WHERE block_number = $1`
+)
+
+// PostgresSource reads snapshot output from an ipld-eth-db database.
+type PostgresSource struct {
+	ctx  context.Context
+	pool *pgxpool.Pool
+}
+
+var _ Source = (*PostgresSource)(nil)
+
+// NewPostgresSource connects to the database.
+func NewPostgresSource(ctx context.Context, config postgres.Config) (*PostgresSource, error) {
+	pool, err := pgxpool.Connect(ctx, config.DbConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return &PostgresSource{ctx: ctx, pool: pool}, nil
+}
+
+func (s *PostgresSource) StateRoot(height uint64) (common.Hash, error) {
+	rows, err := s.pool.Query(s.ctx, stateRootPgStr, height)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	defer rows.Close()
+	var roots []string
+	for rows.Next() {
+		var root string
+		if err := rows.Scan(&root); err != nil {
+			return common.Hash{}, err
+		}
+		roots = append(roots, root)
+	}
+	if err := rows.Err(); err != nil {
+		return common.Hash{}, err
+	}
+	switch len(roots) {
+	case 0:
+		return common.Hash{}, fmt.Errorf("no header at height %d", height)
+	case 1:
+		return common.HexToHash(roots[0]), nil
+	default:
+		return common.Hash{}, fmt.Errorf("headers with differing state roots at height %d: %v", height, roots)
+	}
+}
+
+func (s *PostgresSource) Block(key string) ([]byte, error) {
+	var data []byte
+	err := s.pool.QueryRow(s.ctx, blockPgStr, key).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *PostgresSource) ForEachBlock(height uint64, fn func(key string) error) error {
+	rows, err := s.pool.Query(s.ctx, blockKeysPgStr, height)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Close closes the connection pool.
+func (s *PostgresSource) Close() {
+	s.pool.Close()
+}
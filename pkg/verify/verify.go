@@ -0,0 +1,272 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package verify checks the completeness of snapshot output by rebuilding the state from it.
+package verify
+
+import (
+	"fmt"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ipfs/go-cid"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	visitedPrefix     = []byte("verify-visited-")
+	storageRootPrefix = []byte("verify-storage-root-")
+)
+
+// Source provides the snapshot output to verify.
+type Source interface {
+	// StateRoot returns the state root of the header at the height.
+	StateRoot(height uint64) (common.Hash, error)
+	// Block returns the data of the IPLD block with the CID key, or nil if there is none.
+	Block(key string) ([]byte, error)
+	// ForEachBlock calls fn with the key of each IPLD block at the height.
+	ForEachBlock(height uint64, fn func(key string) error) error
+}
+
+// Result is the outcome of a verification.
+type Result struct {
+	Height    uint64
+	StateRoot common.Hash
+	// ComputedRoot is the root of the state trie rebuilt from the leaves found
+	ComputedRoot common.Hash
+	// Missing are the CIDs of trie nodes which are referenced but not present. A block whose data
+	// does not hash to its CID is also considered missing.
+	Missing []string
+	// Dangling are the CIDs of trie node blocks at the height which are not part of the state
+	Dangling []string
+	// BadStorageRoots are the storage roots of accounts whose rebuilt trie did not match
+	BadStorageRoots []common.Hash
+
+	StateNodes   uint64
+	StorageNodes uint64
+	Accounts     uint64
+}
+
+// OK returns whether the output is complete and consistent.
+func (r *Result) OK() bool {
+	return r.ComputedRoot == r.StateRoot && len(r.Missing) == 0 && len(r.Dangling) == 0 &&
+		len(r.BadStorageRoots) == 0
+}
+
+// Verifier rebuilds the state trie and storage tries of a snapshot from its IPLD blocks.
+type Verifier struct {
+	source Source
+	// visited records the trie nodes and storage tries reached from the state root
+	visited ethdb.KeyValueStore
+}
+
+// NewVerifier returns a verifier reading from source. The visited store is used to track which
+// nodes are reached, as these may not fit in memory; it should be empty.
+func NewVerifier(source Source, visited ethdb.KeyValueStore) *Verifier {
+	return &Verifier{source: source, visited: visited}
+}
+
+// Verify walks the state trie at the height and each storage trie from their roots, recomputing
+// each root from the leaves found, then lists any trie node blocks at the height which were not
+// reached.
+func (v *Verifier) Verify(height uint64) (*Result, error) {
+	root, err := v.source.StateRoot(height)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Height: height, StateRoot: root}
+	log.WithField("height", height).WithField("root", root).Info("Verifying state trie")
+
+	stateTrie := trie.NewStackTrie(nil)
+	onLeaf := func(key, value []byte) error {
+		res.Accounts++
+		if err := stateTrie.Update(key, value); err != nil {
+			return err
+		}
+		var account types.StateAccount
+		if err := rlp.DecodeBytes(value, &account); err != nil {
+			return fmt.Errorf("invalid account %x: %w", key, err)
+		}
+		return v.verifyStorage(account.Root, res)
+	}
+	if root != types.EmptyRootHash {
+		if err := v.walk(ipld.MEthStateTrie, root, nil, onLeaf, res, &res.StateNodes); err != nil {
+			return nil, err
+		}
+	}
+	res.ComputedRoot = stateTrie.Hash()
+
+	err = v.source.ForEachBlock(height, func(key string) error {
+		c, err := cid.Decode(key)
+		if err != nil {
+			return fmt.Errorf("invalid block key %s: %w", key, err)
+		}
+		if c.Type() != ipld.MEthStateTrie && c.Type() != ipld.MEthStorageTrie {
+			return nil
+		}
+		visited, err := v.visited.Has(prefixed(visitedPrefix, []byte(key)))
+		if err != nil {
+			return err
+		}
+		if !visited {
+			res.Dangling = append(res.Dangling, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// verifyStorage walks the storage trie with the root, if it has not been already.
+func (v *Verifier) verifyStorage(root common.Hash, res *Result) error {
+	if root == types.EmptyRootHash {
+		return nil
+	}
+	key := prefixed(storageRootPrefix, root.Bytes())
+	if done, err := v.visited.Has(key); err != nil || done {
+		return err
+	}
+	if err := v.visited.Put(key, nil); err != nil {
+		return err
+	}
+
+	storageTrie := trie.NewStackTrie(nil)
+	onLeaf := func(key, value []byte) error {
+		return storageTrie.Update(key, value)
+	}
+	missing := len(res.Missing)
+	if err := v.walk(ipld.MEthStorageTrie, root, nil, onLeaf, res, &res.StorageNodes); err != nil {
+		return err
+	}
+	// Missing nodes are already reported
+	if len(res.Missing) == missing && storageTrie.Hash() != root {
+		res.BadStorageRoots = append(res.BadStorageRoots, root)
+	}
+	return nil
+}
+
+// walk fetches the node with the hash and visits it, recording it if it is missing.
+func (v *Verifier) walk(codec uint64, hash common.Hash, path []byte, onLeaf func(key, value []byte) error,
+	res *Result, count *uint64) error {
+	key := ipld.Keccak256ToCid(codec, hash.Bytes()).String()
+	data, err := v.source.Block(key)
+	if err != nil {
+		return err
+	}
+	if data == nil || crypto.Keccak256Hash(data) != hash {
+		res.Missing = append(res.Missing, key)
+		return nil
+	}
+	*count++
+	if err := v.visited.Put(prefixed(visitedPrefix, []byte(key)), nil); err != nil {
+		return err
+	}
+	return v.visit(codec, data, path, onLeaf, res, count)
+}
+
+// visit decodes a trie node and walks its children in key order, passing each leaf to onLeaf.
+func (v *Verifier) visit(codec uint64, data []byte, path []byte, onLeaf func(key, value []byte) error,
+	res *Result, count *uint64) error {
+	var elems []rlp.RawValue
+	if err := rlp.DecodeBytes(data, &elems); err != nil {
+		return fmt.Errorf("invalid trie node at path %x: %w", path, err)
+	}
+	switch len(elems) {
+	case 17:
+		for i := 0; i < 16; i++ {
+			if err := v.child(codec, elems[i], append(path, byte(i)), onLeaf, res, count); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 2:
+		encodedKey, _, err := rlp.SplitString(elems[0])
+		if err != nil {
+			return err
+		}
+		nibbles, leaf := compactToHex(encodedKey)
+		path = append(path, nibbles...)
+		if !leaf {
+			return v.child(codec, elems[1], path, onLeaf, res, count)
+		}
+		value, _, err := rlp.SplitString(elems[1])
+		if err != nil {
+			return err
+		}
+		if len(path)%2 != 0 {
+			return fmt.Errorf("invalid leaf path %x", path)
+		}
+		return onLeaf(hexToKey(path), value)
+	default:
+		return fmt.Errorf("invalid trie node at path %x: %d elements", path, len(elems))
+	}
+}
+
+// child visits a child reference, which is either a hash, empty, or an embedded node.
+func (v *Verifier) child(codec uint64, ref rlp.RawValue, path []byte, onLeaf func(key, value []byte) error,
+	res *Result, count *uint64) error {
+	// copy the path, as it is appended to by siblings
+	path = append([]byte(nil), path...)
+	kind, content, _, err := rlp.Split(ref)
+	if err != nil {
+		return err
+	}
+	switch {
+	case kind == rlp.List:
+		return v.visit(codec, ref, path, onLeaf, res, count)
+	case len(content) == 0:
+		return nil
+	case len(content) == common.HashLength:
+		return v.walk(codec, common.BytesToHash(content), path, onLeaf, res, count)
+	default:
+		return fmt.Errorf("invalid child reference at path %x", path)
+	}
+}
+
+func prefixed(prefix, key []byte) []byte {
+	return append(append([]byte(nil), prefix...), key...)
+}
+
+// compactToHex decodes a hex-prefix encoded key to nibbles, and whether it is a leaf key.
+func compactToHex(compact []byte) ([]byte, bool) {
+	if len(compact) == 0 {
+		return nil, false
+	}
+	flag := compact[0] >> 4
+	var nibbles []byte
+	if flag&1 != 0 {
+		nibbles = append(nibbles, compact[0]&0x0f)
+	}
+	for _, b := range compact[1:] {
+		nibbles = append(nibbles, b>>4, b&0x0f)
+	}
+	return nibbles, flag&2 != 0
+}
+
+// hexToKey packs an even number of nibbles into bytes.
+func hexToKey(nibbles []byte) []byte {
+	key := make([]byte, len(nibbles)/2)
+	for i := range key {
+		key[i] = nibbles[2*i]<<4 | nibbles[2*i+1]
+	}
+	return key
+}
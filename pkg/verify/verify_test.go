@@ -0,0 +1,184 @@
+package verify
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+// mapSource holds the blocks of a single height in memory
+type mapSource struct {
+	root   common.Hash
+	blocks map[string][]byte
+}
+
+func (s *mapSource) StateRoot(uint64) (common.Hash, error) { return s.root, nil }
+
+func (s *mapSource) Block(key string) ([]byte, error) { return s.blocks[key], nil }
+
+func (s *mapSource) ForEachBlock(_ uint64, fn func(string) error) error {
+	for key := range s.blocks {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildTrie builds a trie of the sorted key-value pairs, adding its nodes to the source.
+func (s *mapSource) buildTrie(codec uint64, kvs map[common.Hash][]byte) common.Hash {
+	var keys []common.Hash
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Big().Cmp(keys[j].Big()) < 0 })
+	st := trie.NewStackTrie(func(_ common.Hash, _ []byte, hash common.Hash, blob []byte) {
+		s.blocks[ipld.Keccak256ToCid(codec, hash.Bytes()).String()] = common.CopyBytes(blob)
+	})
+	for _, k := range keys {
+		st.MustUpdate(k.Bytes(), kvs[k])
+	}
+	root, err := st.Commit()
+	if err != nil {
+		panic(err)
+	}
+	return root
+}
+
+func newTestSource(t *testing.T) *mapSource {
+	s := &mapSource{blocks: make(map[string][]byte)}
+	slots := make(map[common.Hash][]byte)
+	for i := 0; i < 20; i++ {
+		val, _ := rlp.EncodeToBytes(big.NewInt(int64(i + 1)))
+		slots[crypto.Keccak256Hash(common.BigToHash(big.NewInt(int64(i))).Bytes())] = val
+	}
+	storageRoot := s.buildTrie(ipld.MEthStorageTrie, slots)
+
+	accounts := make(map[common.Hash][]byte)
+	for i := 0; i < 100; i++ {
+		account := types.StateAccount{
+			Nonce:    uint64(i),
+			Balance:  big.NewInt(int64(i)),
+			Root:     types.EmptyRootHash,
+			CodeHash: types.EmptyCodeHash.Bytes(),
+		}
+		// some accounts share a storage trie
+		if i%10 == 0 {
+			account.Root = storageRoot
+		}
+		data, err := rlp.EncodeToBytes(&account)
+		require.NoError(t, err)
+		accounts[crypto.Keccak256Hash([]byte(fmt.Sprint(i)))] = data
+	}
+	s.root = s.buildTrie(ipld.MEthStateTrie, accounts)
+	return s
+}
+
+func TestVerify(t *testing.T) {
+	source := newTestSource(t)
+	res, err := NewVerifier(source, rawdb.NewMemoryDatabase()).Verify(1)
+	require.NoError(t, err)
+	require.True(t, res.OK(), "%+v", res)
+	require.Equal(t, source.root, res.ComputedRoot)
+	require.Equal(t, uint64(100), res.Accounts)
+	require.Equal(t, len(source.blocks), int(res.StateNodes+res.StorageNodes))
+}
+
+func TestVerifyMissing(t *testing.T) {
+	source := newTestSource(t)
+	rootKey := ipld.Keccak256ToCid(ipld.MEthStateTrie, source.root.Bytes()).String()
+	var removed []string
+	// remove a state trie node other than the root
+	for key := range source.blocks {
+		if c, err := cid.Decode(key); err == nil && c.Type() == ipld.MEthStateTrie && key != rootKey {
+			delete(source.blocks, key)
+			removed = append(removed, key)
+			break
+		}
+	}
+	res, err := NewVerifier(source, rawdb.NewMemoryDatabase()).Verify(1)
+	require.NoError(t, err)
+	require.False(t, res.OK())
+	require.Equal(t, removed, res.Missing)
+	require.NotEqual(t, source.root, res.ComputedRoot)
+}
+
+func TestVerifyDangling(t *testing.T) {
+	source := newTestSource(t)
+	extra := &mapSource{blocks: source.blocks}
+	extra.buildTrie(ipld.MEthStorageTrie, map[common.Hash][]byte{
+		{1}: {1}, {2}: {2}, {3}: {3},
+	})
+	res, err := NewVerifier(source, rawdb.NewMemoryDatabase()).Verify(1)
+	require.NoError(t, err)
+	require.False(t, res.OK())
+	require.Empty(t, res.Missing)
+	require.Equal(t, source.root, res.ComputedRoot)
+	require.NotEmpty(t, res.Dangling)
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+	source := newTestSource(t)
+	rootKey := ipld.Keccak256ToCid(ipld.MEthStateTrie, source.root.Bytes()).String()
+	source.blocks[rootKey] = append(source.blocks[rootKey], 0)
+	res, err := NewVerifier(source, rawdb.NewMemoryDatabase()).Verify(1)
+	require.NoError(t, err)
+	require.Equal(t, []string{rootKey}, res.Missing)
+}
+
+func TestCSVSource(t *testing.T) {
+	source := newTestSource(t)
+	dir := t.TempDir()
+
+	var header []string
+	for _, col := range schema.TableHeader.Columns {
+		switch col.Name {
+		case "block_number":
+			header = append(header, "1")
+		case "state_root":
+			header = append(header, source.root.String())
+		default:
+			header = append(header, "")
+		}
+	}
+	writeCSV(t, filepath.Join(dir, "eth.header_cids.csv"), [][]string{header})
+	var blocks [][]string
+	for key, data := range source.blocks {
+		blocks = append(blocks, []string{"1", key, fmt.Sprintf(`\x%x`, data)})
+	}
+	// split between workers
+	writeCSV(t, filepath.Join(dir, "0", "ipld.blocks.csv"), blocks[:10])
+	writeCSV(t, filepath.Join(dir, "1", "ipld.blocks.csv"), blocks[10:])
+
+	db := rawdb.NewMemoryDatabase()
+	csvSource, err := NewCSVSource(dir, 1, db)
+	require.NoError(t, err)
+	res, err := NewVerifier(csvSource, db).Verify(1)
+	require.NoError(t, err)
+	require.True(t, res.OK(), "%+v", res)
+	require.Equal(t, len(source.blocks), int(res.StateNodes+res.StorageNodes))
+}
+
+func writeCSV(t *testing.T, path string, rows [][]string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	w := csv.NewWriter(f)
+	require.NoError(t, w.WriteAll(rows))
+}
@@ -4,6 +4,9 @@
 # Usage: compare-versions.sh [-d <output-dir>] <binary-A> <binary-B>
 #
 # Configure the input data using environment vars.
+#
+# Versions which write contract code differ from those which do not by the code rows of
+# ipld.blocks; this difference is expected.
 (
   set -u
   : $SNAPSHOT_BLOCK_HEIGHT
@@ -39,8 +42,8 @@ export DATABASE_PASSWORD="password"
 
 export ETH_CLIENT_NAME=test-client
 export ETH_NODE_ID=test-node
-export ETH_NETWORK_ID=test-network
-export ETH_CHAIN_ID=4242
+# ETH_CHAIN_ID and ETH_NETWORK_ID are read from the chain database if unset. Versions which cannot
+# read them need them set to the values of the chain, or public.nodes will differ.
 
 dump_table() {
   statement="copy (select * from $1) to stdout with csv"
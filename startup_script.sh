@@ -30,7 +30,6 @@ if [[ -n "$TARGET_UID" ]] && [[ -n "$TARGET_GID" ]]; then
     chown -R $TARGET_UID:$TARGET_GID /var/run/statediff
 fi
 
-START_TIME=`date -u +"%Y-%m-%dT%H:%M:%SZ"`
 echo "Running the snapshot service" && \
 if [[ -n "$LOG_FILE" ]]; then
   $SETUID /app/ipld-eth-state-snapshot "$VDB_COMMAND" $* |& $SETUID tee ${LOG_FILE}.console
@@ -39,25 +38,5 @@ else
   $SETUID /app/ipld-eth-state-snapshot "$VDB_COMMAND" $*
   rc=$?
 fi
-STOP_TIME=`date -u +"%Y-%m-%dT%H:%M:%SZ"`
-
-if [ $rc -eq 0 ] && [ "$VDB_COMMAND" == "stateSnapshot" ] && [ -n "$SNAPSHOT_BLOCK_HEIGHT" ]; then
-  cat >metadata.json <<EOF
-{
-  "type": "snapshot",
-  "range": { "start": $SNAPSHOT_BLOCK_HEIGHT, "stop": $SNAPSHOT_BLOCK_HEIGHT },
-  "nodeId": "$ETH_NODE_ID",
-  "genesisBlock": "$ETH_GENESIS_BLOCK",
-  "networkId": "$ETH_NETWORK_ID",
-  "chainId": "$ETH_CHAIN_ID",
-  "time": { "start": "$START_TIME", "stop": "$STOP_TIME" }
-}
-EOF
-  if [[ -n "$TARGET_UID" ]] && [[ -n "$TARGET_GID" ]]; then
-    echo 'metadata.json' | cpio -p --owner $TARGET_UID:$TARGET_GID $FILE_OUTPUT_DIR
-  else
-    cp metadata.json $FILE_OUTPUT_DIR
-  fi
-fi
 
 exit $rc